@@ -3,27 +3,38 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/client"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/logger"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/server"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/watcher"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		os.Exit(userCommand(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	var config string
-	var createUserFlag bool
-	var deleteUserFlag bool
+	var sessionsFlag bool
+	var killSession string
 
 	flag.StringVar(&config, "config", "config.yml", "specify configuration file for service.")
 	flag.StringVar(&config, "c", "config.yml", "specify configuration file for service.")
-	flag.BoolVar(&createUserFlag, "create-user", false, "create user")
-	flag.BoolVar(&deleteUserFlag, "delete-user", false, "delete user")
+	flag.BoolVar(&sessionsFlag, "sessions", false, "list sessions open on server (client config of an admin user)")
+	flag.StringVar(&killSession, "kill-session", "", "kill session with given id on server (client config of an admin user)")
 	flag.Parse()
 
 	lg := log.New(os.Stdout, "rfswatcher --> ", 1|4)
@@ -37,54 +48,179 @@ func main() {
 	}
 
 	clg.Printcf(logger.ColorBlue, "config rfswatcher : type: %s, address: %s, path: %s", cfg.ServiceType, cfg.Address, cfg.Path)
+	hash, err := filehandler.ParseHashAlgorithm(cfg.Hash)
+	if err != nil {
+		clg.Printcf(logger.ColorRed, "error rfswatcher : %v", err)
+		os.Exit(1)
+	}
+	symlinks, err := filehandler.ParseSymlinkPolicy(cfg.Symlinks)
+	if err != nil {
+		clg.Printcf(logger.ColorRed, "error rfswatcher : %v", err)
+		os.Exit(1)
+	}
+
+	flt, err := filter.Load(cfg.Path, cfg.Ignore)
+	if err != nil {
+		clg.Printcf(logger.ColorRed, "error rfswatcher : got error %v on loading ignore patterns", err)
+		os.Exit(1)
+	}
+
 	switch cfg.ServiceType {
 	case pkg.ServerType:
 		{
 			var um *user.UserManager = nil
 			if cfg.Server.PwFile != "" {
-				um := &user.UserManager{PwFile: cfg.Server.PwFile}
+				um = &user.UserManager{
+					PwFile:      cfg.Server.PwFile,
+					AclFile:     cfg.Server.AclFile,
+					MaxSessions: cfg.Server.MaxSessions,
+					TokenTTL:    cfg.Server.TokenTTL,
+					Cleartext:   cfg.Server.Cleartext,
+				}
 
 				if err := um.Init(); err != nil {
 					clg.Printcf(logger.ColorRed, "server error : failed user manager initiallazation. %v", err)
+					os.Exit(1)
 				}
 
-				if createUserFlag {
-					if err := um.CreateUser(nil); err != nil {
-						clg.Printcf(logger.ColorRed, "server error : failed to create user. %v", err)
-						os.Exit(1)
+				// users are reloaded when pwfile or aclfile is written and on SIGHUP.
+				reloaded := func(ended []string, err error) {
+					if err != nil {
+						clg.Printcf(logger.ColorRed, "server error : got error %v on reloading users, previous ones are kept !", err)
+						return
 					}
-					os.Exit(0)
-				} else if deleteUserFlag {
-					if err := um.DeleteUser(""); err != nil {
-						clg.Printcf(logger.ColorRed, "server error : failed to delete user. %v", err)
-						os.Exit(1)
-					}
-					os.Exit(0)
+					clg.Printcf(logger.ColorBlue, "server : users reloaded, sessions ended of %v", ended)
+				}
+				stop, err := um.WatchFiles(reloaded)
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "server error : got error %v on watching user files !", err)
+					os.Exit(1)
 				}
+				defer stop()
+
+				hup := make(chan os.Signal, 1)
+				signal.Notify(hup, syscall.SIGHUP)
+				go func() {
+					for range hup {
+						reloaded(um.Reload())
+					}
+				}()
+			}
+
+			if cfg.Path == "" && len(cfg.Server.Shares) == 0 {
+				clg.Printcf(logger.ColorRed, "server error : nothing to serve, set path or shares !")
+				os.Exit(1)
 			}
 
-			handler, err := filehandler.NewHandler(cfg.Path, lg)
+			slowConsumer, err := server.ParseSlowConsumerPolicy(cfg.Server.SlowConsumer)
 			if err != nil {
-				clg.Printcf(logger.ColorRed, "server error : got error %v on initiating file handler !", err)
+				clg.Printcf(logger.ColorRed, "server error : %v", err)
 				os.Exit(1)
 			}
+
+			options := []server.Option{
+				server.WithQueueSize(cfg.Server.QueueSize),
+				server.WithSlowConsumerPolicy(slowConsumer),
+				server.WithHeartbeat(cfg.Server.Heartbeat),
+			}
+			if cfg.Server.Sync {
+				policy, err := server.ParseConflictPolicy(cfg.Server.Conflict)
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "server error : %v", err)
+					os.Exit(1)
+				}
+				options = append(options, server.WithSync(policy))
+			}
+
+			// watched directories, with hooks of their handler and share.
+			type watched struct {
+				path    string
+				filter  *filter.Filter
+				handler *filehandler.Handler
+				hook    func(e model.Event, err error)
+			}
+			var watches []watched
+
+			var handler *filehandler.Handler
+			if cfg.Path != "" {
+				handler, err = filehandler.NewHandler(cfg.Path, lg, filehandler.WithHash(hash), filehandler.WithSymlinks(symlinks), filehandler.WithFilter(flt))
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "server error : got error %v on initiating file handler !", err)
+					os.Exit(1)
+				}
+				j, err := journal.Open(cfg.Server.Journal.Path, cfg.Server.Journal.Size)
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "server error : got error %v on opening journal !", err)
+					os.Exit(1)
+				}
+				defer j.Close()
+
+				options = append(options, server.WithJournal(j), server.WithFilter(flt))
+			}
+
+			names := make(map[string]struct{})
+			for _, sc := range cfg.Server.Shares {
+				if _, ok := names[sc.Name]; ok || sc.Name == "" || sc.Path == "" {
+					clg.Printcf(logger.ColorRed, "server error : share %q needs a unique name and a path !", sc.Name)
+					os.Exit(1)
+				}
+				names[sc.Name] = struct{}{}
+
+				sflt, err := filter.Load(sc.Path, append(append([]string{}, cfg.Ignore...), sc.Ignore...))
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "server error : got error %v on loading ignore patterns of share %q !", err, sc.Name)
+					os.Exit(1)
+				}
+				h, err := filehandler.NewHandler(sc.Path, lg, filehandler.WithHash(hash), filehandler.WithSymlinks(symlinks), filehandler.WithFilter(sflt))
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "server error : got error %v on initiating file handler of share %q !", err, sc.Name)
+					os.Exit(1)
+				}
+				j, err := journal.Open(sc.Journal.Path, sc.Journal.Size)
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "server error : got error %v on opening journal of share %q !", err, sc.Name)
+					os.Exit(1)
+				}
+				defer j.Close()
+
+				sh := server.NewShare(sc.Name, sc.Path, h,
+					server.WithShareJournal(j),
+					server.WithShareFilter(sflt),
+					server.WithShareUsers(sc.Users...))
+				options = append(options, server.WithShare(sh))
+				watches = append(watches, watched{path: sc.Path, filter: sflt, handler: h, hook: sh.EventHook})
+			}
+
 			var tls *server.ServerTLS = nil
-			if cfg.Server.TLS.Cert != "" || cfg.Server.TLS.Key != "" {
-				tls = &server.ServerTLS{Cert: cfg.Server.TLS.Cert, Key: cfg.Server.TLS.Key}
+			if cfg.Server.TLS != (pkg.ServerTLSConfig{}) {
+				tls = &server.ServerTLS{
+					Cert:              cfg.Server.TLS.Cert,
+					Key:               cfg.Server.TLS.Key,
+					ClientCA:          cfg.Server.TLS.ClientCA,
+					RequireClientCert: cfg.Server.TLS.RequireClientCert,
+				}
 			}
-			srv := server.NewServer(cfg.Address, cfg.Path, tls, um, lg, handler)
+			srv := server.NewServer(cfg.Address, cfg.Path, tls, um, lg, handler, options...)
 			defer srv.Exit()
 
-			watch, err := watcher.NewWatcher(cfg.Path,
-				watcher.WithCallbackFunction(handler.EventHook),
-				watcher.WithCallbackFunction(srv.EventHook))
-
-			if err != nil {
-				clg.Printcf(logger.ColorRed, "server error : got error %v on watcher !", err)
-				os.Exit(1)
+			if handler != nil {
+				watches = append(watches, watched{path: cfg.Path, filter: flt, handler: handler, hook: srv.EventHook})
 			}
+			for _, w := range watches {
+				watch, err := watcher.NewWatcher(w.path,
+					watcher.WithIgnore(filehandler.IsStaging),
+					watcher.WithFilter(w.filter),
+					watcher.WithFollowSymlinks(symlinks == filehandler.SymlinkFollowWithinRoot),
+					watcher.WithCallbackFunction(w.handler.EventHook),
+					watcher.WithCallbackFunction(w.hook))
+
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "server error : got error %v on watcher of %s !", err, w.path)
+					os.Exit(1)
+				}
 
-			defer watch.Close()
+				defer watch.Close()
+			}
 
 			err = srv.Run()
 			if err != nil {
@@ -94,21 +230,72 @@ func main() {
 		}
 	case pkg.ClientType:
 		{
-			handler, err := filehandler.NewHandler(cfg.Path, lg)
+			handler, err := filehandler.NewHandler(cfg.Path, lg, filehandler.WithHash(hash), filehandler.WithSymlinks(symlinks), filehandler.WithFilter(flt))
 			if err != nil {
 				clg.Printcf(logger.ColorRed, "client error : got error %v on initiating file handler !", err)
 				os.Exit(1)
 			}
 
 			var tlsCfg *tls.Config
-			if cfg.Client.TLS {
-				tlsCfg = &tls.Config{}
+			if cfg.Client.TLS || cfg.Client.TLSCA != "" || cfg.Client.TLSCert != "" || cfg.Client.TLSKey != "" {
+				tlsCfg, err = client.TLSConfig(cfg.Client.TLSCA, cfg.Client.TLSCert, cfg.Client.TLSKey)
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "client error : got error %v on loading tls configuration !", err)
+					os.Exit(1)
+				}
+			}
+
+			cli, err := client.NewClient(cfg.Address, cfg.Client.Username, cfg.Client.Password, tlsCfg, lg, handler,
+				client.WithPrune(cfg.Client.Prune),
+				client.WithDelta(cfg.Client.Delta),
+				client.WithOwner(cfg.Client.Owner),
+				client.WithFilter(flt),
+				client.WithShare(cfg.Client.Share),
+				client.WithPaths(cfg.Client.Paths...),
+				client.WithSync(cfg.Client.Sync),
+				client.WithLegacyPassword(cfg.Client.Legacy),
+				client.WithHeartbeatTimeout(cfg.Client.HeartbeatTimeout),
+				client.WithReconnectDelay(cfg.Client.ReconnectDelay, cfg.Client.ReconnectMaxDelay))
+			if err != nil {
+				clg.Printcf(logger.ColorRed, "client error : got error %v on subscribed paths !", err)
+				os.Exit(1)
+			}
+
+			if sessionsFlag {
+				sessions, err := cli.Sessions()
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "client error : failed to list sessions. %v", err)
+					os.Exit(1)
+				}
+				for _, s := range sessions {
+					fmt.Printf("%s\t%s\t%s\t%s\t%d\n", s.Id, s.Username, s.Addr, s.Started.Format(time.RFC3339), s.Conns)
+				}
+				os.Exit(0)
+			} else if killSession != "" {
+				if err := cli.KillSession(killSession); err != nil {
+					clg.Printcf(logger.ColorRed, "client error : failed to kill session. %v", err)
+					os.Exit(1)
+				}
+				os.Exit(0)
+			}
+
+			if cfg.Client.Sync {
+				watch, err := watcher.NewWatcher(cfg.Path,
+					watcher.WithIgnore(filehandler.IsStaging),
+					watcher.WithFilter(flt),
+					watcher.WithFollowSymlinks(symlinks == filehandler.SymlinkFollowWithinRoot),
+					watcher.WithCallbackFunction(handler.EventHook),
+					watcher.WithCallbackFunction(cli.EventHook))
+				if err != nil {
+					clg.Printcf(logger.ColorRed, "client error : got error %v on watcher of %s !", err, cfg.Path)
+					os.Exit(1)
+				}
+				defer watch.Close()
 			}
 
-			cli := client.NewClient(cfg.Address, cfg.Client.Username, cfg.Client.Password, tlsCfg, lg, handler)
 			err = cli.Run()
 			if err != nil {
-				clg.Printcf(logger.ColorRed, "client error : got error %v on initialize connection with server !!", err)
+				clg.Printcf(logger.ColorRed, "client error : got error %v on connection with server !!", err)
 				os.Exit(1)
 			}
 		}
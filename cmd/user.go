@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
+	"golang.org/x/term"
+)
+
+// exit codes of user command.
+const (
+	exitOk    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+var errPasswordMismatch = errors.New("passwords don't match")
+
+const userUsage = `usage: rfswatcher user <command> [flags] [username]
+
+flags come before the username, flags after it are taken as arguments.
+
+commands:
+  add <username>     create a user
+  del <username>     delete a user
+  passwd <username>  change password of a user
+  list               list users, their state and password verifier
+  lock <username>    refuse logins of a user, password is kept
+  unlock <username>  accept logins of a locked user again
+
+password of add and passwd is read from -password-env, -password-stdin or a
+terminal prompt without echo.
+
+flags:
+`
+
+// userCommand
+// manage users of server password file, returns process exit code. messages
+// go to stderr, only list writes to stdout.
+func userCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("rfswatcher user", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, userUsage)
+		fs.PrintDefaults()
+	}
+
+	var config, pwFile, passwordEnv string
+	var passwordStdin bool
+	fs.StringVar(&config, "config", "config.yml", "server configuration file, its pwfile is managed.")
+	fs.StringVar(&config, "c", "config.yml", "server configuration file, its pwfile is managed.")
+	fs.StringVar(&pwFile, "pwfile", "", "password file to manage instead of the one of configuration file.")
+	fs.StringVar(&passwordEnv, "password-env", "", "read password from given environment variable.")
+	fs.BoolVar(&passwordStdin, "password-stdin", false, "read password from first line of stdin.")
+
+	if len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	command := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOk
+		}
+		return exitUsage
+	}
+
+	usage := func(format string, a ...any) int {
+		fmt.Fprintf(stderr, "user error : "+format+"\n", a...)
+		fs.Usage()
+		return exitUsage
+	}
+	fail := func(err error) int {
+		// joined errors are printed on one line.
+		fmt.Fprintf(stderr, "user error : %s %s\n", command, strings.ReplaceAll(err.Error(), "\n", ": "))
+		return exitError
+	}
+
+	var username string
+	switch command {
+	case "list":
+		if fs.NArg() != 0 {
+			return usage("list takes no username")
+		}
+	case "add", "del", "passwd", "lock", "unlock":
+		if fs.NArg() > 1 && strings.HasPrefix(fs.Arg(1), "-") {
+			return usage("flag %s after username, flags come before it", fs.Arg(1))
+		}
+		if fs.NArg() != 1 {
+			return usage("%s takes one username", command)
+		}
+		username = fs.Arg(0)
+	default:
+		return usage("unknown command %q", command)
+	}
+
+	if pwFile == "" {
+		cfg, err := pkg.ReadConfig(config)
+		if err != nil {
+			return fail(fmt.Errorf("reading configuration file %s: %w", config, err))
+		}
+		if cfg.Server.PwFile == "" {
+			return fail(fmt.Errorf("pwfile is not set in server configuration %s", config))
+		}
+		pwFile = cfg.Server.PwFile
+	}
+
+	um := &user.UserManager{PwFile: pwFile}
+	if err := um.Init(); err != nil {
+		return fail(fmt.Errorf("loading password file %s: %w", pwFile, err))
+	}
+
+	var err error
+	switch command {
+	case "add", "passwd":
+		var password string
+		password, err = readPassword(username, passwordEnv, passwordStdin, stdin, stderr)
+		if err != nil {
+			break
+		}
+		if command == "add" {
+			err = um.CreateUser(&user.Creadential{Username: username, Password: password})
+		} else {
+			err = um.SetPassword(username, password)
+		}
+	case "del":
+		err = um.DeleteUser(username)
+	case "lock":
+		err = um.Lock(username)
+	case "unlock":
+		err = um.Unlock(username)
+	case "list":
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tSTATE\tVERIFIER")
+		for _, u := range um.Users() {
+			state, verifier := "active", "scram-sha-256"
+			if u.Locked {
+				state = "locked"
+			}
+			if u.Legacy {
+				verifier = "bcrypt"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", u.Username, state, verifier)
+		}
+		err = w.Flush()
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+	if username != "" {
+		fmt.Fprintf(stderr, "user : %s %s done\n", command, username)
+	}
+	return exitOk
+}
+
+// readPassword
+// password from environment variable, first line of stdin or, when stdin is
+// a terminal, a prompt without echo asking twice.
+func readPassword(username, env string, fromStdin bool, stdin io.Reader, stderr io.Writer) (string, error) {
+	switch {
+	case env != "":
+		password, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", env)
+		}
+		return password, nil
+	case fromStdin:
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", fmt.Errorf("reading password from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	f, ok := stdin.(*os.File)
+	if !ok || !term.IsTerminal(int(f.Fd())) {
+		return "", errors.New("stdin is not a terminal, use -password-stdin or -password-env")
+	}
+
+	fmt.Fprintf(stderr, "Password for %s: ", username)
+	password, err := term.ReadPassword(int(f.Fd()))
+	fmt.Fprintln(stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(stderr, "Confirm password for %s: ", username)
+	confirm, err := term.ReadPassword(int(f.Fd()))
+	fmt.Fprintln(stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(confirm) {
+		return "", errPasswordMismatch
+	}
+	return string(password), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserCommand(t *testing.T) {
+	pwFile := filepath.Join(t.TempDir(), "pwfile")
+	require.NoError(t, os.WriteFile(pwFile, nil, 0600))
+	t.Setenv("RFSWATCHER_TEST_PASSWORD", "from-env")
+
+	// cases run in order on the same password file.
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		code   int
+		stderr string
+		stdout string
+	}{
+		{name: "no command", args: nil, code: exitUsage, stderr: "usage:"},
+		{name: "help", args: []string{"list", "-h"}, code: exitOk, stderr: "usage:"},
+		{name: "unknown command", args: []string{"rename", "alice"}, code: exitUsage, stderr: `unknown command "rename"`},
+		{name: "unknown flag", args: []string{"add", "-force", "alice"}, code: exitUsage},
+		{name: "add without username", args: []string{"add", "-pwfile", pwFile}, code: exitUsage, stderr: "add takes one username"},
+		{name: "list with username", args: []string{"list", "-pwfile", pwFile, "alice"}, code: exitUsage, stderr: "list takes no username"},
+		{name: "flag after username", args: []string{"add", "-pwfile", pwFile, "alice", "-password-stdin"}, stdin: "secret\n", code: exitUsage, stderr: "flags come before it"},
+		{name: "missing config", args: []string{"list", "-c", filepath.Join(t.TempDir(), "config.yml")}, code: exitError, stderr: "reading configuration file"},
+
+		{name: "add from stdin", args: []string{"add", "-pwfile", pwFile, "-password-stdin", "alice"}, stdin: "secret\n", code: exitOk, stderr: "add alice done"},
+		{name: "add existing", args: []string{"add", "-pwfile", pwFile, "-password-stdin", "alice"}, stdin: "secret\n", code: exitError, stderr: user.ErrUsernameExists.Error()},
+		{name: "add from env", args: []string{"add", "-pwfile", pwFile, "-password-env", "RFSWATCHER_TEST_PASSWORD", "bob"}, code: exitOk},
+		{name: "add from unset env", args: []string{"add", "-pwfile", pwFile, "-password-env", "RFSWATCHER_TEST_UNSET", "carol"}, code: exitError, stderr: "RFSWATCHER_TEST_UNSET is not set"},
+		{name: "add without terminal", args: []string{"add", "-pwfile", pwFile, "carol"}, code: exitError, stderr: "stdin is not a terminal"},
+		{name: "add empty password", args: []string{"add", "-pwfile", pwFile, "-password-stdin", "carol"}, stdin: "\n", code: exitError, stderr: user.ErrEmptyPassword.Error()},
+		{name: "passwd from stdin", args: []string{"passwd", "-pwfile", pwFile, "-password-stdin", "bob"}, stdin: "changed", code: exitOk},
+		{name: "passwd unknown", args: []string{"passwd", "-pwfile", pwFile, "-password-stdin", "nobody"}, stdin: "secret\n", code: exitError, stderr: user.ErrUnknownUser.Error()},
+		{name: "lock", args: []string{"lock", "-pwfile", pwFile, "alice"}, code: exitOk},
+		{name: "lock unknown", args: []string{"lock", "-pwfile", pwFile, "nobody"}, code: exitError, stderr: user.ErrUnknownUser.Error()},
+		{name: "unlock unknown", args: []string{"unlock", "-pwfile", pwFile, "nobody"}, code: exitError, stderr: user.ErrUnknownUser.Error()},
+		{name: "del unknown", args: []string{"del", "-pwfile", pwFile, "nobody"}, code: exitError, stderr: user.ErrUnknownUser.Error()},
+		{name: "list", args: []string{"list", "-pwfile", pwFile}, code: exitOk, stdout: "alice     locked"},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := userCommand(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+		assert.Equal(t, tt.code, code, "%s: %s", tt.name, stderr.String())
+		assert.Contains(t, stderr.String(), tt.stderr, tt.name)
+		assert.Contains(t, stdout.String(), tt.stdout, tt.name)
+		if tt.args != nil && tt.args[0] != "list" {
+			assert.Empty(t, stdout.String(), "%s: only list writes to stdout", tt.name)
+		}
+	}
+
+	um := &user.UserManager{PwFile: pwFile}
+	require.NoError(t, um.Init())
+	assert.True(t, um.CheckUserPassword("bob", "changed"), "password of last line without newline")
+	assert.False(t, um.HasUser("carol"))
+	assert.False(t, um.Active("alice"))
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, exitOk, userCommand([]string{"del", "-pwfile", pwFile, "alice"}, strings.NewReader(""), &stdout, &stderr))
+	require.NoError(t, um.Init())
+	assert.False(t, um.HasUser("alice"))
+}
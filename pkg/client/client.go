@@ -1,15 +1,19 @@
 package client
 
 import (
-	"bufio"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand/v2"
 	"net"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
 )
@@ -20,11 +24,115 @@ var (
 	ErrClientWritePacket             = errors.New("failed to write packet to connection")
 	ErrClientInconsistentWrite       = errors.New("inconsistent data write: bytes written mismatch")
 	ErrClientAuthenticationFailed    = errors.New("authentication failed")
+	ErrClientTooManySessions         = errors.New("server refused login, user has too many sessions")
+	ErrClientSubscriptionRejected    = errors.New("subscription rejected by server")
 	ErrClientInvalidPacketType       = errors.New("invalid packet type received")
 	ErrClientUnmarshalResponsePacket = errors.New("failed to unmarshal response packet data")
 	ErrClientReadDeadline            = errors.New("failed to set read deadline on connection")
+	ErrClientFileResponse            = errors.New("server refused file request")
+	ErrClientChunkOffset             = errors.New("unexpected file chunk offset")
+	ErrClientChecksumMismatch        = errors.New("received file checksum mismatch")
+	ErrClientHeartbeatTimeout        = errors.New("no heartbeat received from server")
+	ErrClientPermissionDenied        = errors.New("permission denied by server")
+	ErrClientServerSignature         = errors.New("server signature mismatch, server doesn't know the password verifier")
+	ErrClientPaths                   = errors.New("invalid subscribed paths")
 )
 
+const (
+	defaultMinReconnectDelay = time.Millisecond * 500
+	defaultMaxReconnectDelay = time.Second * 30
+	defaultHeartbeatTimeout  = time.Second * 30
+)
+
+type Option func(c *Client)
+
+// WithPrune
+// remove local files which doesn't exist on server during initial sync.
+func WithPrune(prune bool) Option {
+	return func(c *Client) {
+		c.prune = prune
+	}
+}
+
+// WithDelta
+// send signature of local copy when requesting a file, so only changed parts
+// are transferred.
+func WithDelta(delta bool) Option {
+	return func(c *Client) {
+		c.delta = delta
+	}
+}
+
+// WithReconnectDelay
+// bounds of the exponential backoff between reconnect attempts.
+func WithReconnectDelay(min time.Duration, max time.Duration) Option {
+	return func(c *Client) {
+		if min > 0 {
+			c.minDelay = min
+		}
+		if max > 0 {
+			c.maxDelay = max
+		}
+	}
+}
+
+// WithHeartbeatTimeout
+// server is considered dead when nothing is received for given duration, it
+// should be a few times the server heartbeat interval.
+func WithHeartbeatTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		if timeout > 0 {
+			c.heartbeatTimeout = timeout
+		}
+	}
+}
+
+// WithOwner
+// apply owner (uid and gid) of server files to local copies, it needs
+// privileges to change file owner.
+func WithOwner(owner bool) Option {
+	return func(c *Client) {
+		c.owner = owner
+	}
+}
+
+// WithFilter
+// changes of names matching filter are not applied locally, and local files
+// matching it are never pruned.
+func WithFilter(f *filter.Filter) Option {
+	return func(c *Client) {
+		c.filter = f
+	}
+}
+
+// WithPaths
+// sub paths or glob patterns under server root to mirror, only their changes
+// are received and only local files under them are pruned. none means the
+// whole root.
+func WithPaths(paths ...string) Option {
+	return func(c *Client) {
+		c.paths = paths
+	}
+}
+
+// WithShare
+// name of the server share to mirror, server default share when empty.
+func WithShare(name string) Option {
+	return func(c *Client) {
+		c.share = name
+	}
+}
+
+// WithLegacyPassword
+// answer a server asking for the password in clear, as it does for users
+// from before SCRAM, on connections without tls. an observer of such a
+// connection learns the password.
+func WithLegacyPassword(legacy bool) Option {
+	return func(c *Client) {
+		c.legacy = legacy
+	}
+}
+
 type Client struct {
 	tls      *tls.Config
 	address  string
@@ -34,9 +142,46 @@ type Client struct {
 	f        *filehandler.Handler
 	exit     chan struct{}
 	download chan protocol.FileMetaPayload
+	prune    bool
+	delta    bool
+	owner    bool
+	legacy   bool
+	remote   *remoteTree
+	filter   *filter.Filter
+	share    string
+	paths    []string
+	scope    *filter.Scope
+	rejected atomic.Uint64
+	sync     bool
+	host     string
+	push     *pushQueue
+
+	// synced
+	// server versions local copies were last synced with, by a download, a
+	// push or a listing entry local copy already matched. it is the base of
+	// pushed changes, and tells a local file server deleted from a new one.
+	synced *remoteTree
+
+	// login
+	// session opened by subscription connection, transfer connections join it.
+	login atomic.Pointer[login]
+
+	// journal and sequence number of the last change received from server,
+	// used to resume subscription after reconnect.
+	journal string
+	seq     uint64
+
+	// failed
+	// a received change couldn't be applied locally, resuming after it would
+	// skip it for good, so next subscription asks for a full listing.
+	failed atomic.Bool
+
+	minDelay         time.Duration
+	maxDelay         time.Duration
+	heartbeatTimeout time.Duration
 }
 
-func NewClient(address string, username string, password string, tls *tls.Config, logger *log.Logger, f *filehandler.Handler) *Client {
+func NewClient(address string, username string, password string, tls *tls.Config, logger *log.Logger, f *filehandler.Handler, options ...Option) (*Client, error) {
 	c := Client{
 		tls:      tls,
 		address:  address,
@@ -46,11 +191,43 @@ func NewClient(address string, username string, password string, tls *tls.Config
 		f:        f,
 		exit:     make(chan struct{}),
 		download: make(chan protocol.FileMetaPayload, 1),
+		push:     newPushQueue(),
+		remote:   newRemoteTree(),
+		synced:   newRemoteTree(),
+		filter:   filter.Default(),
+
+		minDelay:         defaultMinReconnectDelay,
+		maxDelay:         defaultMaxReconnectDelay,
+		heartbeatTimeout: defaultHeartbeatTimeout,
+	}
+
+	for _, op := range options {
+		op(&c)
 	}
 
+	// server validates subscribed paths too, it rejects the subscription
+	// before any listing is sent.
+	clean := make([]string, 0, len(c.paths))
+	for _, p := range c.paths {
+		name, err := filehandler.CleanName(p)
+		if err != nil {
+			return nil, errors.Join(ErrClientPaths, fmt.Errorf("path %q", p), err)
+		}
+		clean = append(clean, name)
+	}
+	sc, err := filter.NewScope(clean...)
+	if err != nil {
+		return nil, errors.Join(ErrClientPaths, err)
+	}
+	c.scope = sc
+
 	go c.downloader() // run download daemon
+	if c.sync {
+		c.host, _ = os.Hostname()
+		go c.pusher()
+	}
 
-	return &c
+	return &c, nil
 }
 
 func (c *Client) Exit() error {
@@ -58,85 +235,231 @@ func (c *Client) Exit() error {
 	return nil
 }
 
-func (c *Client) Run() error {
-	var conn net.Conn
+func (c *Client) dial() (net.Conn, error) {
 	if c.tls != nil {
-		_conn, err := tls.Dial("tcp", c.address, c.tls)
-		if err != nil {
-			return err
+		return tls.Dial("tcp", c.address, c.tls)
+	}
+
+	return net.Dial("tcp", c.address)
+}
+
+// Run
+// keep a subscription to the server, connection is re-established with
+// exponential backoff whenever it fails. server sends its listing on every
+// subscription, so changes missed while disconnected are caught up.
+// returns on Exit or when server rejects the credentials or subscription,
+// a client whose session was killed is rejected. a login refused for too
+// many sessions is retried.
+func (c *Client) Run() error {
+	delay := c.minDelay
+	for {
+		subscribed, err := c.session()
+
+		select {
+		case <-c.exit:
+			return nil
+		default:
 		}
 
-		conn = _conn
-	} else {
-		_conn, err := net.Dial("tcp", c.address)
-		if err != nil {
+		if errors.Is(err, ErrClientAuthenticationFailed) || errors.Is(err, ErrClientSubscriptionRejected) {
 			return err
 		}
 
-		conn = _conn
+		if subscribed {
+			delay = c.minDelay
+		}
+
+		// full jitter in [delay/2, delay] keeps clients from reconnecting in lockstep.
+		wait := delay/2 + rand.N(delay/2+1)
+		c.logger.Printf("client error :: connection to %s failed %v, reconnect in %v\n", c.address, err, wait)
+
+		select {
+		case <-c.exit:
+			return nil
+		case <-time.After(wait):
+		}
+
+		delay = min(delay*2, c.maxDelay)
+	}
+}
+
+// session
+// single subscription connection, returns when connection fails or no packet
+// (heartbeat included) is received within heartbeat timeout.
+func (c *Client) session() (subscribed bool, err error) {
+	conn, err := c.dial()
+	if err != nil {
+		return false, err
 	}
+	defer conn.Close()
+
+	// unblock reads on exit.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.exit:
+			conn.Close()
+		case <-done:
+		}
+	}()
 
-	c.Auth(conn, c.username, c.password)
+	// previous session ended with its connection, subscription opens a new
+	// one. server refuses it when previous one was killed. transfers keep the
+	// previous login until the new one replaces it, see connect.
+	var previous string
+	if l := c.login.Load(); l != nil {
+		previous = l.session
+	}
+	l, err := c.join(conn, protocol.JoinPayload{Username: c.username, Password: c.password, Previous: previous})
+	if err != nil {
+		return false, err
+	}
+	if l.session != "" {
+		c.login.Store(&l)
+	} else {
+		c.login.Store(nil)
+	}
 
 	c.logger.Printf("client :: connected to host %s ...\n", c.address)
 
+	// resume from the last change, server falls back to listing when it can't.
+	from := c.seq
+	if c.failed.Swap(false) {
+		c.logger.Printf("client :: a change failed to apply, request full listing\n")
+		from = 0
+	}
+	reqPayload, _ := json.Marshal(protocol.SubscribePathPayload{
+		Share:   c.share,
+		Paths:   c.paths,
+		Journal: c.journal,
+		From:    from,
+	})
 	req := protocol.Data{
 		Sec:     0,
 		Time:    time.Now(),
 		Type:    protocol.SubscribePath,
 		Heading: nil,
-		Payload: nil,
+		Payload: reqPayload,
 	}
-	rb, err := json.Marshal(req)
+	err = protocol.NewEncoder(conn).Encode(&req)
 	if err != nil {
-		c.logger.Printf("client error :: got error %v on marshal subscribe request\n", err)
-		return err
+		return false, errors.Join(ErrClientWritePacket, err)
 	}
 
-	rb = append(rb, '@')
-	n, err := conn.Write(rb)
-	if n != len(rb) || err != nil {
-		c.logger.Printf("client error :: send subscribe request %v\n", err)
-		return err
-	}
-
-	r := bufio.NewReader(conn)
+	dec := protocol.NewDecoder(conn)
+	var listing []protocol.FileMetaPayload
 	for {
-		select {
-		case <-c.exit:
-			return conn.Close()
-		default:
-			err = conn.SetReadDeadline(time.Now().Add(time.Second * 10))
+		err = conn.SetReadDeadline(time.Now().Add(c.heartbeatTimeout))
+		if err != nil {
+			return subscribed, errors.Join(ErrClientReadDeadline, err)
+		}
+
+		d := protocol.Data{}
+		err = dec.Decode(&d)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return subscribed, errors.Join(ErrClientHeartbeatTimeout, err)
+		}
+		if err != nil {
+			return subscribed, errors.Join(ErrClientReadPacket, err)
+		}
+
+		switch d.Type {
+		case protocol.Heartbeat:
+		case protocol.ChangeNotify:
+			payload := protocol.FileMetaPayload{}
+			err = json.Unmarshal(d.Payload, &payload)
 			if err != nil {
-				c.logger.Printf("client error :: got error %v\n", err)
+				c.logger.Printf("client :: error invalid file notify change payload %v, %T\n", string(d.Payload), d.Payload)
 				continue
 			}
-			data, err := r.ReadBytes('@')
+
+			c.remote.apply(payload)
+			if !c.queue(payload) {
+				return subscribed, nil
+			}
+			c.seq = max(c.seq, d.Sec)
+		case protocol.FilesList:
+			page := protocol.PathFiles{}
+			err = json.Unmarshal(d.Payload, &page)
 			if err != nil {
+				c.logger.Printf("client :: error invalid files list payload %v\n", err)
 				continue
 			}
 
-			d := protocol.Data{}
-			err = json.Unmarshal(data[:len(data)-1], &d)
-			if err != nil {
-				c.logger.Printf("client error :: got error %v on unmarshalling data %s\n", err, string(data))
+			if page.Resume {
+				c.logger.Printf("client :: resume from change %d\n", d.Sec)
+				subscribed = true
+				c.journal, c.seq = page.Journal, d.Sec
 				continue
 			}
 
-			if d.Type == protocol.ChangeNotify {
-				payload := protocol.FileMetaPayload{}
-				err = json.Unmarshal(d.Payload, &payload)
-				if err != nil {
-					c.logger.Printf("client :: error invalid file notify change payload %v, %T\n", string(d.Payload), d.Payload)
-					continue
-				}
-
-				c.download <- payload
-			} else {
-				c.logger.Printf("client :: got data %v !!\n", d)
+			listing = append(listing, page.Files...)
+			if page.Last {
+				subscribed = true
+				c.remote.reset(listing)
+				c.syncListing(listing)
+				c.journal, c.seq = page.Journal, d.Sec
+				listing = nil
 			}
+		case protocol.Error:
+			return subscribed, errors.Join(ErrClientSubscriptionRejected, errorFrame(d))
+		default:
+			c.logger.Printf("client :: got data %v !!\n", d)
+		}
+	}
+}
+
+// queue
+// hand a change to the downloader, false when client exits first. a full
+// queue doesn't hold Exit back.
+func (c *Client) queue(e protocol.FileMetaPayload) bool {
+	select {
+	case c.download <- e:
+		return true
+	case <-c.exit:
+		return false
+	}
+}
+
+// RejectedPaths
+// number of server notifications refused because their name escapes local path.
+func (c *Client) RejectedPaths() uint64 {
+	return c.rejected.Load()
+}
+
+// checkNames
+// names of a notification are received from server, they must stay under
+// local path.
+func (c *Client) checkNames(e protocol.FileMetaPayload) error {
+	if _, err := filehandler.CleanName(e.FileName); err != nil {
+		return err
+	}
+	if e.Op.Has(model.Move) {
+		if _, err := filehandler.CleanName(e.From); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// ignored
+// check whether notification is about a filtered name. a name moved from a
+// filtered one is not, it is downloaded when there is nothing to rename.
+func (c *Client) ignored(e protocol.FileMetaPayload) bool {
+	dir := e.Op.Has(model.Mkdir) || e.Op.Has(model.Rmdir)
+	if m := c.f.GetMeta(e.FileName); m != nil {
+		dir = dir || m.Dir
+	}
+	return c.filter.Match(e.FileName, dir)
+}
+
+// applyFailed
+// log a change which couldn't be applied locally and mark it for next
+// subscription.
+func (c *Client) applyFailed(format string, a ...any) {
+	c.failed.Store(true)
+	c.logger.Printf(format, a...)
 }
 
 func (c *Client) downloader() {
@@ -145,93 +468,106 @@ func (c *Client) downloader() {
 			select {
 			case e := <-c.download:
 				{
-					if e.Op.Has(model.Write) {
-						// download file
-						var conn net.Conn
-						if c.tls != nil {
-							_conn, err := tls.Dial("tcp", c.address, c.tls)
-							if err != nil {
-								c.logger.Printf("client worker :: error establish download connection %v\n", err)
-								continue
-							}
-
-							conn = _conn
+					if err := c.checkNames(e); err != nil {
+						c.rejected.Add(1)
+						c.logger.Printf("client worker ERROR :: rejected notification %v, %v\n", e, err)
+						continue
+					}
+					if c.ignored(e) {
+						c.logger.Printf("client worker :: skip ignored file %s\n", e.FileName)
+						continue
+					}
+					if e.Op.Has(model.Write) && e.Link != "" {
+						// symbolic link copied as link, nothing to download.
+						if lm := c.f.GetMeta(e.FileName); lm != nil && lm.Link == e.Link {
+							c.synced.apply(e)
+							continue
+						}
+						c.logger.Printf("client worker :: link notification %v !!\n", e)
+						err := c.f.MakeLink(e.FileName, e.Link)
+						if errors.Is(err, filehandler.ErrUnsafePath) {
+							c.rejected.Add(1)
+							c.logger.Printf("client worker ERROR :: rejected link %s, %v\n", e.FileName, err)
+						} else if err != nil {
+							c.applyFailed("client worker ERROR :: error %v on create link %s !!\n", err, e.FileName)
 						} else {
-							_conn, err := net.Dial("tcp", c.address)
-							if err != nil {
-								c.logger.Printf("client worker :: error establish download connection %v\n", err)
-								continue
-							}
-
-							conn = _conn
+							c.synced.apply(e)
 						}
-
-						if err := c.Auth(conn, c.username, c.password); err != nil {
+						continue
+					}
+					if e.Op.Has(model.Write) {
+						// duplicated or no-op change, local copy is already identical.
+						if c.f.SameContent(e.FileName, e.Hash) {
+							c.logger.Printf("client worker :: file %s is up to date, skip download\n", e.FileName)
+							c.synced.apply(e)
 							continue
 						}
-
-						reqPayload, _ := json.Marshal(protocol.RequestFilePayload{
-							Path:       e.Path,
-							FileName:   e.FileName,
-							ChangeDate: e.ChangeDate,
-						})
-						req := protocol.Data{
-							Sec:     0,
-							Time:    time.Now(),
-							Type:    protocol.RequestFile,
-							Heading: nil,
-							Payload: reqPayload,
-						}
-
-						rb, err := json.Marshal(req)
-						if err != nil {
-							c.logger.Printf("client worker :: got error %v on marshal subscribe request\n", err)
+						// download file
+						if err := c.requestFile(e); err != nil {
+							c.applyFailed("client worker ERROR :: error %v on receiving file %s !!\n", err, e.FileName)
 							continue
 						}
-
-						rb = append(rb, '@')
-						n, err := conn.Write(rb)
-						if n != len(rb) || err != nil {
-							c.logger.Printf("client worker :: send subscribe request %v\n", err)
+						c.synced.apply(e)
+						continue
+					}
+					if e.Op.Has(model.Move) {
+						// rename local copy, download it when there is nothing to rename.
+						c.logger.Printf("client worker :: move file notification %v !!\n", e)
+						// pushed by this client, already moved locally.
+						if c.sync && c.f.GetMeta(e.From) == nil && c.f.GetMeta(e.FileName) != nil {
 							continue
 						}
-
-						err = conn.SetReadDeadline(time.Now().Add(time.Second * 30))
-						if err != nil {
-							c.logger.Printf("client worker :: read file deadline %v\n", err)
+						err := c.f.MoveFile(e.From, e.FileName)
+						if err == nil {
+							c.synced.apply(e)
 							continue
 						}
 
-						r := bufio.NewReader(conn)
-						data, err := r.ReadBytes('@')
-						if err != nil {
-							c.logger.Printf("client worker :: got error %v, %T... on reading file\n", err, err)
+						c.logger.Printf("client worker :: error %v on move file %s, download it\n", err, e.From)
+						if err := c.requestFile(e); err != nil {
+							c.applyFailed("client worker ERROR :: error %v on receiving file %s !!\n", err, e.FileName)
 							continue
 						}
-
-						data = data[:len(data)-1]
-
-						response := protocol.Data{}
-						err = json.Unmarshal(data, &response)
-						if err != nil {
-							c.logger.Printf("client worker ERROR :: error %v on reading file request response !!", err)
+						c.synced.apply(e)
+						continue
+					}
+					if e.Op.Has(model.Mkdir) {
+						c.logger.Printf("client worker :: mkdir notification %v !!\n", e)
+						if err := c.f.MakeDir(e.FileName, c.attr(e.Mode, e.HasMode, time.Time{}, e.Owner)); err != nil {
+							c.applyFailed("client worker ERROR :: error %v on create directory %s !!\n", err, e.FileName)
 							continue
 						}
-
-						err = c.f.WriteFile(e.FileName, response.Payload)
-						if err != nil {
-							c.logger.Printf("client worker ERROR :: error %v on write data into file %s!!\n", e, e.FileName)
+						c.synced.apply(e)
+						continue
+					}
+					if e.Op.Has(model.Chmod) {
+						// attributes only, content is unchanged.
+						c.logger.Printf("client worker :: attributes notification %v !!\n", e)
+						if err := c.f.SetAttr(e.FileName, c.attr(e.Mode, e.HasMode, e.ChangeDate, e.Owner)); err != nil {
+							c.applyFailed("client worker ERROR :: error %v on update attributes of %s !!\n", err, e.FileName)
 						}
 						continue
-						// read connection and tell file management to create file
 					}
-					if e.Op.Has(model.Remove) {
+					if e.Op.Has(model.Rmdir) {
+						// remove only what server doesn't have anymore.
+						c.logger.Printf("client worker :: rmdir notification %v !!\n", e)
+						if err := c.f.RemoveDir(e.FileName, c.remote.has); err != nil {
+							c.applyFailed("client worker ERROR :: error %v on remove directory %s !!\n", err, e.FileName)
+							continue
+						}
+						c.synced.apply(e)
+						continue
+					}
+					// rename without a new name, file is moved out of server path.
+					if e.Op.Has(model.Remove) || e.Op.Has(model.Rename) {
 						// remove files
 						c.logger.Printf("client worker :: remove file notification %v !!\n", e)
 						err := c.f.RemoveFile(e.FileName)
 						if err != nil {
-							c.logger.Printf("client worker ERROR :: error %v on remove file %s !!\n", e, e.FileName)
+							c.applyFailed("client worker ERROR :: error %v on remove file %s !!\n", e, e.FileName)
+							continue
 						}
+						c.synced.apply(e)
 						continue
 					}
 				}
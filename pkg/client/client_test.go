@@ -0,0 +1,120 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClient_Paths(t *testing.T) {
+	lg := log.New(io.Discard, "", 0)
+	f, err := filehandler.NewHandler(t.TempDir(), lg)
+	require.NoError(t, err)
+
+	c, err := NewClient("", "", "", nil, lg, f, WithPaths("/team-a", "docs/**/*.md"))
+	require.NoError(t, err)
+	require.NoError(t, c.Exit())
+
+	// subscription out of server root is rejected before dialing.
+	for _, p := range []string{"../", "team-a/../../etc"} {
+		_, err = NewClient("", "", "", nil, lg, f, WithPaths(p))
+		require.ErrorIs(t, err, ErrClientPaths, p)
+	}
+}
+
+func TestClient_QueueExit(t *testing.T) {
+	lg := log.New(io.Discard, "", 0)
+	f, err := filehandler.NewHandler(t.TempDir(), lg)
+	require.NoError(t, err)
+	scope, err := filter.NewScope()
+	require.NoError(t, err)
+
+	// nothing takes downloads, as with a downloader busy on a big file.
+	c := &Client{
+		logger:   lg,
+		f:        f,
+		exit:     make(chan struct{}),
+		download: make(chan protocol.FileMetaPayload),
+		remote:   newRemoteTree(),
+		synced:   newRemoteTree(),
+		filter:   filter.Default(),
+		scope:    scope,
+	}
+	listing := []protocol.FileMetaPayload{
+		{FileName: "a.txt", Op: model.Write, Hash: "a"},
+		{FileName: "b.txt", Op: model.Write, Hash: "b"},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.syncListing(listing)
+		close(done)
+	}()
+	require.NoError(t, c.Exit())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("listing blocks exit on a full download queue")
+	}
+}
+
+func TestClient_JoinBusy(t *testing.T) {
+	lg := log.New(io.Discard, "", 0)
+	f, err := filehandler.NewHandler(t.TempDir(), lg)
+	require.NoError(t, err)
+	c, err := NewClient("", "", "", nil, lg, f)
+	require.NoError(t, err)
+	defer c.Exit()
+
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	go func() {
+		_ = protocol.NewDecoder(srv).Decode(&protocol.Data{})
+		payload, _ := json.Marshal(protocol.AckJoinPayload{Msg: "too many sessions", Busy: true})
+		_ = protocol.NewEncoder(srv).Encode(&protocol.Data{Type: protocol.AckJoin, Payload: payload})
+	}()
+
+	// sessions of the user may end, Run keeps retrying.
+	_, err = c.join(cli, protocol.JoinPayload{})
+	require.ErrorIs(t, err, ErrClientTooManySessions)
+	require.NotErrorIs(t, err, ErrClientAuthenticationFailed)
+}
+
+func TestClient_JoinIterations(t *testing.T) {
+	lg := log.New(io.Discard, "", 0)
+	f, err := filehandler.NewHandler(t.TempDir(), lg)
+	require.NoError(t, err)
+	c, err := NewClient("", "user", "secret", nil, lg, f)
+	require.NoError(t, err)
+	defer c.Exit()
+
+	for _, iterations := range []int{0, 1, user.ScramMaxIterations + 1} {
+		srv, cli := net.Pipe()
+		go func() {
+			req := protocol.Data{}
+			_ = protocol.NewDecoder(srv).Decode(&req)
+			join := protocol.JoinPayload{}
+			_ = json.Unmarshal(req.Payload, &join)
+			payload, _ := json.Marshal(protocol.AuthChallengePayload{Nonce: join.Nonce + "server", Salt: []byte("salt"), Iterations: iterations})
+			_ = protocol.NewEncoder(srv).Encode(&protocol.Data{Type: protocol.AuthChallenge, Payload: payload})
+		}()
+
+		// a server could make client hash for ever or for nothing.
+		_, err = c.join(cli, protocol.JoinPayload{Username: "user", Password: "secret"})
+		require.ErrorIs(t, err, ErrClientAuthenticationFailed, iterations)
+		srv.Close()
+		cli.Close()
+	}
+}
@@ -1,26 +1,99 @@
 package client
 
 import (
-	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/delta"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
 )
 
+// login
+// session of client subscription and the token its connections present,
+// token is renewed with a password login joining the session before it
+// expires.
+type login struct {
+	session string
+	token   string
+	expires time.Time
+}
+
+// tokenRenewal
+// token is renewed when it expires within this duration.
+const tokenRenewal = time.Minute
+
 // Login into the server(send join packet).
+// join is sent even without username, server without user manager accepts it
+// and expects it as the first packet of every connection. connection joins
+// the session of client subscription when there is one, with its token
+// instead of the password.
 func (c *Client) Auth(conn net.Conn, username string, password string) error {
-	if username == "" {
-		return nil
+	l := c.login.Load()
+	if l == nil {
+		_, err := c.join(conn, protocol.JoinPayload{Username: username, Password: password})
+		return err
+	}
+	if l.token != "" && time.Until(l.expires) > tokenRenewal {
+		_, err := c.join(conn, protocol.JoinPayload{Token: l.token})
+		return err
 	}
 
-	reqPayload, _ := json.Marshal(protocol.JoinPayload{
-		Username: username,
-		Password: password,
-	})
+	renewed, err := c.join(conn, protocol.JoinPayload{Username: username, Password: password, Session: l.session})
+	if err == nil && renewed.token != "" {
+		c.login.CompareAndSwap(l, &renewed)
+	}
+	return err
+}
+
+// connect
+// dial a transfer connection and join client session. a transfer which
+// loaded the login of a session ending with its subscription is retried once
+// when a new subscription replaced the login meanwhile.
+func (c *Client) connect() (net.Conn, error) {
+	for retry := true; ; retry = false {
+		l := c.login.Load()
+		conn, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.Auth(conn, c.username, c.password)
+		if err == nil {
+			return conn, nil
+		}
+		conn.Close()
+
+		if !retry || !errors.Is(err, ErrClientAuthenticationFailed) || c.login.Load() == l {
+			return nil, err
+		}
+	}
+}
+
+// join
+// send join packet, returns session connection belongs to and token issued
+// on password login. password of payload is not sent, it answers the SCRAM
+// challenge of server instead.
+func (c *Client) join(conn net.Conn, payload protocol.JoinPayload) (login, error) {
+	password := payload.Password
+	if payload.Username != "" && password != "" {
+		nonce, err := user.ScramNonce()
+		if err != nil {
+			return login{}, err
+		}
+		payload.Password, payload.Nonce = "", nonce
+	}
+
+	reqPayload, _ := json.Marshal(payload)
 	req := protocol.Data{
 		Sec:     0,
 		Time:    time.Now(),
@@ -29,51 +102,51 @@ func (c *Client) Auth(conn net.Conn, username string, password string) error {
 		Payload: reqPayload,
 	}
 
-	rb, err := json.Marshal(req)
-	if err != nil {
-		return errors.Join(ErrClientMarshalPacket, err)
-	}
-
-	rb = append(rb, '@')
-	n, err := conn.Write(rb)
+	err := protocol.NewEncoder(conn).Encode(&req)
 	if err != nil {
-		return errors.Join(ErrClientWritePacket, err)
-	}
-
-	reqBytesLen := len(rb)
-	if n != reqBytesLen {
-		subErr := fmt.Errorf("%d != %d", n, reqBytesLen)
-		return errors.Join(ErrClientInconsistentWrite, subErr)
+		return login{}, errors.Join(ErrClientWritePacket, err)
 	}
 
 	err = conn.SetReadDeadline(time.Now().Add(time.Second * 30))
 	if err != nil {
-		return errors.Join(ErrClientReadDeadline, err)
+		return login{}, errors.Join(ErrClientReadDeadline, err)
 	}
 
-	r := bufio.NewReader(conn)
-	data, err := r.ReadBytes('@')
+	dec := protocol.NewDecoder(conn)
+	response := protocol.Data{}
+	err = dec.Decode(&response)
 	if err != nil {
-		return errors.Join(ErrClientReadPacket, err)
+		return login{}, errors.Join(ErrClientReadPacket, err)
 	}
 
-	data = data[:len(data)-1]
+	// server accepting client certificate answers join right away. any other
+	// server answering a password login without challenge could be one which
+	// doesn't know the password, it can't sign the login.
+	var signature []byte
+	challenged := false
+	if response.Type == protocol.AuthChallenge && payload.Nonce != "" {
+		signature, err = c.prove(conn, response, payload, password)
+		if err != nil {
+			return login{}, err
+		}
+		challenged = true
 
-	response := protocol.Data{}
-	err = json.Unmarshal(data, &response)
-	if err != nil {
-		return errors.Join(ErrClientUnmarshalResponsePacket, err)
+		response = protocol.Data{}
+		err = dec.Decode(&response)
+		if err != nil {
+			return login{}, errors.Join(ErrClientReadPacket, err)
+		}
 	}
 
 	if response.Type != protocol.AckJoin {
 		subErr := fmt.Errorf("expect %d(ack join) but received %d", protocol.AckJoin, response.Type)
-		return errors.Join(ErrClientInvalidPacketType, subErr)
+		return login{}, errors.Join(ErrClientInvalidPacketType, subErr)
 	}
 
 	ackJoinPayload := &protocol.AckJoinPayload{}
 	err = json.Unmarshal(response.Payload, &ackJoinPayload)
 	if err != nil {
-		return errors.Join(ErrClientUnmarshalResponsePacket, err)
+		return login{}, errors.Join(ErrClientUnmarshalResponsePacket, err)
 	}
 
 	if !ackJoinPayload.Ok {
@@ -81,8 +154,260 @@ func (c *Client) Auth(conn net.Conn, username string, password string) error {
 		if ackJoinPayload.Msg != "" {
 			subErr = errors.New(ackJoinPayload.Msg)
 		}
-		return errors.Join(ErrClientAuthenticationFailed, subErr)
+		if ackJoinPayload.Busy {
+			// sessions of this user may end, login isn't wrong.
+			return login{}, errors.Join(ErrClientTooManySessions, subErr)
+		}
+		return login{}, errors.Join(ErrClientAuthenticationFailed, subErr)
+	}
+
+	if signature != nil && !hmac.Equal(signature, ackJoinPayload.Signature) {
+		return login{}, ErrClientServerSignature
+	}
+	if payload.Nonce != "" && !challenged && !c.hasCertificate() {
+		return login{}, ErrClientServerSignature
+	}
+
+	return login{session: ackJoinPayload.Session, token: ackJoinPayload.Token, expires: ackJoinPayload.Expires}, nil
+}
+
+// hasCertificate
+// connections present a client certificate server can log in with.
+func (c *Client) hasCertificate() bool {
+	return c.tls != nil && (len(c.tls.Certificates) > 0 || c.tls.GetClientCertificate != nil)
+}
+
+// prove
+// answer SCRAM challenge of server, returns server signature to expect in
+// join answer. a legacy user sends its password once, server has no
+// verifier to sign with yet, it is sent only over tls or when client opted
+// in with WithLegacyPassword.
+func (c *Client) prove(conn net.Conn, res protocol.Data, payload protocol.JoinPayload, password string) ([]byte, error) {
+	challenge := protocol.AuthChallengePayload{}
+	if err := json.Unmarshal(res.Payload, &challenge); err != nil {
+		return nil, errors.Join(ErrClientUnmarshalResponsePacket, err)
+	}
+	if !strings.HasPrefix(challenge.Nonce, payload.Nonce) {
+		return nil, errors.Join(ErrClientAuthenticationFailed, errors.New("invalid challenge"))
+	}
+	if !challenge.Legacy && (challenge.Iterations < user.ScramMinIterations || challenge.Iterations > user.ScramMaxIterations) {
+		return nil, errors.Join(ErrClientAuthenticationFailed, fmt.Errorf("challenge with %d iterations", challenge.Iterations))
+	}
+
+	proof := protocol.AuthProofPayload{Nonce: challenge.Nonce}
+	var signature []byte
+	if challenge.Legacy {
+		if c.tls == nil && !c.legacy {
+			return nil, errors.Join(ErrClientAuthenticationFailed, errors.New("server asks for the password in clear without tls"))
+		}
+		proof.Password = password
+	} else {
+		msg := user.ScramAuthMessage(payload.Username, payload.Nonce, challenge.Nonce, challenge.Salt, challenge.Iterations)
+		proof.Proof, signature = user.ScramProof(password, challenge.Salt, challenge.Iterations, msg)
 	}
 
-	return nil
+	proofPayload, _ := json.Marshal(proof)
+	err := protocol.NewEncoder(conn).Encode(&protocol.Data{
+		Sec:     0,
+		Time:    time.Now(),
+		Type:    protocol.AuthProof,
+		Heading: nil,
+		Payload: proofPayload,
+	})
+	if err != nil {
+		return nil, errors.Join(ErrClientWritePacket, err)
+	}
+	return signature, nil
+}
+
+// requestFile
+// download given file over a dedicated connection, with delta enabled and a
+// local copy present only changed parts are transferred.
+func (c *Client) requestFile(e protocol.FileMetaPayload) error {
+	var base *os.File
+	var sig *delta.Signature
+	if c.delta {
+		f, meta, err := c.f.OpenFile(e.FileName)
+		if err == nil {
+			defer f.Close()
+
+			sig, err = delta.Sign(f, delta.BlockSizeFor(meta.Size))
+			if err != nil {
+				c.logger.Printf("client worker :: error %v on signing %s, request whole file\n", err, e.FileName)
+				sig = nil
+			} else {
+				base = f
+			}
+		}
+	}
+
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reqPayload, _ := json.Marshal(protocol.RequestFilePayload{
+		Share:      c.share,
+		Path:       e.Path,
+		FileName:   e.FileName,
+		ChangeDate: e.ChangeDate,
+		Signature:  sig,
+	})
+	req := protocol.Data{
+		Sec:     0,
+		Time:    time.Now(),
+		Type:    protocol.RequestFile,
+		Heading: nil,
+		Payload: reqPayload,
+	}
+
+	err = protocol.NewEncoder(conn).Encode(&req)
+	if err != nil {
+		return errors.Join(ErrClientWritePacket, err)
+	}
+
+	return c.receiveFile(conn, e.FileName, base)
+}
+
+// receiveFile
+// read a file transfer (header, chunks and checksum) from given connection and
+// stream its content into a staging file, file is replaced only when the
+// checksum matches. copy frames of a delta transfer are read from base.
+func (c *Client) receiveFile(conn net.Conn, name string, base io.ReaderAt) error {
+	dec := protocol.NewDecoder(conn)
+
+	err := conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+	if err != nil {
+		return errors.Join(ErrClientReadDeadline, err)
+	}
+
+	response := protocol.Data{}
+	err = dec.Decode(&response)
+	if err != nil {
+		return errors.Join(ErrClientReadPacket, err)
+	}
+
+	if response.Type == protocol.Error {
+		return errorFrame(response)
+	}
+
+	if response.Type != protocol.ResponseFile {
+		subErr := fmt.Errorf("expect %d(response file) but received %d", protocol.ResponseFile, response.Type)
+		return errors.Join(ErrClientInvalidPacketType, subErr)
+	}
+
+	header := protocol.FileResponsePayload{}
+	err = json.Unmarshal(response.Payload, &header)
+	if err != nil {
+		return errors.Join(ErrClientUnmarshalResponsePacket, err)
+	}
+
+	if !header.Ok {
+		return errors.Join(ErrClientFileResponse, errors.New(header.Msg))
+	}
+
+	if header.Delta && base == nil {
+		return errors.Join(ErrClientFileResponse, errors.New("unexpected delta transfer"))
+	}
+
+	w, err := c.f.NewFileWriter(name)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	for {
+		// every frame gets its own deadline, big files may take a long time.
+		err = conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		if err != nil {
+			_ = w.Abort()
+			return errors.Join(ErrClientReadDeadline, err)
+		}
+
+		frame, err := dec.ReadFrame()
+		if err != nil {
+			_ = w.Abort()
+			return errors.Join(ErrClientReadPacket, err)
+		}
+
+		if frame.Type == protocol.FrameCopy && header.Delta {
+			offset, length, err := frame.Copy()
+			if err != nil {
+				_ = w.Abort()
+				return errors.Join(ErrClientUnmarshalResponsePacket, err)
+			}
+
+			err = delta.Apply(base, delta.Op{Copy: true, Offset: offset, Length: length}, io.MultiWriter(w, h))
+			if err != nil {
+				_ = w.Abort()
+				return err
+			}
+			continue
+		}
+
+		if frame.Type == protocol.FrameChunk {
+			offset, data, err := frame.Chunk()
+			if err != nil {
+				_ = w.Abort()
+				return errors.Join(ErrClientUnmarshalResponsePacket, err)
+			}
+
+			if offset != w.Size() {
+				_ = w.Abort()
+				return errors.Join(ErrClientChunkOffset, fmt.Errorf("%d != %d", offset, w.Size()))
+			}
+
+			h.Write(data)
+			if _, err := w.Write(data); err != nil {
+				_ = w.Abort()
+				return err
+			}
+			continue
+		}
+
+		trailer := protocol.Data{}
+		err = frame.Decode(&trailer)
+		if err != nil {
+			_ = w.Abort()
+			return errors.Join(ErrClientUnmarshalResponsePacket, err)
+		}
+
+		if trailer.Type != protocol.FileChecksum {
+			_ = w.Abort()
+			subErr := fmt.Errorf("expect %d(file checksum) but received %d", protocol.FileChecksum, trailer.Type)
+			return errors.Join(ErrClientInvalidPacketType, subErr)
+		}
+
+		sum := protocol.FileChecksumPayload{}
+		err = json.Unmarshal(trailer.Payload, &sum)
+		if err != nil {
+			_ = w.Abort()
+			return errors.Join(ErrClientUnmarshalResponsePacket, err)
+		}
+
+		if sum.Size != w.Size() || sum.Sum != hex.EncodeToString(h.Sum(nil)) {
+			_ = w.Abort()
+			subErr := fmt.Errorf("size %d/%d, sum %s", sum.Size, w.Size(), sum.Sum)
+			return errors.Join(ErrClientChecksumMismatch, subErr)
+		}
+
+		w.SetAttr(c.attr(header.Mode, header.HasMode, header.ChangeDate, header.Owner))
+		return w.Commit()
+	}
+}
+
+// errorFrame
+// error of a request rejected by server with an error frame.
+func errorFrame(d protocol.Data) error {
+	payload := protocol.ErrorPayload{}
+	if err := json.Unmarshal(d.Payload, &payload); err != nil {
+		return errors.Join(ErrClientUnmarshalResponsePacket, err)
+	}
+
+	subErr := fmt.Errorf("%s: %s", payload.Code, payload.Msg)
+	if payload.Code == protocol.CodePermissionDenied {
+		return errors.Join(ErrClientPermissionDenied, subErr)
+	}
+	return errors.Join(ErrClientFileResponse, subErr)
 }
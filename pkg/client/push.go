@@ -0,0 +1,370 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+)
+
+var ErrClientPushRejected = errors.New("server refused pushed change")
+
+// WithSync
+// push local changes to the server, local path should be watched with
+// EventHook. local files newer than server ones are pushed on initial sync
+// instead of downloaded, and local files server doesn't have are pushed
+// instead of pruned.
+func WithSync(sync bool) Option {
+	return func(c *Client) {
+		c.sync = sync
+	}
+}
+
+// localChange
+// a local change to push, names are relative to local path.
+type localChange struct {
+	name string
+	from string
+	op   model.Op
+}
+
+// pushQueue
+// local changes waiting for pusher. it is unbounded so watcher hook never
+// waits for a slow push, consecutive writes of a file are queued once as its
+// content is read when it is pushed.
+type pushQueue struct {
+	mu      sync.Mutex
+	changes []localChange
+	ready   chan struct{}
+}
+
+func newPushQueue() *pushQueue {
+	return &pushQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *pushQueue) add(lc localChange) {
+	q.mu.Lock()
+	n := len(q.changes)
+	if n == 0 || !lc.op.Has(model.Write) || !q.changes[n-1].op.Has(model.Write) || q.changes[n-1].name != lc.name {
+		q.changes = append(q.changes, lc)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take
+// queued changes in order, queue is emptied.
+func (q *pushQueue) take() []localChange {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	changes := q.changes
+	q.changes = nil
+	return changes
+}
+
+// EventHook
+// watcher hook of local path in sync mode. changes received from server are
+// reported by watcher too, pusher skips them by comparing with remote tree.
+func (c *Client) EventHook(event model.Event, err error) {
+	if err != nil {
+		c.logger.Printf("client error :: receive error %v on hook\n", err)
+		return
+	}
+
+	// new files are pushed on their first write, attributes are not pushed.
+	if !c.sync ||
+		filehandler.IsStaging(event.Name) ||
+		strings.HasPrefix(event.Name, model.ExitName) ||
+		event.Op.Has(model.Create) ||
+		event.Op.Has(model.Chmod) {
+		return
+	}
+
+	lc := localChange{name: c.f.RelName(event.Name), op: event.Op}
+	if event.Op.Has(model.Move) {
+		lc.from = c.f.RelName(event.OldName)
+		// temporary file renamed into place, server doesn't have the old name.
+		if filehandler.IsStaging(event.OldName) || c.localIgnored(lc.from, false) {
+			lc = localChange{name: lc.name, op: model.Write}
+		}
+	}
+
+	if c.localIgnored(lc.name, event.Op.Has(model.Mkdir) || event.Op.Has(model.Rmdir)) {
+		return
+	}
+
+	c.push.add(lc)
+}
+
+// localIgnored
+// check whether a local name is filtered out or out of subscribed paths.
+func (c *Client) localIgnored(name string, dir bool) bool {
+	if m := c.f.GetMeta(name); m != nil {
+		dir = dir || m.Dir
+	}
+	return c.filter.Match(name, dir) || !c.scope.Contains(name, dir)
+}
+
+func (c *Client) pusher() {
+	for {
+		select {
+		case <-c.push.ready:
+			for _, lc := range c.push.take() {
+				if err := c.pushChange(lc); err != nil {
+					c.logger.Printf("client pusher ERROR :: error %v on push of %s %s !!\n", err, lc.op, lc.name)
+				}
+			}
+		case <-c.exit:
+			return
+		}
+	}
+}
+
+// pushChange
+// push a local change unless server already has it, changes applied from
+// server notifications match remote or synced tree and are skipped. base of
+// a change is the server version local copy was last synced with, server
+// version may be ahead of it when a download is queued or has failed. a name
+// which was never synced has no base, it conflicts with any server version.
+func (c *Client) pushChange(lc localChange) error {
+	switch {
+	case lc.op.Has(model.Write):
+		m, err := c.f.Stat(lc.name)
+		if err != nil || m.Dir || m.Link != "" {
+			return nil // gone meanwhile, symbolic links are not pushed.
+		}
+		base, synced := c.synced.hash(lc.name)
+		if hash, ok := c.remote.hash(lc.name); (ok && hash == m.Hash) || (synced && base == m.Hash) {
+			return nil
+		}
+		return c.pushFile(protocol.PushFilePayload{FileName: lc.name, Op: model.Write, Base: base})
+	case lc.op.Has(model.Mkdir):
+		if _, ok := c.remote.hash(lc.name); ok {
+			return nil
+		}
+		m, err := c.f.Stat(lc.name)
+		if err != nil || !m.Dir {
+			return nil
+		}
+		return c.pushFile(protocol.PushFilePayload{FileName: lc.name, Op: model.Mkdir, Mode: filehandler.PosixMode(m.Mode), HasMode: true})
+	case lc.op.Has(model.Move):
+		_, to := c.remote.hash(lc.name)
+		_, from := c.remote.hash(lc.from)
+		if !from {
+			if to {
+				return nil
+			}
+			// server doesn't have the old name, push new name as a new file.
+			return c.pushTree(lc.name)
+		}
+		base, _ := c.synced.hash(lc.from)
+		return c.pushFile(protocol.PushFilePayload{FileName: lc.name, Op: model.Move, From: lc.from, Base: base})
+	case lc.op.Has(model.Rmdir):
+		if _, ok := c.remote.hash(lc.name); !ok {
+			return nil
+		}
+		return c.pushFile(protocol.PushFilePayload{FileName: lc.name, Op: model.Rmdir})
+	case lc.op.Has(model.Remove) || lc.op.Has(model.Rename):
+		if !c.remote.has(lc.name) {
+			return nil
+		}
+		base, _ := c.synced.hash(lc.name)
+		return c.pushFile(protocol.PushFilePayload{FileName: lc.name, Op: lc.op & (model.Remove | model.Rename), Base: base})
+	}
+	return nil
+}
+
+// pushTree
+// push given name and, for a directory, everything under it as new files.
+func (c *Client) pushTree(name string) error {
+	m, err := c.f.Stat(name)
+	if err != nil {
+		return nil
+	}
+	if !m.Dir {
+		return c.pushChange(localChange{name: name, op: model.Write})
+	}
+
+	if err := c.pushChange(localChange{name: name, op: model.Mkdir}); err != nil {
+		return err
+	}
+	for _, lm := range c.f.List() {
+		if !strings.HasPrefix(lm.Name, name+"/") || c.localIgnored(lm.Name, lm.Dir) {
+			continue
+		}
+		op := model.Write
+		if lm.Dir {
+			op = model.Mkdir
+		}
+		if err := c.pushChange(localChange{name: lm.Name, op: op}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushFile
+// send a change over a dedicated connection and apply server answer, content
+// of a write is streamed as chunks followed by its checksum. a change server
+// discarded is reverted by downloading server version.
+func (c *Client) pushFile(p protocol.PushFilePayload) error {
+	p.Share, p.Host = c.share, c.host
+	var file *os.File
+	if p.Op.Has(model.Write) {
+		f, meta, err := c.f.OpenFile(p.FileName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		file = f
+		p.Size, p.Hash, p.ChangeDate, p.Mode = meta.Size, meta.Hash, meta.ModifyTime, filehandler.PosixMode(meta.Mode)
+		p.HasMode = true
+	}
+
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reqPayload, _ := json.Marshal(p)
+	enc := protocol.NewEncoder(conn)
+	err = enc.Encode(&protocol.Data{
+		Sec:     0,
+		Time:    time.Now(),
+		Type:    protocol.PushFile,
+		Heading: nil,
+		Payload: reqPayload,
+	})
+	if err != nil {
+		return errors.Join(ErrClientWritePacket, err)
+	}
+
+	if file != nil {
+		h := sha256.New()
+		var offset int64
+		buf := make([]byte, protocol.ChunkSize)
+		for {
+			n, rerr := file.Read(buf)
+			if n > 0 {
+				h.Write(buf[:n])
+				if err := enc.WriteChunk(offset, buf[:n]); err != nil {
+					return errors.Join(ErrClientWritePacket, err)
+				}
+				offset += int64(n)
+			}
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return rerr
+			}
+		}
+
+		sumPayload, _ := json.Marshal(protocol.FileChecksumPayload{
+			Size: offset,
+			Sum:  hex.EncodeToString(h.Sum(nil)),
+		})
+		err = enc.Encode(&protocol.Data{
+			Sec:     1,
+			Time:    time.Now(),
+			Type:    protocol.FileChecksum,
+			Heading: nil,
+			Payload: sumPayload,
+		})
+		if err != nil {
+			return errors.Join(ErrClientWritePacket, err)
+		}
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+	if err != nil {
+		return errors.Join(ErrClientReadDeadline, err)
+	}
+
+	response := protocol.Data{}
+	err = protocol.NewDecoder(conn).Decode(&response)
+	if err != nil {
+		return errors.Join(ErrClientReadPacket, err)
+	}
+
+	if response.Type == protocol.Error {
+		return errorFrame(response)
+	}
+
+	if response.Type != protocol.AckPush {
+		subErr := fmt.Errorf("expect %d(ack push) but received %d", protocol.AckPush, response.Type)
+		return errors.Join(ErrClientInvalidPacketType, subErr)
+	}
+
+	ack := protocol.AckPushPayload{}
+	err = json.Unmarshal(response.Payload, &ack)
+	if err != nil {
+		return errors.Join(ErrClientUnmarshalResponsePacket, err)
+	}
+
+	if !ack.Ok {
+		return errors.Join(ErrClientPushRejected, errors.New(ack.Msg))
+	}
+
+	return c.pushed(p, ack)
+}
+
+// pushed
+// record a pushed change in remote and synced trees, on conflict local copy
+// gets server version back.
+func (c *Client) pushed(p protocol.PushFilePayload, ack protocol.AckPushPayload) error {
+	if !ack.Conflict || ack.Name == p.FileName {
+		c.logger.Printf("client pusher :: pushed %s %s\n", p.Op, p.FileName)
+		e := protocol.FileMetaPayload{FileName: p.FileName, From: p.From, Op: p.Op, Hash: p.Hash}
+		c.remote.apply(e)
+		c.synced.apply(e)
+		return nil
+	}
+
+	if ack.Name != "" {
+		c.logger.Printf("client pusher :: conflict on %s, pushed content stored as %s\n", p.FileName, ack.Name)
+	} else {
+		c.logger.Printf("client pusher :: conflict on %s, pushed change discarded\n", p.FileName)
+	}
+
+	if p.Op.Has(model.Move) {
+		// source changed on server, keep the local copy under its new name.
+		if err := c.pushTree(p.FileName); err != nil {
+			return err
+		}
+		return c.restore(p.From)
+	}
+	return c.restore(p.FileName)
+}
+
+// restore
+// download server version of given name.
+func (c *Client) restore(name string) error {
+	hash, ok := c.remote.hash(name)
+	if !ok {
+		return nil
+	}
+	e := protocol.FileMetaPayload{FileName: name, Op: model.Write, Hash: hash}
+	if err := c.requestFile(e); err != nil {
+		return err
+	}
+	c.synced.apply(e)
+	return nil
+}
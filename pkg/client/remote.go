@@ -0,0 +1,97 @@
+package client
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+)
+
+// remoteTree
+// names server has according to its last listing and changes received since,
+// with the content hash of files. recursive removals are confirmed against it
+// so nothing server still has is removed locally, in sync mode local changes
+// are compared with it so received changes are not pushed back.
+type remoteTree struct {
+	mu    sync.RWMutex
+	names map[string]string
+}
+
+func newRemoteTree() *remoteTree {
+	return &remoteTree{names: make(map[string]string)}
+}
+
+// reset
+// replace known names with a full listing.
+func (r *remoteTree) reset(files []protocol.FileMetaPayload) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.names = make(map[string]string, len(files))
+	for _, f := range files {
+		r.names[remoteName(f.FileName)] = f.Hash
+	}
+}
+
+// apply
+// update known names with a change notification.
+func (r *remoteTree) apply(e protocol.FileMetaPayload) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := remoteName(e.FileName)
+	switch {
+	case e.Op.Has(model.Write) || e.Op.Has(model.Mkdir):
+		r.names[name] = e.Hash
+	case e.Op.Has(model.Move):
+		from := remoteName(e.From)
+		hash := e.Hash
+		r.remove(from, func(n string, h string) {
+			if n == from && hash == "" {
+				hash = h
+			}
+			r.names[name+strings.TrimPrefix(n, from)] = h
+		})
+		r.names[name] = hash
+	case e.Op.Has(model.Remove) || e.Op.Has(model.Rename) || e.Op.Has(model.Rmdir):
+		r.remove(name, nil)
+	}
+}
+
+// remove
+// drop name and every name under it, moved is called with each dropped name
+// and its hash.
+func (r *remoteTree) remove(name string, moved func(n string, hash string)) {
+	prefix := name + "/"
+	for n, h := range r.names {
+		if n == name || strings.HasPrefix(n, prefix) {
+			delete(r.names, n)
+			if moved != nil {
+				moved(n, h)
+			}
+		}
+	}
+}
+
+func (r *remoteTree) has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.names[remoteName(name)]
+	return ok
+}
+
+func remoteName(name string) string {
+	return strings.TrimLeft(name, "/")
+}
+
+// hash
+// content hash of given name on server, ok is false when server doesn't have it.
+func (r *remoteTree) hash(name string) (hash string, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hash, ok = r.names[remoteName(name)]
+	return hash, ok
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+)
+
+var ErrClientKillSession = errors.New("server refused to kill session")
+
+// Sessions
+// list open sessions of every user, client user must be admin.
+func (c *Client) Sessions() ([]protocol.SessionPayload, error) {
+	res, err := c.admin(protocol.ListSessions, nil, protocol.SessionsList)
+	if err != nil {
+		return nil, err
+	}
+
+	list := protocol.SessionsListPayload{}
+	if err := json.Unmarshal(res.Payload, &list); err != nil {
+		return nil, errors.Join(ErrClientUnmarshalResponsePacket, err)
+	}
+	return list.Sessions, nil
+}
+
+// KillSession
+// end given session on server, client user must be admin.
+func (c *Client) KillSession(id string) error {
+	reqPayload, _ := json.Marshal(protocol.KillSessionPayload{Id: id})
+	res, err := c.admin(protocol.KillSession, reqPayload, protocol.AckKillSession)
+	if err != nil {
+		return err
+	}
+
+	ack := protocol.AckKillSessionPayload{}
+	if err := json.Unmarshal(res.Payload, &ack); err != nil {
+		return errors.Join(ErrClientUnmarshalResponsePacket, err)
+	}
+	if !ack.Ok {
+		return errors.Join(ErrClientKillSession, errors.New(ack.Msg))
+	}
+	return nil
+}
+
+// admin
+// send an admin request over a dedicated connection and read its answer.
+// connection opens no session, so it works when user has as many sessions
+// open as server allows.
+func (c *Client) admin(t protocol.Type, payload []byte, expect protocol.Type) (protocol.Data, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return protocol.Data{}, err
+	}
+	defer conn.Close()
+
+	if _, err := c.join(conn, protocol.JoinPayload{Username: c.username, Password: c.password, Admin: true}); err != nil {
+		return protocol.Data{}, err
+	}
+
+	err = protocol.NewEncoder(conn).Encode(&protocol.Data{
+		Sec:     0,
+		Time:    time.Now(),
+		Type:    t,
+		Heading: nil,
+		Payload: payload,
+	})
+	if err != nil {
+		return protocol.Data{}, errors.Join(ErrClientWritePacket, err)
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+	if err != nil {
+		return protocol.Data{}, errors.Join(ErrClientReadDeadline, err)
+	}
+
+	response := protocol.Data{}
+	if err := protocol.NewDecoder(conn).Decode(&response); err != nil {
+		return protocol.Data{}, errors.Join(ErrClientReadPacket, err)
+	}
+
+	if response.Type == protocol.Error {
+		return protocol.Data{}, errorFrame(response)
+	}
+	if response.Type != expect {
+		subErr := fmt.Errorf("expect %d but received %d", expect, response.Type)
+		return protocol.Data{}, errors.Join(ErrClientInvalidPacketType, subErr)
+	}
+	return response, nil
+}
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+)
+
+// syncListing
+// compare server listing with local files, queue download of missing or
+// outdated files (by content hash when server sends it), creation of missing
+// directories, attribute updates of identical files and, when prune is
+// enabled, removal of local files and directories which server doesn't have.
+// in sync mode local files changed since they were synced and local files
+// server doesn't have are pushed instead, unless they were synced before and
+// are unchanged since, server deleted them meanwhile. without a synced version
+// the newer copy wins.
+// listing is queued before any later change notification, so the local tree
+// is in sync before live events are applied, queueing stops on Exit. like
+// rsync, modes of directories are applied after their content, a read-only
+// directory would refuse files downloaded into it.
+func (c *Client) syncListing(files []protocol.FileMetaPayload) {
+	remote := make(map[string]struct{}, len(files))
+	var dirs []protocol.FileMetaPayload
+	var outdated, attrs, pushed int
+	for _, rf := range files {
+		if c.filter.Match(rf.FileName, rf.Op.Has(model.Mkdir)) {
+			continue
+		}
+		remote[rf.FileName] = struct{}{}
+
+		lm := c.f.GetMeta(rf.FileName)
+		if rf.Op.Has(model.Mkdir) {
+			if lm == nil || !lm.Dir {
+				outdated++
+				dirs = append(dirs, rf)
+				rf.HasMode = false
+				if !c.queue(rf) {
+					return
+				}
+				continue
+			}
+			c.synced.apply(rf)
+			if !c.sameAttr(lm, rf) {
+				attrs++
+				dirs = append(dirs, rf)
+			}
+			continue
+		}
+		if rf.Link != "" {
+			if lm == nil || lm.Link != rf.Link {
+				outdated++
+				rf.Op = model.Write
+				if !c.queue(rf) {
+					return
+				}
+			}
+			continue
+		}
+		if lm != nil && rf.Hash != "" && c.f.SameContent(rf.FileName, rf.Hash) {
+			c.synced.apply(protocol.FileMetaPayload{FileName: rf.FileName, Op: model.Write, Hash: rf.Hash})
+			if lm = c.f.GetMeta(rf.FileName); lm != nil && !c.sameAttr(lm, rf) {
+				attrs++
+				rf.Op = model.Chmod
+				if !c.queue(rf) {
+					return
+				}
+			}
+			continue
+		}
+		if lm != nil && rf.Hash == "" && lm.Size == rf.Size && !lm.ModifyTime.Before(rf.ChangeDate) {
+			continue
+		}
+		if c.sync && lm != nil && !lm.Dir && c.changedLocally(*lm, rf) {
+			pushed++
+			c.push.add(localChange{name: rf.FileName, op: model.Write})
+			continue
+		}
+
+		outdated++
+		rf.Op = model.Write
+		if !c.queue(rf) {
+			return
+		}
+	}
+
+	var extra int
+	if c.prune || c.sync {
+		var local []filehandler.Meta
+		for _, lm := range c.f.List() {
+			if _, ok := remote[lm.Name]; ok || c.filter.Match(lm.Name, lm.Dir) || !c.scope.Contains(lm.Name, lm.Dir) {
+				continue
+			}
+			local = append(local, lm)
+		}
+
+		// a directory server deleted is kept when it has new local content.
+		var created []string
+		if c.sync {
+			for _, lm := range local {
+				if !lm.Dir && !c.deletedRemotely(lm) {
+					created = append(created, lm.Name)
+				}
+			}
+			sort.Strings(created)
+		}
+
+		for _, lm := range local {
+			if c.sync && (!c.deletedRemotely(lm) || (lm.Dir && hasPrefix(created, lm.Name+"/"))) {
+				op := model.Write
+				if lm.Dir {
+					op = model.Mkdir
+				}
+				pushed++
+				c.push.add(localChange{name: lm.Name, op: op})
+				continue
+			}
+
+			op := model.Remove
+			if lm.Dir {
+				op = model.Rmdir
+			}
+
+			extra++
+			if !c.queue(protocol.FileMetaPayload{FileName: lm.Name, Op: op}) {
+				return
+			}
+		}
+	}
+
+	// listing is sorted, deepest directories come last and are set first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rf := dirs[i]
+		rf.Op = model.Chmod
+		if !c.queue(rf) {
+			return
+		}
+	}
+
+	c.logger.Printf("client :: initial sync, %d remote files, %d to download, %d to update attributes, %d to remove, %d to push\n", len(files), outdated, attrs, extra, pushed)
+}
+
+// attr
+// attributes of a remote file to apply on local copy, owner is applied only
+// when enabled.
+func (c *Client) attr(mode uint32, hasMode bool, modTime time.Time, owner *protocol.FileOwner) filehandler.Attr {
+	a := filehandler.Attr{
+		Mode:    filehandler.FileMode(mode),
+		HasMode: hasMode,
+		ModTime: modTime,
+	}
+	if c.owner && owner != nil {
+		a.Owner = &filehandler.Owner{Uid: owner.Uid, Gid: owner.Gid}
+	}
+	return a
+}
+
+// sameAttr
+// check whether local copy already has attributes of the remote one,
+// modification time of directories is not compared.
+func (c *Client) sameAttr(lm *filehandler.Meta, rf protocol.FileMetaPayload) bool {
+	if rf.HasMode && filehandler.PosixMode(lm.Mode) != rf.Mode {
+		return false
+	}
+	if !lm.Dir && !rf.ChangeDate.IsZero() && !lm.ModifyTime.Equal(rf.ChangeDate) {
+		return false
+	}
+	if c.owner && rf.Owner != nil && (lm.Owner == nil || lm.Owner.Uid != rf.Owner.Uid || lm.Owner.Gid != rf.Owner.Gid) {
+		return false
+	}
+	return true
+}
+
+// changedLocally
+// check whether local copy of a file server has another version of should be
+// pushed. it is when local copy changed since it was synced, a local copy
+// which was never synced is pushed when it is newer.
+func (c *Client) changedLocally(lm filehandler.Meta, rf protocol.FileMetaPayload) bool {
+	base, ok := c.synced.hash(lm.Name)
+	if !ok || rf.Hash == "" {
+		return lm.ModifyTime.After(rf.ChangeDate)
+	}
+	return !c.f.SameContent(lm.Name, base)
+}
+
+// deletedRemotely
+// check whether a local name server doesn't have was synced before and is
+// unchanged since, server deleted it while client was disconnected.
+func (c *Client) deletedRemotely(lm filehandler.Meta) bool {
+	base, ok := c.synced.hash(lm.Name)
+	if !ok {
+		return false
+	}
+	return lm.Dir || c.f.SameContent(lm.Name, base)
+}
+
+// hasPrefix
+// check whether some of given names has prefix, names are sorted.
+func hasPrefix(names []string, prefix string) bool {
+	i := sort.SearchStrings(names, prefix)
+	return i < len(names) && strings.HasPrefix(names[i], prefix)
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrClientCA = errors.New("invalid CA bundle")
+
+// TLSConfig
+// tls configuration trusting certificates of ca bundle, system trust store
+// when ca is empty. cert and key are client certificate presented to server,
+// both optional.
+func TLSConfig(ca, cert, key string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Join(ErrClientCA, fmt.Errorf("no certificate in %s", ca))
+		}
+		cfg.RootCAs = pool
+	}
+
+	if cert != "" || key != "" {
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{c}
+	}
+	return cfg, nil
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"io/ioutil"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -9,19 +10,62 @@ import (
 type Type string
 
 type ServerTLSConfig struct {
-	Key  string `yaml:"key"`
-	Cert string `yaml:"cert"`
+	Key               string `yaml:"key"`
+	Cert              string `yaml:"cert"`
+	ClientCA          string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+type JournalConfig struct {
+	Path string `yaml:"path"`
+	Size int    `yaml:"size"`
+}
+
+// ShareConfig
+// a named directory served next to the top level path, ignore patterns are
+// added to the top level ones. users is the access list, everyone when empty.
+type ShareConfig struct {
+	Name    string        `yaml:"name"`
+	Path    string        `yaml:"path"`
+	Ignore  []string      `yaml:"ignore"`
+	Users   []string      `yaml:"users"`
+	Journal JournalConfig `yaml:"journal"`
 }
 
 type ServerConfig struct {
-	PwFile string          `yaml:"pwfile"`
-	TLS    ServerTLSConfig `yaml:"tls"`
+	PwFile       string          `yaml:"pwfile"`
+	AclFile      string          `yaml:"aclfile"`
+	MaxSessions  int             `yaml:"max_sessions"`
+	TokenTTL     time.Duration   `yaml:"token_ttl"`
+	Cleartext    bool            `yaml:"cleartext_passwords"`
+	TLS          ServerTLSConfig `yaml:"tls"`
+	QueueSize    int             `yaml:"queue_size"`
+	SlowConsumer string          `yaml:"slow_consumer"`
+	Heartbeat    time.Duration   `yaml:"heartbeat"`
+	Journal      JournalConfig   `yaml:"journal"`
+	Shares       []ShareConfig   `yaml:"shares"`
+	Sync         bool            `yaml:"sync"`
+	Conflict     string          `yaml:"conflict"`
 }
 
 type ClientConfig struct {
-	TLS      bool   `yaml:"tls"`
-	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	TLS      bool     `yaml:"tls"`
+	TLSCA    string   `yaml:"tls_ca"`
+	TLSCert  string   `yaml:"tls_cert"`
+	TLSKey   string   `yaml:"tls_key"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Prune    bool     `yaml:"prune"`
+	Delta    bool     `yaml:"delta"`
+	Owner    bool     `yaml:"owner"`
+	Share    string   `yaml:"share"`
+	Paths    []string `yaml:"paths"`
+	Sync     bool     `yaml:"sync"`
+	Legacy   bool     `yaml:"legacy_password"`
+
+	HeartbeatTimeout  time.Duration `yaml:"heartbeat_timeout"`
+	ReconnectDelay    time.Duration `yaml:"reconnect_delay"`
+	ReconnectMaxDelay time.Duration `yaml:"reconnect_max_delay"`
 }
 
 const (
@@ -33,6 +77,9 @@ type Config struct {
 	ServiceType Type         `yaml:"type"`
 	Address     string       `yaml:"address"`
 	Path        string       `yaml:"path"`
+	Hash        string       `yaml:"hash"`
+	Symlinks    string       `yaml:"symlinks"`
+	Ignore      []string     `yaml:"ignore"`
 	Client      ClientConfig `yaml:"client"`
 	Server      ServerConfig `yaml:"server"`
 }
@@ -0,0 +1,280 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+	rsync style delta encoding.
+
+	receiver splits its current copy into fixed size blocks and sends a weak
+	(rolling) and a strong checksum of each block. sender rolls a window over
+	the new content, when the window matches a block it emits a copy of that
+	block, otherwise bytes are emitted as literal data.
+*/
+
+const (
+	// MinBlockSize lower bound of block size picked by BlockSizeFor.
+	MinBlockSize = 2 << 10
+	// MaxBlockSize upper bound of block size accepted in a signature.
+	MaxBlockSize = 1 << 20
+	// MaxBlocks upper bound of blocks picked by BlockSizeFor, keeps
+	// signatures small enough for a single frame.
+	MaxBlocks = 1 << 16
+
+	strongSize = 16
+	weakMod    = 1 << 16
+)
+
+var ErrInvalidSignature = errors.New("invalid delta signature")
+
+type BlockSum struct {
+	Weak   uint32 `json:"w"`
+	Strong []byte `json:"s"`
+}
+
+// Signature
+// checksums of receiver copy, every block is BlockSize long except the last one.
+type Signature struct {
+	BlockSize int        `json:"bs"`
+	Size      int64      `json:"sz"`
+	Blocks    []BlockSum `json:"b"`
+}
+
+// Validate
+// check signature received from remote before using it.
+func (s *Signature) Validate() error {
+	if s.BlockSize <= 0 || s.BlockSize > MaxBlockSize {
+		return errors.Join(ErrInvalidSignature, fmt.Errorf("block size %d", s.BlockSize))
+	}
+
+	blocks := (s.Size + int64(s.BlockSize) - 1) / int64(s.BlockSize)
+	if s.Size < 0 || blocks != int64(len(s.Blocks)) {
+		return errors.Join(ErrInvalidSignature, fmt.Errorf("size %d, blocks %d", s.Size, len(s.Blocks)))
+	}
+
+	for i := range s.Blocks {
+		if len(s.Blocks[i].Strong) != strongSize {
+			return errors.Join(ErrInvalidSignature, fmt.Errorf("block %d strong sum", i))
+		}
+	}
+
+	return nil
+}
+
+// BlockSizeFor
+// pick block size for a file of given size.
+func BlockSizeFor(size int64) int {
+	bs := int64(MinBlockSize)
+	for bs < MaxBlockSize && size/bs >= MaxBlocks {
+		bs <<= 1
+	}
+	return int(bs)
+}
+
+// Sign
+// compute signature of given content.
+func Sign(r io.Reader, blockSize int) (*Signature, error) {
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Size += int64(n)
+			sig.Blocks = append(sig.Blocks, BlockSum{
+				Weak:   newRolling(buf[:n]).sum(),
+				Strong: strong(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Op
+// single delta instruction, either copy Length bytes from Offset of receiver
+// copy, or write Data as is.
+type Op struct {
+	Copy   bool
+	Offset int64
+	Length int64
+	Data   []byte
+}
+
+// Diff
+// roll over new content and emit instructions to rebuild it from the copy
+// described by sig. literal data is emitted in pieces of at most maxLiteral
+// bytes, emitted Data is only valid during the call.
+func Diff(r io.Reader, sig *Signature, maxLiteral int, emit func(op Op) error) error {
+	bs := sig.BlockSize
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		index[b.Weak] = append(index[b.Weak], i)
+	}
+
+	br := bufio.NewReaderSize(r, 64<<10)
+
+	// buf holds pending literal bytes followed by the current window.
+	buf := make([]byte, 0, maxLiteral+bs)
+	ws := 0
+	eof := false
+
+	fill := func() error {
+		for !eof && len(buf)-ws < bs {
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			buf = append(buf, c)
+		}
+		return nil
+	}
+
+	flush := func() error {
+		if ws == 0 {
+			return nil
+		}
+		if err := emit(Op{Data: buf[:ws]}); err != nil {
+			return err
+		}
+		n := copy(buf, buf[ws:])
+		buf = buf[:n]
+		ws = 0
+		return nil
+	}
+
+	match := func(roll *rolling) int {
+		candidates, ok := index[roll.sum()]
+		if !ok {
+			return -1
+		}
+		window := buf[ws:]
+		sum := strong(window)
+		for _, i := range candidates {
+			if blockLen(sig, i) == len(window) && bytes.Equal(sig.Blocks[i].Strong, sum) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	roll := newRolling(buf[ws:])
+
+	for len(buf)-ws > 0 {
+		if i := match(roll); i >= 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := emit(Op{Copy: true, Offset: int64(i) * int64(bs), Length: int64(blockLen(sig, i))}); err != nil {
+				return err
+			}
+
+			buf = buf[:0]
+			if err := fill(); err != nil {
+				return err
+			}
+			roll = newRolling(buf[ws:])
+			continue
+		}
+
+		// slide window by one byte, leaving byte becomes literal.
+		out := buf[ws]
+		ws++
+		if err := fill(); err != nil {
+			return err
+		}
+		if len(buf)-ws == roll.n {
+			roll.roll(out, buf[len(buf)-1])
+		} else {
+			roll.shrink(out)
+		}
+
+		if ws >= maxLiteral {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// Apply
+// write instruction into w, copies are read from base.
+func Apply(base io.ReaderAt, op Op, w io.Writer) error {
+	if !op.Copy {
+		_, err := w.Write(op.Data)
+		return err
+	}
+
+	_, err := io.Copy(w, io.NewSectionReader(base, op.Offset, op.Length))
+	return err
+}
+
+func blockLen(sig *Signature, i int) int {
+	if i == len(sig.Blocks)-1 {
+		if rem := int(sig.Size % int64(sig.BlockSize)); rem != 0 {
+			return rem
+		}
+	}
+	return sig.BlockSize
+}
+
+func strong(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:strongSize]
+}
+
+// rolling
+// rsync weak checksum, can be updated in O(1) when the window slides.
+type rolling struct {
+	a, b uint32
+	n    int
+}
+
+func newRolling(data []byte) *rolling {
+	r := &rolling{n: len(data)}
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c)
+	}
+	r.a %= weakMod
+	r.b %= weakMod
+	return r
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a | r.b<<16
+}
+
+// roll
+// remove first byte of window and append a new one.
+func (r *rolling) roll(out, in byte) {
+	r.a = (r.a - uint32(out) + uint32(in)) % weakMod
+	r.b = (r.b - uint32(r.n)*uint32(out) + r.a) % weakMod
+}
+
+// shrink
+// remove first byte of window, used at the end of content.
+func (r *rolling) shrink(out byte) {
+	r.a = (r.a - uint32(out)) % weakMod
+	r.b = (r.b - uint32(r.n)*uint32(out)) % weakMod
+	r.n--
+}
@@ -0,0 +1,114 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func rebuild(t *testing.T, base, target []byte, blockSize int) (result []byte, literal int64) {
+	sig, err := Sign(bytes.NewReader(base), blockSize)
+	require.NoError(t, err, "sign base content")
+	require.NoError(t, sig.Validate(), "validate signature")
+
+	out := &bytes.Buffer{}
+	err = Diff(bytes.NewReader(target), sig, 4096, func(op Op) error {
+		if !op.Copy {
+			literal += int64(len(op.Data))
+		}
+		return Apply(bytes.NewReader(base), op, out)
+	})
+	require.NoError(t, err, "diff target content")
+
+	return out.Bytes(), literal
+}
+
+func TestDelta_Rebuild(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	base := make([]byte, 300_000)
+	rnd.Read(base)
+
+	blockSize := 2048
+
+	tests := []struct {
+		name       string
+		target     func() []byte
+		maxLiteral int64
+	}{
+		{
+			name:       "identical",
+			target:     func() []byte { return base },
+			maxLiteral: 0,
+		},
+		{
+			name:       "append",
+			target:     func() []byte { return append(append([]byte{}, base...), []byte("appended log line\n")...) },
+			maxLiteral: int64(blockSize) + 18,
+		},
+		{
+			name: "insert in the middle",
+			target: func() []byte {
+				t := append([]byte{}, base[:150_001]...)
+				t = append(t, []byte("inserted")...)
+				return append(t, base[150_001:]...)
+			},
+			maxLiteral: 2*int64(blockSize) + 8,
+		},
+		{
+			name: "patch in place",
+			target: func() []byte {
+				t := append([]byte{}, base...)
+				copy(t[70_000:], "patched")
+				return t
+			},
+			maxLiteral: int64(blockSize),
+		},
+		{
+			name:       "truncate",
+			target:     func() []byte { return base[:100_000] },
+			maxLiteral: int64(blockSize),
+		},
+		{
+			name:       "empty",
+			target:     func() []byte { return []byte{} },
+			maxLiteral: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := tt.target()
+			got, literal := rebuild(t, base, target, blockSize)
+			require.True(t, bytes.Equal(target, got), "rebuilt content mismatch")
+			require.LessOrEqual(t, literal, tt.maxLiteral)
+		})
+	}
+}
+
+func TestDelta_EmptyBase(t *testing.T) {
+	target := []byte("some new content")
+	got, literal := rebuild(t, nil, target, MinBlockSize)
+	require.Equal(t, target, got)
+	require.Equal(t, int64(len(target)), literal)
+}
+
+func TestDelta_Validate(t *testing.T) {
+	sig, err := Sign(bytes.NewReader(make([]byte, 5000)), 2048)
+	require.NoError(t, err)
+	require.NoError(t, sig.Validate())
+	require.Len(t, sig.Blocks, 3)
+
+	sig.Blocks = sig.Blocks[:2]
+	require.ErrorIs(t, sig.Validate(), ErrInvalidSignature)
+
+	require.ErrorIs(t, (&Signature{BlockSize: MaxBlockSize + 1}).Validate(), ErrInvalidSignature)
+}
+
+func TestDelta_BlockSizeFor(t *testing.T) {
+	require.Equal(t, MinBlockSize, BlockSizeFor(0))
+	require.Equal(t, MinBlockSize, BlockSizeFor(MinBlockSize*MaxBlocks-1))
+	require.Equal(t, MinBlockSize*2, BlockSizeFor(MinBlockSize*MaxBlocks))
+	require.Equal(t, MaxBlockSize, BlockSizeFor(1<<50))
+}
@@ -0,0 +1,147 @@
+package filehandler
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// modeMask
+// mode bits which are replicated, permissions together with setuid, setgid
+// and sticky bits.
+const modeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Owner
+// numeric user and group ids of a file.
+type Owner struct {
+	Uid int
+	Gid int
+}
+
+// Attr
+// file attributes replicated together with content, zero values are not
+// applied. Mode is applied only with HasMode, mode 000 is a valid one.
+type Attr struct {
+	Mode    os.FileMode
+	HasMode bool
+	ModTime time.Time
+	Owner   *Owner
+}
+
+// PosixMode
+// convert mode into POSIX mode bits, as they are sent over the wire.
+func PosixMode(m os.FileMode) uint32 {
+	p := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		p |= 0o4000
+	}
+	if m&os.ModeSetgid != 0 {
+		p |= 0o2000
+	}
+	if m&os.ModeSticky != 0 {
+		p |= 0o1000
+	}
+	return p
+}
+
+// FileMode
+// convert POSIX mode bits into mode.
+func FileMode(p uint32) os.FileMode {
+	m := os.FileMode(p) & os.ModePerm
+	if p&0o4000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if p&0o2000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if p&0o1000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// apply
+// set given attributes on a path. only owner is set on symbolic links, mode
+// and times would be applied to the link target.
+func (a Attr) apply(path string) error {
+	if a.Owner != nil {
+		if err := os.Lchown(path, a.Owner.Uid, a.Owner.Gid); err != nil {
+			return fmt.Errorf("error %v change owner of %s", err, path)
+		}
+	}
+
+	if fs, err := os.Lstat(path); err == nil && fs.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	// chown may clear setuid and setgid bits, so mode is set after it.
+	if a.HasMode {
+		if err := os.Chmod(path, a.Mode&modeMask); err != nil {
+			return fmt.Errorf("error %v change mode of %s", err, path)
+		}
+	}
+
+	if !a.ModTime.IsZero() {
+		if err := os.Chtimes(path, a.ModTime, a.ModTime); err != nil {
+			return fmt.Errorf("error %v change times of %s", err, path)
+		}
+	}
+
+	return nil
+}
+
+// SetAttr
+// apply attributes to a tracked file or directory without touching its content.
+// hash of content unchanged since it was tracked is kept, other content is
+// hashed after the lock is released.
+func (h *Handler) SetAttr(name string, a Attr) error {
+	name, hashed, err := h.setAttr(name, a)
+	if err != nil || hashed {
+		return err
+	}
+
+	// a file gone meanwhile is untracked by Stat.
+	_, _ = h.Stat(name)
+	return nil
+}
+
+func (h *Handler) setAttr(name string, a Attr) (string, bool, error) {
+	h.rwM.Lock()
+	defer h.rwM.Unlock()
+
+	name, path, err := h.resolve(name)
+	if err != nil {
+		return name, false, err
+	}
+
+	var prev Meta
+	var cached bool
+	if fs, link, ok := h.lstat(path); ok && link == "" && !fs.IsDir() {
+		prev, cached = h.cachedMeta(name, fs)
+	}
+
+	if err := a.apply(path); err != nil {
+		return name, false, err
+	}
+
+	fs, link, ok := h.lstat(path)
+	switch {
+	case !ok:
+		h.deleteMeta(name)
+	case link != "":
+		h.meta[name] = h.linkMeta(name, fs, link)
+	case fs.IsDir():
+		h.meta[name] = h.dirMeta(name, fs)
+	default:
+		// stat is no proof of content once times are set, hash is taken
+		// from before or left to Stat.
+		meta, _ := h.cachedMeta(name, fs)
+		meta.Hash = ""
+		if cached && prev.Size == meta.Size {
+			meta.Hash = prev.Hash
+		}
+		h.meta[name] = meta
+		return name, meta.Hash != "" || h.hash == HashNone, nil
+	}
+	return name, true, nil
+}
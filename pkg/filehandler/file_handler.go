@@ -2,23 +2,51 @@ package filehandler
 
 import (
 	"fmt"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+// Meta
+// Hash is the content hash of a file, it is kept as long as size and
+// modification time don't change. Owner is nil when the platform doesn't
+// provide it. Link is set on symbolic links copied as is, it is the link target.
 type Meta struct {
 	Name       string
 	Size       int64
 	ModifyTime time.Time
+	Dir        bool
+	Hash       string
+	Mode       os.FileMode
+	Owner      *Owner
+	Link       string
 }
 
 func (f Meta) String() string {
-	return fmt.Sprintf("file meata :: file-name: %s, size: %d, modified_at: %v", f.Name, f.Size, f.ModifyTime.String())
+	if f.Link != "" {
+		return fmt.Sprintf("link meta :: link-name: %s, target: %s", f.Name, f.Link)
+	}
+	if f.Dir {
+		return fmt.Sprintf("dir meta :: dir-name: %s, modified_at: %v", f.Name, f.ModifyTime.String())
+	}
+	return fmt.Sprintf("file meta :: file-name: %s, size: %d, modified_at: %v, hash: %s", f.Name, f.Size, f.ModifyTime.String(), f.Hash)
+}
+
+type Option func(h *Handler)
+
+// WithHash
+// algorithm of content hash computed for every file.
+func WithHash(alg HashAlgorithm) Option {
+	return func(h *Handler) {
+		h.hash = alg
+	}
 }
 
 type Handler struct {
@@ -29,9 +57,21 @@ type Handler struct {
 	rwM    sync.RWMutex
 	path   string
 	logger *log.Logger
+	hash   HashAlgorithm
+
+	symlinks SymlinkPolicy
+	filter   *filter.Filter
 }
 
-func NewHandler(path string, logger *log.Logger) (*Handler, error) {
+// WithFilter
+// names matching filter are neither tracked nor updated from events.
+func WithFilter(f *filter.Filter) Option {
+	return func(h *Handler) {
+		h.filter = f
+	}
+}
+
+func NewHandler(path string, logger *log.Logger, options ...Option) (*Handler, error) {
 	logger.Printf("NEW handler :: on path %s\n", path)
 
 	h := Handler{
@@ -39,11 +79,24 @@ func NewHandler(path string, logger *log.Logger) (*Handler, error) {
 		rwM:    sync.RWMutex{},
 		path:   path,
 		logger: logger,
+		hash:   HashSHA256,
+
+		symlinks: SymlinkIgnore,
+		filter:   filter.Default(),
+	}
+
+	for _, op := range options {
+		op(&h)
+	}
+
+	var visited map[string]struct{}
+	if h.symlinks == SymlinkFollowWithinRoot {
+		visited = make(map[string]struct{})
 	}
 
 	h.rwM.Lock()
 	defer h.rwM.Unlock()
-	if err := h.readDir(path, 0); err != nil {
+	if err := h.readDir("", visited); err != nil {
 		return nil, err
 	}
 
@@ -51,7 +104,10 @@ func NewHandler(path string, logger *log.Logger) (*Handler, error) {
 }
 
 func (h *Handler) GetMeta(name string) *Meta {
-	name = strings.TrimPrefix(name, h.path)
+	h.rwM.RLock()
+	defer h.rwM.RUnlock()
+
+	name = h.relName(name)
 	if m, c := h.meta[name]; c {
 		metaCopy := m
 		return &metaCopy
@@ -59,31 +115,97 @@ func (h *Handler) GetMeta(name string) *Meta {
 	return nil
 }
 
-func (h *Handler) readDir(path string, level int) error {
+// relName
+// normalize given name (watcher event name or name received from remote) into
+// the key form of meta map, relative to handler root without leading "./" or "/".
+func (h *Handler) relName(name string) string {
+	name = strings.TrimPrefix(h.trimRoot(name), "./")
+	name = strings.TrimLeft(name, "/")
+	return name
+}
+
+// RelName
+// name of given watcher event path relative to handler root.
+func (h *Handler) RelName(name string) string {
+	return h.relName(name)
+}
+
+// trimRoot
+// strip handler root from a path under it.
+func (h *Handler) trimRoot(name string) string {
+	if h.path != "." && h.path != "" {
+		if name == h.path {
+			return ""
+		}
+		name = strings.TrimPrefix(name, h.path+"/")
+	}
+	return name
+}
+
+// readDir
+// walk given directory (relative to handler root) and record meta data of its
+// files and sub directories. staging files are left over from interrupted
+// transfers, they are removed. visited holds real paths of directories being
+// walked when symbolic links are followed, a link back to one of them is a
+// loop and is skipped.
+func (h *Handler) readDir(rel string, visited map[string]struct{}) error {
+	path := h.path
+	if rel != "" {
+		path = fmt.Sprintf("%s/%s", h.path, rel)
+	}
+
+	if visited != nil {
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return err
+		}
+		visited[real] = struct{}{}
+		defer delete(visited, real)
+	}
+
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		return err
 	}
 
 	for _, f := range files {
-		var fName string
-		if level > 0 {
-			fName = fmt.Sprintf("%s/%s", path, f.Name())
-		} else {
-			fName = f.Name()
+		fName := f.Name()
+		if rel != "" {
+			fName = fmt.Sprintf("%s/%s", rel, f.Name())
+		}
+		if f.Mode().IsRegular() && IsStaging(fName) {
+			h.logger.Printf("handler :: remove staging file %s\n", fName)
+			_ = os.Remove(fmt.Sprintf("%s/%s", h.path, fName))
+			continue
+		}
+
+		if h.filter.Match(fName, f.IsDir()) {
+			continue
+		}
+
+		fs, link, ok := h.lstat(fmt.Sprintf("%s/%s", h.path, fName))
+		if !ok {
+			continue
+		}
+
+		if link != "" {
+			h.meta[fName] = h.linkMeta(fName, fs, link)
+			continue
 		}
-		if !f.IsDir() {
-			meta := Meta{
-				Name:       fName,
-				Size:       f.Size(),
-				ModifyTime: f.ModTime(),
-			}
+
+		if !fs.IsDir() {
+			meta := h.fileMeta(fName, fs)
 
 			h.logger.Printf("handler :: got file with following meta --> %s\n", meta)
 			h.meta[fName] = meta
 			continue
 		} else {
-			err = h.readDir(fName, level+1)
+			if h.loop(fName, visited) {
+				continue
+			}
+			h.meta[fName] = h.dirMeta(fName, fs)
+
+			err = h.readDir(fName, visited)
 			if err != nil {
 				return err
 			}
@@ -93,6 +215,221 @@ func (h *Handler) readDir(path string, level int) error {
 	return nil
 }
 
+// ignored
+// check whether given name is filtered out, a tracked directory is matched as
+// directory whatever the event says.
+func (h *Handler) ignored(name string, dir bool) bool {
+	name = h.relName(name)
+
+	h.rwM.RLock()
+	m, ok := h.meta[name]
+	h.rwM.RUnlock()
+
+	return h.filter.Match(name, dir || (ok && m.Dir))
+}
+
+// loop
+// check whether given directory resolves to one of the directories being
+// walked.
+func (h *Handler) loop(name string, visited map[string]struct{}) bool {
+	if visited == nil {
+		return false
+	}
+
+	real, err := filepath.EvalSymlinks(fmt.Sprintf("%s/%s", h.path, name))
+	if err != nil {
+		return true
+	}
+	if _, ok := visited[real]; ok {
+		h.logger.Printf("handler :: skip directory %s, symlink loop to %s\n", name, real)
+		return true
+	}
+	return false
+}
+
+// cachedMeta
+// meta data of a file from its stat, hash of tracked meta data is reused when
+// file size and modification time are unchanged. ok is false when content has
+// to be hashed again. caller should hold the lock.
+func (h *Handler) cachedMeta(name string, fs os.FileInfo) (Meta, bool) {
+	meta := Meta{
+		Name:       name,
+		Size:       fs.Size(),
+		ModifyTime: fs.ModTime(),
+		Mode:       fs.Mode() & modeMask,
+		Owner:      owner(fs),
+	}
+
+	if prev, ok := h.meta[name]; ok && prev.Hash != "" && !prev.Dir && prev.Link == "" &&
+		prev.Size == meta.Size && prev.ModifyTime.Equal(meta.ModifyTime) &&
+		hashAlgorithmOf(prev.Hash) == h.hash {
+		meta.Hash = prev.Hash
+		return meta, true
+	}
+	return meta, false
+}
+
+// fileMeta
+// meta data of a file from its stat with its content hash. caller should hold
+// the lock.
+func (h *Handler) fileMeta(name string, fs os.FileInfo) Meta {
+	meta, ok := h.cachedMeta(name, fs)
+	if !ok {
+		meta.Hash = h.hashContent(name)
+	}
+	return meta
+}
+
+// hashContent
+// content hash of given file, empty when it can't be read.
+func (h *Handler) hashContent(name string) string {
+	sum, err := hashFile(fmt.Sprintf("%s/%s", h.path, name), h.hash)
+	if err != nil {
+		h.logger.Printf("ERROR handler :: got error %v on hashing file %s\n", err, name)
+	}
+	return sum
+}
+
+// dirMeta
+// meta data of a directory from its stat.
+func (h *Handler) dirMeta(name string, fs os.FileInfo) Meta {
+	return Meta{
+		Name:       name,
+		ModifyTime: fs.ModTime(),
+		Dir:        true,
+		Mode:       fs.Mode() & modeMask,
+		Owner:      owner(fs),
+	}
+}
+
+// Stat
+// refresh meta data of given name from file system and return it. content is
+// hashed without holding the lock, a file written meanwhile is hashed again
+// and its hash is left empty when it doesn't settle.
+func (h *Handler) Stat(name string) (*Meta, error) {
+	h.rwM.Lock()
+	defer h.rwM.Unlock()
+
+	name, path, err := h.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashed os.FileInfo
+	var sum string
+	for attempt := 0; ; attempt++ {
+		fs, link, ok := h.lstat(path)
+		if !ok {
+			h.deleteMeta(name)
+			return nil, fmt.Errorf("untracked file name %s", name)
+		}
+
+		var meta Meta
+		switch {
+		case link != "":
+			meta = h.linkMeta(name, fs, link)
+		case fs.IsDir():
+			meta = h.dirMeta(name, fs)
+		default:
+			var cached bool
+			meta, cached = h.cachedMeta(name, fs)
+			switch {
+			case cached:
+			case hashed != nil && sameStat(hashed, fs):
+				meta.Hash = sum
+			case attempt < hashAttempts:
+				h.rwM.Unlock()
+				sum, hashed = h.hashContent(name), fs
+				h.rwM.Lock()
+				continue
+			}
+		}
+		h.meta[name] = meta
+
+		return &meta, nil
+	}
+}
+
+// hashAttempts
+// times Stat hashes a file which keeps changing while it is hashed.
+const hashAttempts = 3
+
+func sameStat(a os.FileInfo, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// SameContent
+// check whether local copy of given file has given content hash, local copy
+// is hashed again when hash was computed with another algorithm.
+func (h *Handler) SameContent(name string, sum string) bool {
+	if sum == "" {
+		return false
+	}
+
+	meta, err := h.Stat(name)
+	if err != nil || meta.Dir || meta.Link != "" {
+		return false
+	}
+
+	if hashAlgorithmOf(meta.Hash) == hashAlgorithmOf(sum) {
+		return meta.Hash == sum
+	}
+
+	alg := hashAlgorithmOf(sum)
+	if alg.new() == nil {
+		return false
+	}
+
+	local, err := hashFile(fmt.Sprintf("%s/%s", h.path, meta.Name), alg)
+	return err == nil && local == sum
+}
+
+// addParents
+// record meta data of parent directories of given name which are not tracked yet.
+func (h *Handler) addParents(name string) {
+	for dir := filepath.Dir(name); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if _, ok := h.meta[dir]; ok {
+			return
+		}
+
+		fs, err := os.Stat(fmt.Sprintf("%s/%s", h.path, dir))
+		if err != nil || !fs.IsDir() {
+			return
+		}
+
+		h.meta[dir] = h.dirMeta(dir, fs)
+	}
+}
+
+// deleteMeta
+// forget given name, and every name under it when it is a directory.
+func (h *Handler) deleteMeta(name string) {
+	delete(h.meta, name)
+
+	prefix := name + "/"
+	for n := range h.meta {
+		if strings.HasPrefix(n, prefix) {
+			delete(h.meta, n)
+		}
+	}
+}
+
+// List
+// snapshot of all tracked files and directories sorted by name, a directory
+// comes before its content.
+func (h *Handler) List() []Meta {
+	h.rwM.RLock()
+	defer h.rwM.RUnlock()
+
+	list := make([]Meta, 0, len(h.meta))
+	for _, meta := range h.meta {
+		list = append(list, meta)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
 func (h *Handler) ListFiles() {
 	h.rwM.RLock()
 	defer h.rwM.RUnlock()
@@ -107,77 +444,190 @@ func (h *Handler) RemoveFile(name string) error {
 	h.rwM.Lock()
 	defer h.rwM.Unlock()
 
-	name = strings.TrimPrefix(name, "./")
-	name = fmt.Sprintf("%s/%s", h.path, name)
+	name, path, err := h.resolve(name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("invalid file name %q", name)
+	}
 
-	_ = os.RemoveAll(name)
-	return h.readDir(h.path, 0)
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+
+	h.deleteMeta(name)
+	return nil
 }
 
-func (h *Handler) ReadFile(name string) ([]byte, error) {
-	h.rwM.RLock()
-	defer h.rwM.RUnlock()
+// MoveFile
+// rename file or directory, parent directories of destination are created.
+func (h *Handler) MoveFile(from string, to string) error {
+	h.rwM.Lock()
+	defer h.rwM.Unlock()
 
-	name = strings.TrimPrefix(name, ".")
-	name = strings.TrimPrefix(name, h.path)
+	from, src, err := h.resolve(from)
+	if err != nil {
+		return err
+	}
+	to, dst, err := h.resolve(to)
+	if err != nil {
+		return err
+	}
+	if from == "" || to == "" {
+		return fmt.Errorf("invalid move of root, %q to %q", from, to)
+	}
 
-	_, ok := h.meta[name]
-	if !ok {
-		return nil, fmt.Errorf("invalid file name %s", name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return fmt.Errorf("error %v create path %s", err, filepath.Dir(dst))
 	}
 
-	name = fmt.Sprintf("%s/%s", h.path, name)
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
 
-	return os.ReadFile(name)
+	h.moveMeta(from, to)
+	h.addParents(to)
+	return nil
 }
 
-func (h *Handler) WriteFile(name string, data []byte) error {
+// MakeDir
+// create directory together with its parents, given attributes are applied
+// to the directory itself.
+func (h *Handler) MakeDir(name string, a Attr) error {
 	h.rwM.Lock()
 	defer h.rwM.Unlock()
 
-	name = strings.TrimPrefix(name, ".")
-	name = strings.TrimPrefix(name, "/")
-	name = fmt.Sprintf("%s/%s", h.path, name)
-	_, err := os.Stat(name)
+	name, path, err := h.resolve(name)
 	if err != nil {
-		nl := strings.Split(name, "/")
+		return err
+	}
+	if err := os.MkdirAll(path, 0777); err != nil {
+		return fmt.Errorf("error %v create path %s", err, path)
+	}
 
-		if len(nl) == 1 {
-			// create file only
-			f, err := os.Create(name)
-			if err != nil {
-				return fmt.Errorf("error create file %v", err)
-			}
+	if err := a.apply(path); err != nil {
+		return err
+	}
 
-			n, err := f.Write(data)
-			if n != len(data) || err != nil {
-				return fmt.Errorf("error on write into file %s - %d,%d - %v", name, n, len(data), err)
-			}
+	fs, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
 
-			return h.readDir(h.path, 0) // update local cache files
-		}
+	h.meta[name] = h.dirMeta(name, fs)
+	h.addParents(name)
+	return nil
+}
+
+// RemoveDir
+// remove directory recursively, entries for which keep returns true are left
+// in place together with the directories containing them.
+func (h *Handler) RemoveDir(name string, keep func(name string) bool) error {
+	h.rwM.Lock()
+	defer h.rwM.Unlock()
 
-		path := strings.Join(nl[:len(nl)-1], "/")
-		err = os.MkdirAll(path, 0777)
+	name, root, err := h.resolve(name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("invalid directory name %q", name)
+	}
+
+	var paths []string
+	err = filepath.WalkDir(root, func(path string, _ os.DirEntry, err error) error {
 		if err != nil {
-			return fmt.Errorf("error %v create path %s", err, path)
+			return err
 		}
+		paths = append(paths, path)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		h.deleteMeta(name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-		f, err := os.Create(name)
-		if err != nil {
-			return fmt.Errorf("error %v create file, %s", err, name)
+	// reverse order visits content of a directory before directory itself.
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	kept := make(map[string]struct{})
+	for _, path := range paths {
+		rel := h.relName(path)
+		if _, ok := kept[rel]; ok {
+			continue
+		}
+		if keep != nil && keep(rel) {
+			for dir := filepath.Dir(rel); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+				kept[dir] = struct{}{}
+			}
+			continue
 		}
 
-		n, err := f.Write(data)
-		if n != len(data) || err != nil {
-			return fmt.Errorf("error on write into file %s - %d,%d - %v", name, n, len(data), err)
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
+		delete(h.meta, rel)
+	}
+
+	return nil
+}
+
+// moveMeta
+// rename meta data of a file, or of a directory and everything under it.
+func (h *Handler) moveMeta(from string, to string) {
+	if m, ok := h.meta[from]; ok {
+		delete(h.meta, from)
+		m.Name = to
+		h.meta[to] = m
+	}
+
+	prefix := from + "/"
+	for name, m := range h.meta {
+		if strings.HasPrefix(name, prefix) {
+			delete(h.meta, name)
+			m.Name = to + "/" + strings.TrimPrefix(name, prefix)
+			h.meta[m.Name] = m
+		}
+	}
+}
+
+func (h *Handler) ReadFile(name string) ([]byte, error) {
+	h.rwM.RLock()
+	defer h.rwM.RUnlock()
 
-		return h.readDir(h.path, 0) // update local cache files
+	name, path, err := h.resolve(name)
+	if err != nil {
+		return nil, err
 	}
 
-	// rewrite given file
-	return os.WriteFile(name, data, 0777)
+	_, ok := h.meta[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid file name %s", name)
+	}
+
+	return os.ReadFile(path)
+}
+
+// WriteFile
+// replace content of given file through a staging file.
+func (h *Handler) WriteFile(name string, data []byte) error {
+	w, err := h.NewFileWriter(name)
+	if err != nil {
+		return err
+	}
+
+	n, err := w.Write(data)
+	if n != len(data) || err != nil {
+		_ = w.Abort()
+		return fmt.Errorf("error on write into file %s - %d,%d - %v", name, n, len(data), err)
+	}
+
+	return w.Commit()
 }
 
 // EventHook
@@ -188,36 +638,77 @@ func (h *Handler) EventHook(e model.Event, err error) {
 		return
 	}
 
-	if strings.Contains(e.Name, "swp") ||
-		strings.Contains(e.Name, ".goutputstream") ||
-		strings.HasSuffix(e.Name, "~") ||
+	if IsStaging(e.Name) ||
 		strings.HasPrefix(e.Name, "exit") ||
-		e.Op.Has(model.Chmod) {
+		h.ignored(e.Name, e.Op.Has(model.Mkdir) || e.Op.Has(model.Rmdir)) {
 		return
 	}
 
-	if e.Op == model.Remove || e.Op == model.Rename {
-		h.logger.Printf("handler :: remove file meta --> %s, on event %s\n", h.meta[e.Name], e)
-		delete(h.meta, e.Name)
+	if e.Op == model.Move {
+		h.rwM.Lock()
+		defer h.rwM.Unlock()
+
+		h.logger.Printf("handler :: move file meta, on event %s\n", e)
+		name := h.relName(e.Name)
+		h.moveMeta(h.relName(e.OldName), name)
+
+		// old name may not be tracked (temporary files renamed into place).
+		fs, link, ok := h.lstat(e.Name)
+		switch {
+		case !ok:
+			h.deleteMeta(name)
+		case link != "":
+			h.meta[name] = h.linkMeta(name, fs, link)
+		case fs.IsDir():
+			h.meta[name] = h.dirMeta(name, fs)
+		default:
+			h.meta[name], _ = h.cachedMeta(name, fs)
+		}
 		return
 	}
 
-	fs, err := os.Stat(e.Name)
-	if err != nil {
-		h.logger.Printf("ERROR handler :: got error %v, on event %s\n", err, e)
+	if e.Op == model.Remove || e.Op == model.Rename || e.Op == model.Rmdir {
+		h.rwM.Lock()
+		defer h.rwM.Unlock()
+
+		name := h.relName(e.Name)
+		h.logger.Printf("handler :: remove file meta --> %s, on event %s\n", h.meta[name], e)
+		h.deleteMeta(name)
+		return
+	}
+
+	fs, link, ok := h.lstat(e.Name)
+	if !ok {
+		h.logger.Printf("handler :: skip untracked file, on event %s\n", e)
+		return
+	}
+
+	e.Name = h.relName(e.Name)
+	if link != "" {
+		h.rwM.Lock()
+		defer h.rwM.Unlock()
+
+		h.logger.Printf("handler :: got link meta, on event %s\n", e)
+		h.meta[e.Name] = h.linkMeta(e.Name, fs, link)
+		return
+	}
+
+	if fs.IsDir() && (e.Op == model.Mkdir || e.Op == model.Chmod) {
+		h.rwM.Lock()
+		defer h.rwM.Unlock()
+
+		h.logger.Printf("handler :: got dir meta, on event %s\n", e)
+		h.meta[e.Name] = h.dirMeta(e.Name, fs)
 		return
 	}
 
-	e.Name = strings.TrimPrefix(e.Name, h.path)
 	if !fs.IsDir() {
 		h.rwM.Lock()
 		defer h.rwM.Unlock()
 
-		meta := Meta{
-			Name:       e.Name,
-			Size:       fs.Size(),
-			ModifyTime: fs.ModTime(),
-		}
+		// a file being written gets an event on every write, it is hashed
+		// once on Stat instead of here under the lock.
+		meta, _ := h.cachedMeta(e.Name, fs)
 		if _, contains := h.meta[e.Name]; contains {
 			h.logger.Printf("handler :: got modification on file meta --> %s, on event %s\n", h.meta[e.Name], e)
 		} else {
@@ -1,10 +1,13 @@
 package filehandler
 
 import (
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
 	"github.com/stretchr/testify/require"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 var (
@@ -45,3 +48,196 @@ func TestFileHandler_Copy(t *testing.T) {
 	err = h.RemoveFile(file)
 	require.NoError(t, err, "remove file error !!")
 }
+
+func TestFileHandler_Dirs(t *testing.T) {
+	path := t.TempDir()
+
+	h, err := NewHandler(path, lg)
+	require.NoError(t, err, "read temporary directory.")
+
+	require.NoError(t, h.MakeDir("empty", Attr{}))
+	require.NoError(t, h.MakeDir("tree/sub", Attr{}))
+	require.NoError(t, os.WriteFile(path+"/tree/sub/a.txt", []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(path+"/tree/sub/b.txt", []byte("b"), 0644))
+
+	h, err = NewHandler(path, lg)
+	require.NoError(t, err, "read temporary directory again.")
+
+	names := make([]string, 0)
+	for _, m := range h.List() {
+		names = append(names, m.Name)
+	}
+	require.Equal(t, []string{"empty", "tree", "tree/sub", "tree/sub/a.txt", "tree/sub/b.txt"}, names)
+	require.True(t, h.GetMeta("tree/sub").Dir)
+	require.False(t, h.GetMeta("tree/sub/a.txt").Dir)
+
+	// entries which are kept hold their parent directories.
+	keep := func(name string) bool { return name == "tree/sub/b.txt" }
+	require.NoError(t, h.RemoveDir("tree", keep))
+	require.NoFileExists(t, path+"/tree/sub/a.txt")
+	require.FileExists(t, path+"/tree/sub/b.txt")
+	require.Nil(t, h.GetMeta("tree/sub/a.txt"))
+	require.NotNil(t, h.GetMeta("tree/sub"))
+
+	require.NoError(t, h.RemoveDir("tree", nil))
+	require.NoDirExists(t, path+"/tree")
+	require.Nil(t, h.GetMeta("tree"))
+	require.NotNil(t, h.GetMeta("empty"))
+}
+
+func TestFileHandler_Hash(t *testing.T) {
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(path+"/a.txt", []byte("abc"), 0644))
+
+	h, err := NewHandler(path, lg)
+	require.NoError(t, err, "read temporary directory.")
+	require.Equal(t, "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", h.GetMeta("a.txt").Hash)
+
+	b, err := NewHandler(path, lg, WithHash(HashBLAKE3))
+	require.NoError(t, err, "read temporary directory with blake3.")
+	require.Equal(t, "blake3:6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85", b.GetMeta("a.txt").Hash)
+
+	n, err := NewHandler(path, lg, WithHash(HashNone))
+	require.NoError(t, err, "read temporary directory without hash.")
+	require.Empty(t, n.GetMeta("a.txt").Hash)
+
+	// hash of other algorithm is computed on demand.
+	require.True(t, h.SameContent("a.txt", b.GetMeta("a.txt").Hash))
+	require.True(t, n.SameContent("a.txt", h.GetMeta("a.txt").Hash))
+	require.False(t, h.SameContent("a.txt", ""))
+
+	require.NoError(t, os.WriteFile(path+"/a.txt", []byte("abcd"), 0644))
+	require.False(t, h.SameContent("a.txt", b.GetMeta("a.txt").Hash))
+	meta, err := h.Stat("a.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(4), meta.Size)
+	require.NotEqual(t, b.GetMeta("a.txt").Hash, meta.Hash)
+
+	// write events don't hash under the lock, next stat does.
+	require.NoError(t, os.WriteFile(path+"/a.txt", []byte("abcde"), 0644))
+	h.EventHook(model.Event{Name: path + "/a.txt", Op: model.Write}, nil)
+	require.Equal(t, int64(5), h.GetMeta("a.txt").Size)
+	require.Empty(t, h.GetMeta("a.txt").Hash)
+	meta, err = h.Stat("a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "sha256:36bbe50ed96841d10443bcb670d6554f0a34b761be67ec9c4a8ad2c0c44ca42c", meta.Hash)
+	require.Equal(t, meta.Hash, h.GetMeta("a.txt").Hash)
+
+	_, err = ParseHashAlgorithm("md5")
+	require.ErrorIs(t, err, ErrHashAlgorithm)
+	alg, err := ParseHashAlgorithm("")
+	require.NoError(t, err)
+	require.Equal(t, HashSHA256, alg)
+}
+
+func TestFileHandler_Staging(t *testing.T) {
+	path := t.TempDir()
+	require.NoError(t, os.MkdirAll(path+"/sub", 0755))
+	require.NoError(t, os.WriteFile(path+"/sub/.rfswatcher-123.tmp", []byte("partial"), 0600))
+	require.NoError(t, os.WriteFile(path+"/a.txt", []byte("old"), 0644))
+
+	// leftovers of interrupted transfers are removed on startup.
+	h, err := NewHandler(path, lg)
+	require.NoError(t, err, "read temporary directory.")
+	require.NoFileExists(t, path+"/sub/.rfswatcher-123.tmp")
+	require.Nil(t, h.GetMeta("sub/.rfswatcher-123.tmp"))
+
+	w, err := h.NewFileWriter("a.txt")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("new content"))
+	require.NoError(t, err)
+
+	// destination is untouched until commit.
+	data, err := os.ReadFile(path + "/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "old", string(data))
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	w.SetAttr(Attr{ModTime: mtime})
+	require.NoError(t, w.Commit())
+
+	fs, err := os.Stat(path + "/a.txt")
+	require.NoError(t, err)
+	require.True(t, mtime.Equal(fs.ModTime()))
+	require.Equal(t, os.FileMode(0644), fs.Mode().Perm())
+	require.True(t, mtime.Equal(h.GetMeta("a.txt").ModifyTime))
+	sum, err := hashFile(path+"/a.txt", HashSHA256)
+	require.NoError(t, err)
+	require.Equal(t, sum, h.GetMeta("a.txt").Hash, "content is hashed while written")
+
+	entries, err := os.ReadDir(path)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.False(t, IsStaging(e.Name()), "staging file %s is left", e.Name())
+	}
+}
+
+func TestFileHandler_Attr(t *testing.T) {
+	for _, m := range []os.FileMode{0644, 0755, 0600 | os.ModeSetuid, 0775 | os.ModeSetgid, 0777 | os.ModeSticky} {
+		require.Equal(t, m, FileMode(PosixMode(m)))
+	}
+	require.Equal(t, uint32(0o4755), PosixMode(0755|os.ModeSetuid))
+	require.Equal(t, uint32(0o1777), PosixMode(0777|os.ModeSticky))
+
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(path+"/a.txt", []byte("a"), 0644))
+
+	h, err := NewHandler(path, lg)
+	require.NoError(t, err, "read temporary directory.")
+	require.Equal(t, os.FileMode(0644), h.GetMeta("a.txt").Mode)
+	hash := h.GetMeta("a.txt").Hash
+
+	mtime := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	require.NoError(t, h.SetAttr("a.txt", Attr{Mode: 0600, HasMode: true, ModTime: mtime}))
+
+	fs, err := os.Stat(path + "/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fs.Mode().Perm())
+	require.True(t, mtime.Equal(fs.ModTime()))
+
+	meta := h.GetMeta("a.txt")
+	require.Equal(t, os.FileMode(0600), meta.Mode)
+	require.True(t, mtime.Equal(meta.ModifyTime))
+	require.Equal(t, hash, meta.Hash, "content is unchanged")
+
+	// content changed since it was tracked is hashed again.
+	require.NoError(t, os.WriteFile(path+"/a.txt", []byte("b"), 0600))
+	require.NoError(t, h.SetAttr("a.txt", Attr{ModTime: mtime}))
+	sum, err := hashFile(path+"/a.txt", HashSHA256)
+	require.NoError(t, err)
+	require.Equal(t, sum, h.GetMeta("a.txt").Hash)
+
+	require.NoError(t, h.MakeDir("private", Attr{Mode: 0700, HasMode: true}))
+	fs, err = os.Stat(path + "/private")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fs.Mode().Perm())
+	require.Equal(t, os.FileMode(0700), h.GetMeta("private").Mode)
+}
+
+func TestFileHandler_Filter(t *testing.T) {
+	path := t.TempDir()
+	require.NoError(t, os.MkdirAll(path+"/node_modules/pkg", 0755))
+	require.NoError(t, os.WriteFile(path+"/node_modules/pkg/a.js", []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(path+"/a.txt", []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(path+"/a.txt.swp", []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(path+"/b.tmp", []byte("b"), 0644))
+
+	f, err := filter.New("node_modules/", "*.tmp")
+	require.NoError(t, err)
+	h, err := NewHandler(path, lg, WithFilter(f))
+	require.NoError(t, err, "read temporary directory.")
+
+	list := h.List()
+	require.Len(t, list, 2)
+	require.Equal(t, "a.txt", list[0].Name)
+	require.Equal(t, "a.txt.swp", list[1].Name, "defaults are replaced by given filter")
+
+	require.NoError(t, os.WriteFile(path+"/c.tmp", []byte("c"), 0644))
+	h.EventHook(model.Event{Name: path + "/c.tmp", Op: model.Write}, nil)
+	require.Nil(t, h.GetMeta("c.tmp"), "event of ignored name")
+
+	d, err := NewHandler(path, lg)
+	require.NoError(t, err, "read temporary directory.")
+	require.Nil(t, d.GetMeta("a.txt.swp"), "default filter")
+	require.NotNil(t, d.GetMeta("node_modules/pkg/a.js"))
+}
@@ -0,0 +1,162 @@
+package filehandler
+
+import (
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+)
+
+// stagingPattern
+// name pattern of temporary files used while a file is being received.
+const stagingPattern = ".rfswatcher-*.tmp"
+
+// IsStaging
+// check whether given name is a staging file, they should be ignored by
+// watchers, they are never complete files.
+func IsStaging(name string) bool {
+	ok, _ := filepath.Match(stagingPattern, filepath.Base(name))
+	return ok
+}
+
+// OpenFile
+// open a tracked file for streaming read, caller should close the returned file.
+func (h *Handler) OpenFile(name string) (*os.File, *Meta, error) {
+	h.rwM.RLock()
+	defer h.rwM.RUnlock()
+
+	name, path, err := h.resolve(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta, ok := h.meta[name]
+	if !ok || meta.Dir || meta.Link != "" {
+		return nil, nil, fmt.Errorf("invalid file name %s", name)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f, &meta, nil
+}
+
+// FileWriter
+// receive file content into a staging file next to the destination, the
+// destination is only replaced on Commit, so readers never see a partial file.
+// content is hashed while it is written, Commit doesn't read it back.
+type FileWriter struct {
+	h    *Handler
+	name string
+	f    *os.File
+	hs   hash.Hash
+	size int64
+	attr Attr
+}
+
+func (h *Handler) NewFileWriter(name string) (*FileWriter, error) {
+	name, path, err := h.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("invalid file name %q", name)
+	}
+
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("error %v create path %s", err, dir)
+	}
+
+	f, err := os.CreateTemp(dir, stagingPattern)
+	if err != nil {
+		return nil, fmt.Errorf("error %v create staging file for %s", err, name)
+	}
+
+	return &FileWriter{h: h, name: name, f: f, hs: h.hash.new()}, nil
+}
+
+// Size
+// number of bytes written so far.
+func (w *FileWriter) Size() int64 {
+	return w.size
+}
+
+func (w *FileWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if w.hs != nil {
+		_, _ = w.hs.Write(p[:n])
+	}
+	w.size += int64(n)
+	return n, err
+}
+
+// SetAttr
+// attributes given to the file on Commit, without mode the file gets 0644 and
+// without modification time it keeps the time of writing.
+func (w *FileWriter) SetAttr(a Attr) {
+	w.attr = a
+}
+
+// Commit
+// flush staging file to disk, move it into its destination and update local
+// cache. a crash leaves either the old or the new content in place.
+func (w *FileWriter) Commit() error {
+	if err := w.f.Sync(); err != nil {
+		_ = w.Abort()
+		return err
+	}
+
+	if err := w.f.Close(); err != nil {
+		_ = os.Remove(w.f.Name())
+		return err
+	}
+
+	// staging files are created private, give the file regular permissions.
+	attr := w.attr
+	if !attr.HasMode {
+		attr.Mode, attr.HasMode = 0644, true
+	}
+	if err := attr.apply(w.f.Name()); err != nil {
+		_ = os.Remove(w.f.Name())
+		return err
+	}
+
+	w.h.rwM.Lock()
+	defer w.h.rwM.Unlock()
+
+	dst := fmt.Sprintf("%s/%s", w.h.path, w.name)
+	if err := os.Rename(w.f.Name(), dst); err != nil {
+		_ = os.Remove(w.f.Name())
+		return fmt.Errorf("error %v move staging file into %s", err, dst)
+	}
+
+	fs, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+
+	// content is replaced, hash of previous content must not be reused.
+	delete(w.h.meta, w.name)
+	meta, _ := w.h.cachedMeta(w.name, fs)
+	meta.Hash = formatHash(w.h.hash, w.hs)
+	w.h.meta[w.name] = meta
+	w.h.addParents(w.name)
+
+	// rename is only durable once parent directory is flushed.
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return fmt.Errorf("error %v sync directory of %s", err, dst)
+	}
+
+	return nil
+}
+
+// Abort
+// drop staging file, destination is left untouched.
+func (w *FileWriter) Abort() error {
+	_ = w.f.Close()
+	return os.Remove(w.f.Name())
+}
@@ -0,0 +1,90 @@
+package filehandler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// HashAlgorithm
+// algorithm of content hash kept in file meta data, hashes are formatted as
+// "<algorithm>:<hex digest>" so hashes of different algorithms never match.
+type HashAlgorithm string
+
+const (
+	HashSHA256 HashAlgorithm = "sha256"
+	HashBLAKE3 HashAlgorithm = "blake3"
+	// HashNone disable content hashing, changes are detected by size and
+	// modification time only.
+	HashNone HashAlgorithm = "none"
+)
+
+var ErrHashAlgorithm = errors.New("unknown hash algorithm")
+
+// ParseHashAlgorithm
+// validate algorithm name from configuration, empty name is sha256.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	switch alg := HashAlgorithm(strings.ToLower(name)); alg {
+	case "":
+		return HashSHA256, nil
+	case HashSHA256, HashBLAKE3, HashNone:
+		return alg, nil
+	default:
+		return "", errors.Join(ErrHashAlgorithm, fmt.Errorf("algorithm %q", name))
+	}
+}
+
+func (a HashAlgorithm) new() hash.Hash {
+	switch a {
+	case HashSHA256:
+		return sha256.New()
+	case HashBLAKE3:
+		return blake3.New(32, nil)
+	default:
+		return nil
+	}
+}
+
+// hashFile
+// content hash of given file, empty when algorithm is none.
+func hashFile(path string, alg HashAlgorithm) (string, error) {
+	hs := alg.new()
+	if hs == nil {
+		return "", nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(hs, f); err != nil {
+		return "", err
+	}
+
+	return formatHash(alg, hs), nil
+}
+
+// formatHash
+// formatted hash of content written into hs, empty when hs is nil.
+func formatHash(alg HashAlgorithm, hs hash.Hash) string {
+	if hs == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", alg, hex.EncodeToString(hs.Sum(nil)))
+}
+
+// hashAlgorithmOf
+// algorithm of a formatted hash.
+func hashAlgorithmOf(sum string) HashAlgorithm {
+	alg, _, _ := strings.Cut(sum, ":")
+	return HashAlgorithm(alg)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package filehandler
+
+import "os"
+
+// ownership isn't available, it is never replicated.
+func owner(fi os.FileInfo) *Owner {
+	return nil
+}
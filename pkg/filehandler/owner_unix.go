@@ -0,0 +1,16 @@
+//go:build unix
+
+package filehandler
+
+import (
+	"os"
+	"syscall"
+)
+
+func owner(fi os.FileInfo) *Owner {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &Owner{Uid: int(st.Uid), Gid: int(st.Gid)}
+}
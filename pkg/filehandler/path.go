@@ -0,0 +1,79 @@
+package filehandler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrUnsafePath is joined to every error of a name rejected by path
+	// confinement, callers check it with errors.Is to count rejected names.
+	ErrUnsafePath    = errors.New("unsafe path")
+	ErrInvalidPath   = errors.New("invalid path name")
+	ErrAbsolutePath  = errors.New("absolute path name")
+	ErrPathTraversal = errors.New("path name escapes root")
+	ErrSymlinkEscape = errors.New("path name resolves out of root through symbolic link")
+)
+
+// CleanName
+// normalize a name received from remote into its form relative to root. the
+// single leading "/" used on wire is accepted, names which are absolute after
+// it, contain ".." components or NUL bytes are rejected.
+func CleanName(name string) (string, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(name, "./"), "/")
+	switch {
+	case strings.ContainsRune(rel, 0):
+		return "", errors.Join(ErrUnsafePath, ErrInvalidPath, fmt.Errorf("name %q", name))
+	case strings.HasPrefix(rel, "/") || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "":
+		return "", errors.Join(ErrUnsafePath, ErrAbsolutePath, fmt.Errorf("name %q", name))
+	}
+
+	for _, part := range strings.FieldsFunc(rel, isSeparator) {
+		if part == ".." {
+			return "", errors.Join(ErrUnsafePath, ErrPathTraversal, fmt.Errorf("name %q", name))
+		}
+	}
+
+	rel = filepath.ToSlash(filepath.Clean(filepath.FromSlash(rel)))
+	if rel == "." {
+		rel = ""
+	}
+	return rel, nil
+}
+
+func isSeparator(r rune) bool {
+	return r == '/' || r == filepath.Separator
+}
+
+// resolve
+// confine given name to handler root, returns its name relative to root and
+// its path on disk. like os.Root, symbolic links on the way are accepted only
+// while they resolve inside root. the last component is not resolved, it is
+// the entry being operated on.
+func (h *Handler) resolve(name string) (rel string, path string, err error) {
+	rel, err = CleanName(h.trimRoot(name))
+	if err != nil {
+		return "", "", err
+	}
+	if rel == "" {
+		return "", h.path, nil
+	}
+
+	parts := strings.Split(rel, "/")
+	dir := h.path
+	for _, part := range parts[:len(parts)-1] {
+		dir = fmt.Sprintf("%s/%s", dir, part)
+		fs, err := os.Lstat(dir)
+		if err != nil {
+			break // nothing exists below, it is created inside root.
+		}
+		if fs.Mode()&os.ModeSymlink != 0 && !h.withinRoot(dir) {
+			return "", "", errors.Join(ErrUnsafePath, ErrSymlinkEscape, fmt.Errorf("name %q", name))
+		}
+	}
+
+	return rel, fmt.Sprintf("%s/%s", h.path, rel), nil
+}
@@ -0,0 +1,80 @@
+package filehandler
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanName(t *testing.T) {
+	for name, want := range map[string]string{
+		"/a.txt":      "a.txt",
+		"a.txt":       "a.txt",
+		"./dir/a.txt": "dir/a.txt",
+		"dir//./a":    "dir/a",
+		"/":           "",
+		"..a/b..":     "..a/b..",
+	} {
+		got, err := CleanName(name)
+		require.NoError(t, err, name)
+		require.Equal(t, want, got, name)
+	}
+
+	for name, kind := range map[string]error{
+		"../../etc/x":  ErrPathTraversal,
+		"/dir/../../x": ErrPathTraversal,
+		"dir/..":       ErrPathTraversal,
+		"//etc/passwd": ErrAbsolutePath,
+		"a\x00b":       ErrInvalidPath,
+	} {
+		_, err := CleanName(name)
+		require.ErrorIs(t, err, ErrUnsafePath, name)
+		require.ErrorIs(t, err, kind, name)
+	}
+}
+
+func TestFileHandler_Confinement(t *testing.T) {
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(outside+"/victim.txt", []byte("victim"), 0644))
+
+	path := t.TempDir()
+	require.NoError(t, os.MkdirAll(path+"/dir", 0755))
+	require.NoError(t, os.WriteFile(path+"/dir/a.txt", []byte("a"), 0644))
+	if err := os.Symlink(outside, path+"/escape"); err != nil {
+		t.Skipf("symbolic links are not supported, %v", err)
+	}
+	require.NoError(t, os.Symlink("dir", path+"/inside"))
+
+	h, err := NewHandler(path, lg)
+	require.NoError(t, err, "read temporary directory.")
+
+	require.ErrorIs(t, h.RemoveFile("../"+outside), ErrPathTraversal)
+	require.ErrorIs(t, h.WriteFile("/../x.txt", []byte("x")), ErrPathTraversal)
+	_, err = h.ReadFile("dir/../../x")
+	require.ErrorIs(t, err, ErrUnsafePath)
+	require.ErrorIs(t, h.MoveFile("dir/a.txt", "../a.txt"), ErrPathTraversal)
+	require.ErrorIs(t, h.MakeDir("../dir", Attr{}), ErrPathTraversal)
+	require.ErrorIs(t, h.RemoveDir("..", nil), ErrPathTraversal)
+
+	// symbolic link on the way must resolve inside root.
+	require.ErrorIs(t, h.WriteFile("escape/victim.txt", []byte("x")), ErrSymlinkEscape)
+	require.ErrorIs(t, h.RemoveFile("escape/victim.txt"), ErrSymlinkEscape)
+	data, err := os.ReadFile(outside + "/victim.txt")
+	require.NoError(t, err)
+	require.Equal(t, "victim", string(data), "file out of root is untouched")
+
+	require.NoError(t, h.WriteFile("inside/b.txt", []byte("b")))
+	data, err = os.ReadFile(path + "/dir/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, "b", string(data))
+
+	// link itself is the entry operated on, not its target.
+	require.NoError(t, h.RemoveFile("escape"))
+	_, err = os.Stat(outside + "/victim.txt")
+	require.NoError(t, err)
+
+	require.Error(t, h.RemoveFile("/"), "root itself is never removed")
+	_, err = os.Stat(path + "/dir/a.txt")
+	require.NoError(t, err)
+}
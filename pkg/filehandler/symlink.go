@@ -0,0 +1,208 @@
+package filehandler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy
+// how symbolic links found under handler root are handled.
+type SymlinkPolicy string
+
+const (
+	// SymlinkIgnore symbolic links are neither tracked nor replicated.
+	SymlinkIgnore SymlinkPolicy = "ignore"
+	// SymlinkCopyAsLink symbolic links are replicated as links with the same
+	// target, they are never followed.
+	SymlinkCopyAsLink SymlinkPolicy = "copy-as-link"
+	// SymlinkFollowWithinRoot symbolic links pointing inside root are followed
+	// and replicated as regular files and directories, others are ignored.
+	SymlinkFollowWithinRoot SymlinkPolicy = "follow-within-root"
+)
+
+var ErrSymlinkPolicy = errors.New("unknown symlink policy")
+
+// ParseSymlinkPolicy
+// validate policy name from configuration, empty name is ignore.
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	switch p := SymlinkPolicy(strings.ToLower(name)); p {
+	case "":
+		return SymlinkIgnore, nil
+	case SymlinkIgnore, SymlinkCopyAsLink, SymlinkFollowWithinRoot:
+		return p, nil
+	default:
+		return "", errors.Join(ErrSymlinkPolicy, fmt.Errorf("policy %q", name))
+	}
+}
+
+// WithSymlinks
+// policy applied to symbolic links.
+func WithSymlinks(policy SymlinkPolicy) Option {
+	return func(h *Handler) {
+		h.symlinks = policy
+	}
+}
+
+// Symlinks
+// policy applied to symbolic links.
+func (h *Handler) Symlinks() SymlinkPolicy {
+	return h.symlinks
+}
+
+// lstat
+// decide how given path is tracked. fs is the stat of what is tracked (link
+// target when link is followed), link is the target of a link copied as is.
+// ok is false for paths which are not tracked: ignored links, links leaving
+// root and special files (sockets, pipes, devices).
+func (h *Handler) lstat(path string) (fs os.FileInfo, link string, ok bool) {
+	fs, err := os.Lstat(path)
+	if err != nil {
+		return nil, "", false
+	}
+
+	if fs.Mode()&os.ModeSymlink != 0 {
+		switch h.symlinks {
+		case SymlinkCopyAsLink:
+			link, err = os.Readlink(path)
+			return fs, link, err == nil
+		case SymlinkFollowWithinRoot:
+			if !h.withinRoot(path) {
+				h.logger.Printf("handler :: skip symlink %s, it points out of root\n", path)
+				return nil, "", false
+			}
+			if fs, err = os.Stat(path); err != nil {
+				return nil, "", false
+			}
+		default:
+			return nil, "", false
+		}
+	}
+
+	if !fs.Mode().IsRegular() && !fs.IsDir() {
+		h.logger.Printf("handler :: skip special file %s, mode %s\n", path, fs.Mode())
+		return nil, "", false
+	}
+
+	return fs, "", true
+}
+
+// withinRoot
+// check whether given path resolves to a path under handler root.
+func (h *Handler) withinRoot(path string) bool {
+	root, err := filepath.EvalSymlinks(h.path)
+	if err != nil {
+		return false
+	}
+
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(root, real)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// Target
+// name relative to root given name resolves to once links are followed, ok is
+// false when it resolves out of root. a name which doesn't exist, like a
+// removed file, resolves through its closest existing parent.
+func (h *Handler) Target(name string) (string, bool) {
+	name, _, err := h.resolve(name)
+	if err != nil {
+		return "", false
+	}
+	root, err := filepath.EvalSymlinks(h.path)
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.Split(name, "/")
+	for i := len(parts); i >= 0; i-- {
+		real, err := filepath.EvalSymlinks(filepath.Join(append([]string{h.path}, parts[:i]...)...))
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, filepath.Join(append([]string{real}, parts[i:]...)...))
+		rel = filepath.ToSlash(rel)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", false
+		}
+		if rel == "." {
+			rel = ""
+		}
+		return rel, true
+	}
+	return "", false
+}
+
+// linkMeta
+// meta data of a symbolic link copied as is.
+func (h *Handler) linkMeta(name string, fs os.FileInfo, link string) Meta {
+	return Meta{
+		Name:       name,
+		Size:       int64(len(link)),
+		ModifyTime: fs.ModTime(),
+		Link:       link,
+		Owner:      owner(fs),
+	}
+}
+
+// MakeLink
+// create or replace symbolic link, link is put in place atomically. target is
+// received from remote, it must be relative and stay under root once resolved
+// from link directory.
+func (h *Handler) MakeLink(name string, target string) error {
+	h.rwM.Lock()
+	defer h.rwM.Unlock()
+
+	name, dst, err := h.resolve(name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("invalid link name %q", name)
+	}
+	if filepath.IsAbs(target) || strings.HasPrefix(target, "/") {
+		return errors.Join(ErrUnsafePath, ErrAbsolutePath, fmt.Errorf("link %q target %q", name, target))
+	}
+	resolved := filepath.ToSlash(filepath.Join(filepath.Dir(name), target))
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return errors.Join(ErrUnsafePath, ErrSymlinkEscape, fmt.Errorf("link %q target %q", name, target))
+	}
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("error %v create path %s", err, dir)
+	}
+
+	// reserve a staging name, link is created under it and renamed into place.
+	f, err := os.CreateTemp(dir, stagingPattern)
+	if err != nil {
+		return fmt.Errorf("error %v create staging link for %s", err, name)
+	}
+	tmp := f.Name()
+	_ = f.Close()
+	_ = os.Remove(tmp)
+
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("error %v move staging link into %s", err, dst)
+	}
+
+	fs, err := os.Lstat(dst)
+	if err != nil {
+		return err
+	}
+
+	h.meta[name] = h.linkMeta(name, fs, target)
+	h.addParents(name)
+	return nil
+}
@@ -0,0 +1,77 @@
+//go:build unix
+
+package filehandler
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileHandler_Symlinks(t *testing.T) {
+	_, err := ParseSymlinkPolicy("copy")
+	require.ErrorIs(t, err, ErrSymlinkPolicy)
+	p, err := ParseSymlinkPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, SymlinkIgnore, p)
+
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(outside+"/secret.txt", []byte("secret"), 0644))
+
+	path := t.TempDir()
+	require.NoError(t, os.MkdirAll(path+"/dir", 0755))
+	require.NoError(t, os.WriteFile(path+"/dir/a.txt", []byte("a"), 0644))
+	require.NoError(t, os.Symlink("dir/a.txt", path+"/file-link"))
+	require.NoError(t, os.Symlink("dir", path+"/dir-link"))
+	require.NoError(t, os.Symlink("..", path+"/dir/loop"))
+	require.NoError(t, os.Symlink(outside+"/secret.txt", path+"/outside"))
+	require.NoError(t, syscall.Mkfifo(path+"/fifo", 0644))
+
+	h, err := NewHandler(path, lg)
+	require.NoError(t, err, "read temporary directory.")
+	require.Nil(t, h.GetMeta("file-link"), "links are ignored by default")
+	require.Nil(t, h.GetMeta("fifo"), "special files are skipped")
+	require.Len(t, h.List(), 2)
+
+	c, err := NewHandler(path, lg, WithSymlinks(SymlinkCopyAsLink))
+	require.NoError(t, err, "read temporary directory.")
+	require.Equal(t, "dir/a.txt", c.GetMeta("file-link").Link)
+	require.Equal(t, "dir", c.GetMeta("dir-link").Link)
+	require.Equal(t, "..", c.GetMeta("dir/loop").Link)
+	require.Equal(t, outside+"/secret.txt", c.GetMeta("outside").Link)
+	require.Nil(t, c.GetMeta("fifo"))
+	require.False(t, c.SameContent("file-link", c.GetMeta("dir/a.txt").Hash), "link is not compared by content")
+	_, _, err = c.OpenFile("file-link")
+	require.Error(t, err, "link has no content to send")
+
+	f, err := NewHandler(path, lg, WithSymlinks(SymlinkFollowWithinRoot))
+	require.NoError(t, err, "read temporary directory, loop must not recurse forever.")
+	require.Equal(t, "", f.GetMeta("file-link").Link)
+	require.Equal(t, f.GetMeta("dir/a.txt").Hash, f.GetMeta("file-link").Hash)
+	require.True(t, f.GetMeta("dir-link").Dir)
+	require.NotNil(t, f.GetMeta("dir-link/a.txt"))
+	require.Nil(t, f.GetMeta("dir/loop"), "loop back to root is not followed")
+	require.Nil(t, f.GetMeta("outside"), "link out of root is not followed")
+	require.Nil(t, f.GetMeta("fifo"))
+
+	dst := t.TempDir()
+	d, err := NewHandler(dst, lg, WithSymlinks(SymlinkCopyAsLink))
+	require.NoError(t, err)
+	require.NoError(t, d.MakeLink("sub/link", "../target"))
+	target, err := os.Readlink(dst + "/sub/link")
+	require.NoError(t, err)
+	require.Equal(t, "../target", target)
+	require.Equal(t, "../target", d.GetMeta("sub/link").Link)
+	require.True(t, d.GetMeta("sub").Dir)
+
+	require.ErrorIs(t, d.MakeLink("sub/escape", "../../outside"), ErrSymlinkEscape)
+	require.ErrorIs(t, d.MakeLink("absolute", outside+"/secret.txt"), ErrAbsolutePath)
+	require.Nil(t, d.GetMeta("absolute"))
+
+	require.NoError(t, d.MakeLink("sub/link", "other"), "existing link is replaced")
+	target, err = os.Readlink(dst + "/sub/link")
+	require.NoError(t, err)
+	require.Equal(t, "other", target)
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package filehandler
+
+// directories can't be opened for sync, rename is left to the file system.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package filehandler
+
+import "os"
+
+// syncDir
+// flush directory entries to disk, so a rename into it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
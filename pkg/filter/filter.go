@@ -0,0 +1,196 @@
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// IgnoreFile name of the optional patterns file in watched root.
+const IgnoreFile = ".rfsignore"
+
+var ErrFilterPattern = errors.New("invalid filter pattern")
+
+// Defaults
+// editor swap, gtk temporary and backup files, always ignored.
+var Defaults = []string{
+	"*swp*",
+	".goutputstream*",
+	"*~",
+}
+
+type rule struct {
+	parts   []string
+	negate  bool
+	dirOnly bool
+}
+
+// Filter
+// decides which names under a watched root are ignored, patterns use
+// .gitignore syntax :
+//
+//	# comment
+//	*.tmp           any file or directory named so, at any depth
+//	node_modules/   directories only, with everything under them
+//	/build          anchored to root, as is any pattern with a slash
+//	docs/**/a.pdf   ** matches any number of directories
+//	!keep.tmp       negation, re-includes a name excluded before
+//
+// the last matching pattern wins. as in git, a name under an ignored directory
+// can't be re-included.
+type Filter struct {
+	rules []rule
+}
+
+// New
+// compile given patterns, lines in .gitignore syntax.
+func New(patterns ...string) (*Filter, error) {
+	f := Filter{}
+	for _, p := range patterns {
+		if err := f.add(p); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
+}
+
+// Default
+// filter of the default patterns only.
+func Default() *Filter {
+	f, _ := New(Defaults...)
+	return f
+}
+
+// Load
+// compile default patterns, given ones (from configuration) and those of
+// IgnoreFile in root when it exists, in this order.
+func Load(root string, patterns []string) (*Filter, error) {
+	f, err := New(append(append([]string{}, Defaults...), patterns...)...)
+	if err != nil || root == "" {
+		return f, err
+	}
+
+	file, err := os.Open(fmt.Sprintf("%s/%s", root, IgnoreFile))
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if err := f.add(scanner.Text()); err != nil {
+			return nil, fmt.Errorf("%s line %d, %w", IgnoreFile, line, err)
+		}
+	}
+	return f, scanner.Err()
+}
+
+func (f *Filter) add(pattern string) error {
+	line := strings.TrimSuffix(pattern, "\r")
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	r := rule{}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// a pattern without slash matches at any depth.
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return errors.Join(ErrFilterPattern, fmt.Errorf("pattern %q", pattern))
+	}
+
+	r.parts = strings.Split(line, "/")
+	for _, part := range r.parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return errors.Join(ErrFilterPattern, fmt.Errorf("pattern %q", pattern), err)
+		}
+	}
+
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+// Match
+// check whether given name, relative to root with "/" separators, is ignored.
+// dir tells whether name is a directory. nil filter ignores nothing.
+func (f *Filter) Match(name string, dir bool) bool {
+	if f == nil || len(f.rules) == 0 {
+		return false
+	}
+
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return false
+	}
+
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if f.match(parts[:i], true) {
+			return true
+		}
+	}
+	return f.match(parts, dir)
+}
+
+func (f *Filter) match(parts []string, dir bool) bool {
+	ignored := false
+	for _, r := range f.rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+		if r.negate == ignored && matchParts(r.parts, parts) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// matchParts
+// match name components against pattern components, "**" matches any number
+// of components, a trailing one at least one.
+func matchParts(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,143 @@
+package filter
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter_Match(t *testing.T) {
+	f, err := New(
+		"# comment",
+		"",
+		"*.tmp",
+		"!keep.tmp",
+		"node_modules/",
+		"/build",
+		"docs/**/*.pdf",
+		"cache/**",
+		"\\#hash",
+	)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name    string
+		dir     bool
+		ignored bool
+	}{
+		{"a.tmp", false, true},
+		{"dir/sub/a.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"dir/keep.tmp", false, false},
+		{"a.txt", false, false},
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"web/node_modules/x/y.js", false, true},
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"src/build", true, false},
+		{"docs/a.pdf", false, true},
+		{"docs/x/y/a.pdf", false, true},
+		{"other/docs/a.pdf", false, false},
+		{"cache", true, false},
+		{"cache/a", false, true},
+		{"#hash", false, true},
+		{"/a.tmp", false, true},
+		{"", true, false},
+	} {
+		require.Equal(t, c.ignored, f.Match(c.name, c.dir), "name %q dir %v", c.name, c.dir)
+	}
+
+	var none *Filter
+	require.False(t, none.Match("a.tmp", false))
+
+	_, err = New("[a-")
+	require.ErrorIs(t, err, ErrFilterPattern)
+}
+
+func TestFilter_Defaults(t *testing.T) {
+	f := Default()
+	require.True(t, f.Match(".a.txt.swp", false))
+	require.True(t, f.Match("dir/.goutputstream-X1Y2", false))
+	require.True(t, f.Match("a.txt~", false))
+	require.False(t, f.Match("a.txt", false))
+}
+
+func TestFilter_Load(t *testing.T) {
+	root := t.TempDir()
+
+	f, err := Load(root, []string{"*.log"})
+	require.NoError(t, err, "ignore file is optional")
+	require.True(t, f.Match("a.log", false))
+	require.True(t, f.Match("a.swp", false), "defaults are always loaded")
+
+	require.NoError(t, os.WriteFile(root+"/"+IgnoreFile, []byte("vendor/\n!important.log\n"), 0644))
+	f, err = Load(root, []string{"*.log"})
+	require.NoError(t, err)
+	require.True(t, f.Match("vendor", true))
+	require.True(t, f.Match("a.log", false))
+	require.False(t, f.Match("important.log", false), "ignore file patterns come after configuration")
+
+	require.NoError(t, os.WriteFile(root+"/"+IgnoreFile, []byte("ok\n[bad\n"), 0644))
+	_, err = Load(root, nil)
+	require.ErrorIs(t, err, ErrFilterPattern)
+}
+
+func TestScope_Contains(t *testing.T) {
+	s, err := NewScope("team-a/src", "docs/**/*.md", "/shared/")
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name string
+		dir  bool
+		in   bool
+	}{
+		{"team-a", true, true},
+		{"team-a", false, false},
+		{"team-a/src", true, true},
+		{"team-a/src/x/y.go", false, true},
+		{"team-a/other.go", false, false},
+		{"team-b/src/x.go", false, false},
+		{"src", true, false},
+		{"docs", true, true},
+		{"docs/a.md", false, true},
+		{"docs/x/y/a.md", false, true},
+		{"docs/a.pdf", false, false},
+		{"shared/a", false, true},
+		{"/shared/b/c", false, true},
+		{"sub/shared/a", false, false},
+	} {
+		require.Equal(t, c.in, s.Contains(c.name, c.dir), "name %q dir %v", c.name, c.dir)
+	}
+
+	all, err := NewScope()
+	require.NoError(t, err)
+	require.Nil(t, all)
+	require.True(t, all.Contains("any/name", false))
+
+	all, err = NewScope("team-a", "/")
+	require.NoError(t, err)
+	require.Nil(t, all, "root is the whole root")
+
+	_, err = NewScope("[bad")
+	require.ErrorIs(t, err, ErrFilterPattern)
+}
+
+func TestScope_Intersect(t *testing.T) {
+	acl, err := NewScope("team-a", "shared")
+	require.NoError(t, err)
+	sub, err := NewScope("team-a/src", "team-b")
+	require.NoError(t, err)
+
+	s := sub.Intersect(acl)
+	require.True(t, s.Contains("team-a/src/x.go", false))
+	require.True(t, s.Contains("team-a", true))
+	require.False(t, s.Contains("team-a/doc.md", false))
+	require.False(t, s.Contains("team-b/x.go", false))
+	require.False(t, s.Contains("shared/x.go", false))
+
+	var all *Scope
+	require.Equal(t, acl, all.Intersect(acl))
+	require.Equal(t, acl, acl.Intersect(nil))
+}
@@ -0,0 +1,83 @@
+package filter
+
+import (
+	"path"
+	"strings"
+)
+
+// Scope
+// sub paths and glob patterns of a root a subscriber mirrors. a sub path
+// includes everything under it, directories leading to a subscribed path are
+// included too so they exist on the subscriber side. nil scope is the whole
+// root.
+type Scope struct {
+	f    *Filter
+	dirs map[string]struct{}
+	and  *Scope
+}
+
+// NewScope
+// compile given paths, relative to root with "/" separators and already
+// validated not to leave it. no path, or the root itself, is the whole root
+// and returns nil.
+func NewScope(paths ...string) (*Scope, error) {
+	s := Scope{
+		f:    &Filter{},
+		dirs: make(map[string]struct{}),
+	}
+
+	for _, p := range paths {
+		p = strings.Trim(path.Clean("/"+p), "/")
+		if p == "" {
+			return nil, nil
+		}
+
+		// anchored to root, unlike filter patterns without slash.
+		if err := s.f.add("/" + p); err != nil {
+			return nil, err
+		}
+
+		parts := strings.Split(p, "/")
+		for i := 1; i < len(parts); i++ {
+			if strings.ContainsAny(parts[i-1], "*?[\\") {
+				break
+			}
+			s.dirs[strings.Join(parts[:i], "/")] = struct{}{}
+		}
+	}
+
+	if len(s.f.rules) == 0 {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// Contains
+// check whether given name, relative to root, is in scope. dir tells whether
+// name is a directory.
+func (s *Scope) Contains(name string, dir bool) bool {
+	if s == nil {
+		return true
+	}
+
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return true
+	}
+	if _, ok := s.dirs[name]; !(ok && dir) && !s.f.Match(name, dir) {
+		return false
+	}
+	return s.and.Contains(name, dir)
+}
+
+// Intersect
+// scope of names contained in both scopes.
+func (s *Scope) Intersect(o *Scope) *Scope {
+	if s == nil {
+		return o
+	}
+	if o == nil {
+		return s
+	}
+	return &Scope{f: s.f, dirs: s.dirs, and: s.and.Intersect(o)}
+}
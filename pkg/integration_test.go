@@ -1,20 +1,33 @@
 package pkg
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"log"
+	"math/big"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/client"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/server"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/watcher"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func checkOpenSSL() error {
@@ -75,6 +88,154 @@ func genPwFile() (username string, password string, um *user.UserManager, err er
 	return username, password, um, nil
 }
 
+// harness
+// fixture of an integration test, a server on a free port of localhost and
+// its clients. servers, watchers and clients it starts are stopped at the
+// end of test.
+type harness struct {
+	t       *testing.T
+	lg      *log.Logger
+	address string
+}
+
+func newHarness(t *testing.T, name string) *harness {
+	return &harness{
+		t:       t,
+		lg:      log.New(os.Stdout, "integration "+name+" --> ", 1|4),
+		address: freeAddress(t),
+	}
+}
+
+// freeAddress
+// localhost address with a port nothing listens on, server certificates of
+// tests are issued to localhost.
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err, "failed to find a free port")
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	return net.JoinHostPort("localhost", port)
+}
+
+func (h *harness) handler(path string, options ...filehandler.Option) *filehandler.Handler {
+	f, err := filehandler.NewHandler(path, h.lg, options...)
+	require.NoError(h.t, err, "failed to init file handler of %s", path)
+	return f
+}
+
+func (h *harness) watch(path string, options ...watcher.Option) {
+	w, err := watcher.NewWatcher(path, options...)
+	require.NoError(h.t, err, "failed to init watcher of %s", path)
+	h.t.Cleanup(func() { w.Close() })
+}
+
+// serve
+// run a server with default share f of path, changes under path are sent
+// to its clients. a server without default share has nil f.
+func (h *harness) serve(path string, f *filehandler.Handler, tls *server.ServerTLS, um *user.UserManager, options ...server.Option) *server.Server {
+	s := server.NewServer(h.address, path, tls, um, h.lg, f, options...)
+	if f != nil {
+		h.watch(path,
+			watcher.WithIgnore(filehandler.IsStaging),
+			watcher.WithCallbackFunction(f.EventHook),
+			watcher.WithCallbackFunction(s.EventHook))
+	}
+	h.run(s)
+	return s
+}
+
+// run
+// run s, returns once it accepts clients.
+func (h *harness) run(s *server.Server) {
+	h.t.Helper()
+	failed := make(chan error, 1)
+	go func() { failed <- s.Run() }()
+
+	select {
+	case <-s.Ready():
+	case err := <-failed:
+		h.t.Fatalf("failed to run server: %v", err)
+	case <-time.After(time.Second * 5):
+		h.t.Fatal("server is not ready")
+	}
+	h.t.Cleanup(func() { _ = s.Exit() })
+}
+
+func (h *harness) newClient(username string, password string, tls *tls.Config, f *filehandler.Handler, options ...client.Option) *client.Client {
+	c, err := client.NewClient(h.address, username, password, tls, h.lg, f, options...)
+	require.NoError(h.t, err, "failed to init client")
+	return c
+}
+
+// mirror
+// run an anonymous client mirroring server into f.
+func (h *harness) mirror(f *filehandler.Handler, options ...client.Option) *client.Client {
+	c := h.newClient("", "", nil, f, options...)
+	h.runClient(c)
+	return c
+}
+
+// runClient
+// run c until end of test, where it must stop without error.
+func (h *harness) runClient(c *client.Client) {
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	h.t.Cleanup(func() {
+		_ = c.Exit()
+		select {
+		case err := <-done:
+			assert.NoError(h.t, err, "failed to run client")
+		case <-time.After(time.Second * 5):
+			h.t.Error("client didn't exit")
+		}
+	})
+}
+
+// start
+// run c until it stops or test ends, returned channel gets Run result.
+func (h *harness) start(c *client.Client) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+	h.t.Cleanup(func() { _ = c.Exit() })
+	return done
+}
+
+// stopped
+// run c which is expected to stop on its own, returns Run result.
+func (h *harness) stopped(c *client.Client) error {
+	h.t.Helper()
+	select {
+	case err := <-h.start(c):
+		return err
+	case <-time.After(time.Second * 10):
+		h.t.Fatal("client didn't stop")
+		return nil
+	}
+}
+
+// waitFile
+// wait until file has given content. a file written on server before its
+// client starts is there once initial sync is done and changes arrive live.
+func (h *harness) waitFile(name string, content string) {
+	h.t.Helper()
+	require.Eventually(h.t, func() bool {
+		data, err := os.ReadFile(name)
+		return err == nil && string(data) == content
+	}, time.Second*5, time.Millisecond*50, "%s is not replicated", name)
+}
+
+// newUsers
+// user manager with a single user, returns its name and password.
+func newUsers(t *testing.T) (string, string, *user.UserManager) {
+	um := &user.UserManager{PwFile: filepath.Join(t.TempDir(), "pwfile")}
+	require.NoError(t, um.Init(), "failed to init user manager")
+	require.NoError(t, um.CreateUser(&user.Creadential{Username: "user", Password: "user"}))
+	return "user", "user", um
+}
+
 func TestIntegration(t *testing.T) {
 	t.Log("Start integration test ...")
 	lg := log.New(os.Stdout, "integration --> ", 1|4)
@@ -95,7 +256,8 @@ func TestIntegration(t *testing.T) {
 
 	time.Sleep(time.Second)
 
-	c := client.NewClient(address, "", "", nil, lg, fileHandler)
+	c, err := client.NewClient(address, "", "", nil, lg, fileHandler)
+	require.NoError(t, err)
 	go func() {
 		err := c.Run()
 		require.NoError(t, err, "client error !")
@@ -146,7 +308,8 @@ func TestIntegrationWithTLS(t *testing.T) {
 	time.Sleep(time.Second)
 
 	cTlsCfg := &tls.Config{InsecureSkipVerify: true}
-	c := client.NewClient(address, "", "", cTlsCfg, lg, fileHandler)
+	c, err := client.NewClient(address, "", "", cTlsCfg, lg, fileHandler)
+	require.NoError(t, err)
 	go func() {
 		err := c.Run()
 		require.NoError(t, err, "failed to run client")
@@ -190,7 +353,8 @@ func TestIntegrationWithPW(t *testing.T) {
 
 	time.Sleep(time.Second)
 
-	c := client.NewClient(address, username, password, nil, lg, fileHandler)
+	c, err := client.NewClient(address, username, password, nil, lg, fileHandler)
+	require.NoError(t, err)
 	go func() {
 		err := c.Run()
 		require.NoError(t, err, "failed to run client")
@@ -245,7 +409,8 @@ func TestIntegrationWithTLSAndPW(t *testing.T) {
 	time.Sleep(time.Second)
 
 	cTlsCfg := &tls.Config{InsecureSkipVerify: true}
-	c := client.NewClient(address, username, password, cTlsCfg, lg, fileHandler)
+	c, err := client.NewClient(address, username, password, cTlsCfg, lg, fileHandler)
+	require.NoError(t, err)
 	go func() {
 		err := c.Run()
 		require.NoError(t, err, "failed to run client")
@@ -264,3 +429,759 @@ func TestIntegrationWithTLSAndPW(t *testing.T) {
 	<-exit
 	t.Log("Integration test with TLS and password file done.")
 }
+
+func TestIntegrationFileTransfer(t *testing.T) {
+	h := newHarness(t, "transfer")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "ready.txt"), []byte("ready"), 0644))
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+	h.mirror(h.handler(clientPath))
+	h.waitFile(filepath.Join(clientPath, "ready.txt"), "ready")
+
+	// bigger than a single chunk, with delimiter like bytes in name and content.
+	data := bytes.Repeat([]byte("some@data\n"), 100_000)
+	err := os.WriteFile(filepath.Join(serverPath, "file@name.txt"), data, 0644)
+	require.NoError(t, err, "failed to write server file")
+	h.waitFile(filepath.Join(clientPath, "file@name.txt"), string(data))
+}
+
+func TestIntegrationInitialSync(t *testing.T) {
+	h := newHarness(t, "sync")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(serverPath, "foo", "bar"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "foo", "bar", "b.txt"), []byte("b"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(clientPath, "extra.txt"), []byte("extra"), 0644))
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+	h.mirror(h.handler(clientPath), client.WithPrune(true))
+
+	require.Eventually(t, func() bool {
+		a, errA := os.ReadFile(filepath.Join(clientPath, "a.txt"))
+		b, errB := os.ReadFile(filepath.Join(clientPath, "foo", "bar", "b.txt"))
+		_, errExtra := os.Stat(filepath.Join(clientPath, "extra.txt"))
+		return errA == nil && errB == nil && string(a) == "a" && string(b) == "b" && os.IsNotExist(errExtra)
+	}, time.Second*5, time.Millisecond*50, "tree is not synchronized")
+}
+
+func TestIntegrationFanOut(t *testing.T) {
+	h := newHarness(t, "fan-out")
+
+	serverPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "ready.txt"), []byte("ready"), 0644))
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+
+	clientPaths := []string{t.TempDir(), t.TempDir()}
+	for _, clientPath := range clientPaths {
+		h.mirror(h.handler(clientPath))
+	}
+	for _, clientPath := range clientPaths {
+		h.waitFile(filepath.Join(clientPath, "ready.txt"), "ready")
+	}
+
+	for i := 0; i < 5; i++ {
+		name := filepath.Join(serverPath, fmt.Sprintf("file-%d.txt", i))
+		require.NoError(t, os.WriteFile(name, []byte(name), 0644), "failed to write server file")
+	}
+
+	for _, clientPath := range clientPaths {
+		for i := 0; i < 5; i++ {
+			h.waitFile(filepath.Join(clientPath, fmt.Sprintf("file-%d.txt", i)), filepath.Join(serverPath, fmt.Sprintf("file-%d.txt", i)))
+		}
+	}
+}
+
+func TestIntegrationDeltaTransfer(t *testing.T) {
+	h := newHarness(t, "delta")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 50_000)
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "dump.log"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(clientPath, "dump.log"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "ready.txt"), []byte("ready"), 0644))
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+	h.mirror(h.handler(clientPath), client.WithDelta(true))
+	h.waitFile(filepath.Join(clientPath, "ready.txt"), "ready")
+
+	patched := append([]byte{}, data...)
+	copy(patched[400_000:], "patched in the middle")
+	patched = append(patched, []byte("appended line\n")...)
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "dump.log"), patched, 0644))
+	h.waitFile(filepath.Join(clientPath, "dump.log"), string(patched))
+}
+
+func TestIntegrationReconnect(t *testing.T) {
+	h := newHarness(t, "reconnect")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+
+	// client starts before server is up and keeps retrying.
+	h.mirror(h.handler(clientPath), client.WithReconnectDelay(time.Millisecond*50, time.Millisecond*200))
+	time.Sleep(time.Millisecond * 500)
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+	h.waitFile(filepath.Join(clientPath, "a.txt"), "a")
+}
+
+func TestIntegrationResume(t *testing.T) {
+	h := newHarness(t, "resume")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "ready.txt"), []byte("ready"), 0644))
+
+	j, err := journal.Open(filepath.Join(t.TempDir(), "journal"), 100)
+	require.NoError(t, err, "failed to open journal")
+	defer j.Close()
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil, server.WithJournal(j), server.WithHeartbeat(time.Hour))
+
+	// no heartbeat arrives in time, so client reconnects over and over.
+	clientHandler := h.handler(clientPath)
+	h.mirror(clientHandler,
+		client.WithPrune(true),
+		client.WithHeartbeatTimeout(time.Millisecond*200),
+		client.WithReconnectDelay(time.Millisecond*10, time.Millisecond*20))
+	h.waitFile(filepath.Join(clientPath, "ready.txt"), "ready")
+
+	// a full listing would prune this file, a resumed subscription doesn't.
+	require.NoError(t, clientHandler.WriteFile("local.txt", []byte("local")))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+	h.waitFile(filepath.Join(clientPath, "a.txt"), "a")
+
+	// a few more reconnects.
+	time.Sleep(time.Second)
+	_, err = os.Stat(filepath.Join(clientPath, "local.txt"))
+	require.NoError(t, err, "client didn't resume subscription")
+	require.NotZero(t, j.Last())
+}
+
+func TestIntegrationMove(t *testing.T) {
+	h := newHarness(t, "move")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(serverPath, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "dir", "b.txt"), []byte("b"), 0644))
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+	h.mirror(h.handler(clientPath))
+
+	h.waitFile(filepath.Join(clientPath, "a.txt"), "a")
+	h.waitFile(filepath.Join(clientPath, "dir", "b.txt"), "b")
+	var before [2]os.FileInfo
+	var err error
+	before[0], err = os.Stat(filepath.Join(clientPath, "a.txt"))
+	require.NoError(t, err)
+	before[1], err = os.Stat(filepath.Join(clientPath, "dir", "b.txt"))
+	require.NoError(t, err)
+
+	require.NoError(t, os.Rename(filepath.Join(serverPath, "a.txt"), filepath.Join(serverPath, "c.txt")))
+	require.NoError(t, os.Rename(filepath.Join(serverPath, "dir"), filepath.Join(serverPath, "moved")))
+
+	require.Eventually(t, func() bool {
+		_, errA := os.Stat(filepath.Join(clientPath, "a.txt"))
+		_, errDir := os.Stat(filepath.Join(clientPath, "dir"))
+		return os.IsNotExist(errA) && os.IsNotExist(errDir)
+	}, time.Second*5, time.Millisecond*50, "old names still exist")
+
+	// same files renamed in place, not downloaded again.
+	after, err := os.Stat(filepath.Join(clientPath, "c.txt"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before[0], after), "file is downloaded again")
+
+	after, err = os.Stat(filepath.Join(clientPath, "moved", "b.txt"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before[1], after), "directory content is downloaded again")
+}
+
+func TestIntegrationDirectories(t *testing.T) {
+	h := newHarness(t, "directories")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(serverPath, "empty"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(serverPath, "tree", "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "tree", "sub", "a.txt"), []byte("a"), 0644))
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+	h.mirror(h.handler(clientPath))
+
+	// empty directories are part of initial sync.
+	h.waitFile(filepath.Join(clientPath, "tree", "sub", "a.txt"), "a")
+	fs, err := os.Stat(filepath.Join(clientPath, "empty"))
+	require.NoError(t, err, "empty directory is not synchronized")
+	require.True(t, fs.IsDir())
+
+	require.NoError(t, os.MkdirAll(filepath.Join(serverPath, "new", "deep"), 0755))
+	require.Eventually(t, func() bool {
+		fs, err := os.Stat(filepath.Join(clientPath, "new", "deep"))
+		return err == nil && fs.IsDir()
+	}, time.Second*5, time.Millisecond*50, "new directory is not created")
+
+	require.NoError(t, os.RemoveAll(filepath.Join(serverPath, "tree")))
+	require.NoError(t, os.Remove(filepath.Join(serverPath, "empty")))
+	require.Eventually(t, func() bool {
+		_, errTree := os.Stat(filepath.Join(clientPath, "tree"))
+		_, errEmpty := os.Stat(filepath.Join(clientPath, "empty"))
+		return os.IsNotExist(errTree) && os.IsNotExist(errEmpty)
+	}, time.Second*5, time.Millisecond*50, "removed directories still exist")
+}
+
+func TestIntegrationSkipIdentical(t *testing.T) {
+	h := newHarness(t, "identical")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	content := []byte("same content on both sides")
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "b.txt"), []byte("b"), 0644))
+	// older local copy with same content, size and date alone would download it.
+	require.NoError(t, os.WriteFile(filepath.Join(clientPath, "a.txt"), content, 0644))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(clientPath, "a.txt"), old, old))
+
+	before, err := os.Stat(filepath.Join(clientPath, "a.txt"))
+	require.NoError(t, err)
+
+	h.serve(serverPath, h.handler(serverPath, filehandler.WithHash(filehandler.HashBLAKE3)), nil, nil)
+	h.mirror(h.handler(clientPath, filehandler.WithHash(filehandler.HashBLAKE3)))
+
+	// downloads are applied in order, once b.txt exists a.txt was handled.
+	h.waitFile(filepath.Join(clientPath, "b.txt"), "b")
+	after, err := os.Stat(filepath.Join(clientPath, "a.txt"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after), "identical file is downloaded on initial sync")
+
+	// rewrite with same content, change events are duplicates for the client.
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), content, 0644))
+	time.Sleep(time.Millisecond * 100)
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "c.txt"), []byte("c"), 0644))
+	h.waitFile(filepath.Join(clientPath, "c.txt"), "c")
+
+	after, err = os.Stat(filepath.Join(clientPath, "a.txt"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after), "identical file is downloaded on change")
+}
+
+func TestIntegrationAttributes(t *testing.T) {
+	h := newHarness(t, "attributes")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	mtime := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "script.sh"), []byte("#!/bin/sh\n"), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(serverPath, "script.sh"), 0750))
+	require.NoError(t, os.Chtimes(filepath.Join(serverPath, "script.sh"), mtime, mtime))
+	require.NoError(t, os.Mkdir(filepath.Join(serverPath, "private"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "locked.txt"), []byte("locked"), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(serverPath, "locked.txt"), 0))
+	// read-only directory gets its mode after its content is downloaded.
+	require.NoError(t, os.Mkdir(filepath.Join(serverPath, "readonly"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "readonly", "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(serverPath, "readonly"), 0555))
+	t.Cleanup(func() {
+		_ = os.Chmod(filepath.Join(serverPath, "readonly"), 0755)
+		_ = os.Chmod(filepath.Join(clientPath, "readonly"), 0755)
+	})
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+	h.mirror(h.handler(clientPath))
+
+	require.Eventually(t, func() bool {
+		fs, err := os.Stat(filepath.Join(clientPath, "script.sh"))
+		return err == nil && fs.Mode().Perm() == 0750 && fs.ModTime().Equal(mtime)
+	}, time.Second*5, time.Millisecond*50, "file attributes are not replicated")
+
+	for name, mode := range map[string]os.FileMode{"private": 0700, "readonly": 0555, "locked.txt": 0} {
+		require.Eventually(t, func() bool {
+			fs, err := os.Stat(filepath.Join(clientPath, name))
+			return err == nil && fs.Mode().Perm() == mode
+		}, time.Second*5, time.Millisecond*50, "mode of %s is not replicated", name)
+	}
+	data, err := os.ReadFile(filepath.Join(clientPath, "readonly", "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "a", string(data))
+
+	before, err := os.Stat(filepath.Join(clientPath, "script.sh"))
+	require.NoError(t, err)
+
+	// metadata only change, content is not transferred again.
+	require.NoError(t, os.Chmod(filepath.Join(serverPath, "script.sh"), 0700))
+	require.Eventually(t, func() bool {
+		fs, err := os.Stat(filepath.Join(clientPath, "script.sh"))
+		return err == nil && fs.Mode().Perm() == 0700
+	}, time.Second*5, time.Millisecond*50, "mode change is not replicated")
+
+	after, err := os.Stat(filepath.Join(clientPath, "script.sh"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after), "file is downloaded again on mode change")
+}
+
+func TestIntegrationSymlinks(t *testing.T) {
+	h := newHarness(t, "symlinks")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(serverPath, "initial")))
+
+	h.serve(serverPath, h.handler(serverPath, filehandler.WithSymlinks(filehandler.SymlinkCopyAsLink)), nil, nil)
+	c := h.mirror(h.handler(clientPath, filehandler.WithSymlinks(filehandler.SymlinkCopyAsLink)))
+
+	require.Eventually(t, func() bool {
+		target, err := os.Readlink(filepath.Join(clientPath, "initial"))
+		return err == nil && target == "a.txt"
+	}, time.Second*5, time.Millisecond*50, "link in listing is not replicated")
+
+	// target out of client root is never created.
+	require.NoError(t, os.Symlink("../outside", filepath.Join(serverPath, "escape")))
+	require.Eventually(t, func() bool {
+		return c.RejectedPaths() == 1
+	}, time.Second*5, time.Millisecond*50, "link out of root is not rejected")
+	_, err := os.Lstat(filepath.Join(clientPath, "escape"))
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(serverPath, "live")))
+	require.Eventually(t, func() bool {
+		target, err := os.Readlink(filepath.Join(clientPath, "live"))
+		return err == nil && target == "a.txt"
+	}, time.Second*5, time.Millisecond*50, "created link is not replicated")
+
+	require.NoError(t, os.Remove(filepath.Join(serverPath, "live")))
+	require.Eventually(t, func() bool {
+		_, err := os.Lstat(filepath.Join(clientPath, "live"))
+		return os.IsNotExist(err)
+	}, time.Second*5, time.Millisecond*50, "removed link is not replicated")
+}
+
+func TestIntegrationFollowSymlinks(t *testing.T) {
+	h := newHarness(t, "follow symlinks")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(serverPath, "target", "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "target", "sub", "a.txt"), []byte("a"), 0644))
+
+	serverHandler := h.handler(serverPath, filehandler.WithSymlinks(filehandler.SymlinkFollowWithinRoot))
+	s := server.NewServer(h.address, serverPath, nil, nil, h.lg, serverHandler)
+	h.watch(serverPath,
+		watcher.WithFollowSymlinks(true),
+		watcher.WithCallbackFunction(serverHandler.EventHook),
+		watcher.WithCallbackFunction(s.EventHook))
+	h.run(s)
+	h.mirror(h.handler(clientPath))
+
+	h.waitFile(filepath.Join(clientPath, "target", "sub", "a.txt"), "a")
+
+	// link to a directory created live is sent as a directory with content.
+	require.NoError(t, os.Symlink("target", filepath.Join(serverPath, "link")))
+	h.waitFile(filepath.Join(clientPath, "link", "sub", "a.txt"), "a")
+
+	fs, err := os.Lstat(filepath.Join(clientPath, "link"))
+	require.NoError(t, err)
+	require.True(t, fs.IsDir(), "followed link is replicated as directory")
+}
+
+func TestIntegrationSubscribePaths(t *testing.T) {
+	h := newHarness(t, "paths")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+
+	for _, dir := range []string{"team-a/src", "team-b"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(serverPath, dir), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "team-a/src/a.go"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "team-b/b.go"), []byte("b"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "root.txt"), []byte("root"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(clientPath, "local.txt"), []byte("local"), 0644))
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil)
+	h.mirror(h.handler(clientPath), client.WithPaths("/team-a"), client.WithPrune(true))
+
+	h.waitFile(filepath.Join(clientPath, "team-a/src/a.go"), "a")
+
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "team-b/c.go"), []byte("c"), 0644))
+	require.NoError(t, os.Rename(filepath.Join(serverPath, "team-b/b.go"), filepath.Join(serverPath, "team-a/b.go")))
+	h.waitFile(filepath.Join(clientPath, "team-a/b.go"), "b")
+
+	require.NoError(t, os.Rename(filepath.Join(serverPath, "team-a/src/a.go"), filepath.Join(serverPath, "team-b/a.go")))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(clientPath, "team-a/src/a.go"))
+		return os.IsNotExist(err)
+	}, time.Second*5, time.Millisecond*50, "file moved out of subscribed path is not removed")
+
+	for _, name := range []string{"team-b", "root.txt"} {
+		_, err := os.Stat(filepath.Join(clientPath, name))
+		require.True(t, os.IsNotExist(err), "%s is out of subscribed path", name)
+	}
+	_, err := os.Stat(filepath.Join(clientPath, "local.txt"))
+	require.NoError(t, err, "local file out of subscribed path is pruned")
+}
+
+func TestIntegrationShares(t *testing.T) {
+	h := newHarness(t, "shares")
+
+	docsPath := t.TempDir()
+	mediaPath := t.TempDir()
+	privatePath := t.TempDir()
+	clientPath := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(docsPath, "doc.txt"), []byte("doc"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(mediaPath, "media.bin"), []byte("media"), 0644))
+
+	var shares []server.Option
+	for name, path := range map[string]string{"docs": docsPath, "media": mediaPath, "private": privatePath} {
+		f := h.handler(path)
+
+		var options []server.ShareOption
+		if name == "private" {
+			options = append(options, server.WithShareUsers("admin"))
+		}
+		sh := server.NewShare(name, path, f, options...)
+		shares = append(shares, server.WithShare(sh))
+		h.watch(path, watcher.WithCallbackFunction(f.EventHook), watcher.WithCallbackFunction(sh.EventHook))
+	}
+
+	h.serve("", nil, nil, nil, shares...)
+	clientHandler := h.handler(clientPath)
+	h.mirror(clientHandler, client.WithShare("docs"))
+
+	h.waitFile(filepath.Join(clientPath, "doc.txt"), "doc")
+
+	require.NoError(t, os.WriteFile(filepath.Join(docsPath, "new.txt"), []byte("new"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(mediaPath, "other.bin"), []byte("other"), 0644))
+	h.waitFile(filepath.Join(clientPath, "new.txt"), "new")
+
+	for _, name := range []string{"media.bin", "other.bin"} {
+		_, err := os.Stat(filepath.Join(clientPath, name))
+		require.True(t, os.IsNotExist(err), "%s belongs to another share", name)
+	}
+
+	for _, name := range []string{"missing", "private", ""} {
+		rejected := h.newClient("", "", nil, clientHandler, client.WithShare(name))
+		require.ErrorIs(t, h.stopped(rejected), client.ErrClientSubscriptionRejected, "share %q", name)
+	}
+}
+
+func TestIntegrationSync(t *testing.T) {
+	h := newHarness(t, "sync mode")
+
+	serverPath := t.TempDir()
+	syncPath := t.TempDir()
+	mirrorPath := t.TempDir()
+
+	// edited on both sides while client was offline, client copy is newer.
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "c.txt"), []byte("server"), 0644))
+	require.NoError(t, os.Chtimes(filepath.Join(serverPath, "c.txt"), old, old))
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "c.txt"), []byte("client"), 0644))
+
+	h.serve(serverPath, h.handler(serverPath), nil, nil, server.WithSync(server.ConflictKeepBoth))
+
+	syncHandler := h.handler(syncPath)
+	sc := h.newClient("", "", nil, syncHandler, client.WithSync(true))
+	h.watch(syncPath,
+		watcher.WithIgnore(filehandler.IsStaging),
+		watcher.WithCallbackFunction(syncHandler.EventHook),
+		watcher.WithCallbackFunction(sc.EventHook))
+	h.runClient(sc)
+	h.mirror(h.handler(mirrorPath))
+
+	// conflict copy keeps client content, client gets server version back.
+	require.Eventually(t, func() bool {
+		copies, _ := filepath.Glob(filepath.Join(serverPath, "c.txt.conflict-*"))
+		if len(copies) != 1 {
+			return false
+		}
+		data, _ := os.ReadFile(copies[0])
+		local, _ := os.ReadFile(filepath.Join(syncPath, "c.txt"))
+		return string(data) == "client" && string(local) == "server"
+	}, time.Second*5, time.Millisecond*50, "conflict is not resolved with keep-both")
+
+	data, err := os.ReadFile(filepath.Join(serverPath, "c.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "server", string(data), "server version is replaced on conflict")
+
+	// local change is pushed and sent to other clients.
+	require.NoError(t, os.WriteFile(filepath.Join(syncPath, "local.txt"), []byte("local"), 0644))
+	h.waitFile(filepath.Join(serverPath, "local.txt"), "local")
+	h.waitFile(filepath.Join(mirrorPath, "local.txt"), "local")
+
+	// server change is applied on sync client, not pushed back.
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "remote.txt"), []byte("remote"), 0644))
+	h.waitFile(filepath.Join(syncPath, "remote.txt"), "remote")
+
+	require.NoError(t, os.Remove(filepath.Join(syncPath, "local.txt")))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(serverPath, "local.txt"))
+		return os.IsNotExist(err)
+	}, time.Second*5, time.Millisecond*50, "local removal is not pushed")
+
+	copies, err := filepath.Glob(filepath.Join(serverPath, "*.conflict-*"))
+	require.NoError(t, err)
+	require.Len(t, copies, 1, "changes received from server are pushed back")
+}
+
+func TestIntegrationACL(t *testing.T) {
+	h := newHarness(t, "acl")
+
+	serverPath := t.TempDir()
+	username, password, um := newUsers(t)
+	um.AclFile = filepath.Join(t.TempDir(), "acl")
+	require.NoError(t, os.WriteFile(um.AclFile, []byte(username+":ro:team-a\n"), 0600))
+	require.NoError(t, um.Init(), "failed to load acl file")
+
+	h.serve(serverPath, h.handler(serverPath), nil, um)
+
+	c := h.newClient(username, password, nil, h.handler(t.TempDir()), client.WithPaths("team-b"))
+	err := h.stopped(c)
+	require.ErrorIs(t, err, client.ErrClientSubscriptionRejected)
+	require.ErrorIs(t, err, client.ErrClientPermissionDenied)
+}
+
+func TestIntegrationSessions(t *testing.T) {
+	h := newHarness(t, "sessions")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+
+	username, password, um := newUsers(t)
+	um.AclFile = filepath.Join(t.TempDir(), "acl")
+	um.MaxSessions = 1
+	require.NoError(t, os.WriteFile(um.AclFile, []byte(username+":admin:\n"), 0600))
+	require.NoError(t, um.Init(), "failed to load acl file")
+
+	h.serve(serverPath, h.handler(serverPath), nil, um)
+	stopped := h.start(h.newClient(username, password, nil, h.handler(clientPath)))
+
+	// downloads join the subscription session instead of taking another one.
+	h.waitFile(filepath.Join(clientPath, "a.txt"), "a")
+
+	// admin requests open no session, they work with max sessions reached.
+	admin := h.newClient(username, password, nil, h.handler(t.TempDir()))
+	t.Cleanup(func() { _ = admin.Exit() })
+	sessions, err := admin.Sessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, username, sessions[0].Username)
+
+	// another login waits for a free session instead of giving up.
+	otherPath := t.TempDir()
+	otherStopped := h.start(h.newClient(username, password, nil, h.handler(otherPath),
+		client.WithReconnectDelay(time.Millisecond*100, time.Millisecond*200)))
+	time.Sleep(time.Second)
+	select {
+	case err := <-otherStopped:
+		t.Fatalf("client refused for too many sessions stops, %v", err)
+	default:
+	}
+	list, err := admin.Sessions()
+	require.NoError(t, err)
+	require.Len(t, list, 1, "max sessions is not enforced")
+	require.Equal(t, sessions[0].Id, list[0].Id)
+
+	// killed session is closed and its client is refused when it comes back.
+	require.NoError(t, admin.KillSession(sessions[0].Id))
+	select {
+	case err := <-stopped:
+		require.ErrorIs(t, err, client.ErrClientAuthenticationFailed)
+	case <-time.After(time.Second * 15):
+		t.Fatal("client of killed session reconnects")
+	}
+	require.ErrorIs(t, admin.KillSession(sessions[0].Id), client.ErrClientKillSession)
+
+	// freed session goes to the waiting client.
+	h.waitFile(filepath.Join(otherPath, "a.txt"), "a")
+	list, err = admin.Sessions()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.NotEqual(t, sessions[0].Id, list[0].Id)
+}
+
+func TestIntegrationClientCert(t *testing.T) {
+	h := newHarness(t, "client cert")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+
+	username, _, um := newUsers(t)
+
+	// self-signed CA, neither side uses the system trust store.
+	dir := t.TempDir()
+	ca, caKey, caFile := genCA(t, dir)
+	serverCrt, serverKey := genCert(t, dir, ca, caKey, "server", "localhost")
+	userCrt, userKey := genCert(t, dir, ca, caKey, username)
+	strangerCrt, strangerKey := genCert(t, dir, ca, caKey, "stranger")
+
+	tlsCfg := &server.ServerTLS{Key: serverKey, Cert: serverCrt, ClientCA: caFile, RequireClientCert: true}
+	h.serve(serverPath, h.handler(serverPath), tlsCfg, um)
+
+	// certificate common name is the user, no password.
+	cTlsCfg, err := client.TLSConfig(caFile, userCrt, userKey)
+	require.NoError(t, err, "failed to load client tls configuration")
+	h.runClient(h.newClient("", "", cTlsCfg, h.handler(clientPath)))
+	h.waitFile(filepath.Join(clientPath, "a.txt"), "a")
+
+	// verified certificate of an unknown user falls back to password check.
+	sTlsCfg, err := client.TLSConfig(caFile, strangerCrt, strangerKey)
+	require.NoError(t, err, "failed to load client tls configuration")
+	other := h.newClient("", "", sTlsCfg, h.handler(t.TempDir()))
+	require.ErrorIs(t, h.stopped(other), client.ErrClientAuthenticationFailed, "unknown certificate user is logged in")
+}
+
+func TestIntegrationScram(t *testing.T) {
+	h := newHarness(t, "scram")
+
+	serverPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+
+	// user from before SCRAM, its bcrypt hash is replaced on first login.
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	pwFile := filepath.Join(t.TempDir(), "pwfile")
+	require.NoError(t, os.WriteFile(pwFile, []byte("legacy:"+string(hash)+"\n"), 0600))
+	um := &user.UserManager{PwFile: pwFile, Cleartext: true}
+	require.NoError(t, um.Init())
+
+	h.serve(serverPath, h.handler(serverPath), nil, um)
+
+	download := func(password string, options ...client.Option) error {
+		clientPath := t.TempDir()
+		done := h.start(h.newClient("legacy", password, nil, h.handler(clientPath), options...))
+
+		for range 100 {
+			select {
+			case err := <-done:
+				return err
+			case <-time.After(time.Millisecond * 100):
+			}
+			if _, err := os.Stat(filepath.Join(clientPath, "a.txt")); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("file is not downloaded")
+	}
+
+	// password is sent in clear only over tls or when client opted in.
+	require.ErrorIs(t, download("secret"), client.ErrClientAuthenticationFailed)
+	require.ErrorIs(t, download("wrong", client.WithLegacyPassword(true)), client.ErrClientAuthenticationFailed)
+	require.NoError(t, download("secret", client.WithLegacyPassword(true)), "legacy user login")
+
+	content, err := os.ReadFile(pwFile)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "legacy:scram-sha-256$", "bcrypt hash is not migrated")
+
+	require.NoError(t, download("secret"), "SCRAM login")
+	require.ErrorIs(t, download("wrong"), client.ErrClientAuthenticationFailed)
+}
+
+func TestIntegrationScramTLS(t *testing.T) {
+	h := newHarness(t, "scram tls")
+
+	serverPath := t.TempDir()
+	clientPath := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(serverPath, "a.txt"), []byte("a"), 0644))
+
+	// user from before SCRAM and server without cleartext_passwords.
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	pwFile := filepath.Join(t.TempDir(), "pwfile")
+	require.NoError(t, os.WriteFile(pwFile, []byte("legacy:"+string(hash)+"\n"), 0600))
+	um := &user.UserManager{PwFile: pwFile}
+	require.NoError(t, um.Init())
+
+	dir := t.TempDir()
+	ca, caKey, caFile := genCA(t, dir)
+	serverCrt, serverKey := genCert(t, dir, ca, caKey, "server", "localhost")
+	h.serve(serverPath, h.handler(serverPath), &server.ServerTLS{Key: serverKey, Cert: serverCrt}, um)
+
+	// password sent over tls migrates the user.
+	tlsCfg, err := client.TLSConfig(caFile, "", "")
+	require.NoError(t, err, "failed to load client tls configuration")
+	h.runClient(h.newClient("legacy", "secret", tlsCfg, h.handler(clientPath)))
+	h.waitFile(filepath.Join(clientPath, "a.txt"), "a")
+
+	content, err := os.ReadFile(pwFile)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "legacy:scram-sha-256$", "bcrypt hash is not migrated")
+}
+
+// genCA
+// self-signed CA certificate written to dir, returns certificate, its key
+// and bundle file.
+func genCA(t *testing.T, dir string) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "failed to generate CA key")
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rfswatcher test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err, "failed to create CA certificate")
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err, "failed to parse CA certificate")
+
+	file := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return ca, key, file
+}
+
+// genCert
+// certificate with given common name and DNS names signed by ca, usable
+// by both server and client, returns certificate and key files.
+func genCert(t *testing.T, dir string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, cn string, dns ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "failed to generate key")
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err, "failed to generate serial number")
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dns,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	require.NoError(t, err, "failed to create certificate")
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err, "failed to marshal key")
+
+	crtFile := filepath.Join(dir, cn+".crt")
+	keyFile := filepath.Join(dir, cn+".key")
+	require.NoError(t, os.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return crtFile, keyFile
+}
@@ -0,0 +1,280 @@
+package journal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+)
+
+/*
+	Journal keeps the most recent change events with a monotonically increasing
+	sequence number. with a path it is persisted as json lines :
+
+		{"id":"<journal id>"}
+		{"sq":1,"t":"...","n":"foo.txt","op":2}
+		...
+
+	the file is compacted to the last `size` entries once it holds twice as many.
+	journal id changes whenever sequence numbers restart, so a sequence number
+	is meaningful only together with its journal id.
+
+	changes made while server is down are not journaled, so a new id is given
+	on every Open. clients resuming from an older journal get a full listing,
+	the file keeps sequence numbers increasing across restarts.
+*/
+
+const DefaultSize = 10000
+
+var ErrJournalFormat = errors.New("something is wrong with the journal file content format")
+
+type Entry struct {
+	Seq     uint64    `json:"sq"`
+	Time    time.Time `json:"t"`
+	Name    string    `json:"n"`
+	Op      model.Op  `json:"op"`
+	OldName string    `json:"on,omitempty"`
+}
+
+func (e Entry) Event() model.Event {
+	return model.Event{Name: e.Name, Op: e.Op, OldName: e.OldName}
+}
+
+type header struct {
+	Id string `json:"id"`
+}
+
+type Journal struct {
+	mu      sync.Mutex
+	id      string
+	path    string
+	size    int
+	entries []Entry
+	last    uint64
+	f       *os.File
+	lines   int
+}
+
+// Open
+// load journal from given path, or create it. an empty path keeps the
+// journal in memory only.
+func Open(path string, size int) (*Journal, error) {
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	j := &Journal{path: path, size: size}
+	if path == "" {
+		j.id = newId()
+		return j, nil
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		j.id = newId()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		j.id = newId()
+		return scanner.Err()
+	}
+
+	h := header{}
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil || h.Id == "" {
+		return errors.Join(ErrJournalFormat, fmt.Errorf("invalid header %q", scanner.Text()))
+	}
+	j.id = newId()
+
+	for scanner.Scan() {
+		e := Entry{}
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil || e.Seq == 0 || (len(j.entries) > 0 && e.Seq != j.last+1) {
+			return errors.Join(ErrJournalFormat, fmt.Errorf("invalid entry %q", scanner.Text()))
+		}
+		j.last = e.Seq
+		j.entries = append(j.entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	j.trim()
+	return nil
+}
+
+// rewrite
+// write header and retained entries into a new file and replace the old one.
+func (j *Journal) rewrite() error {
+	if j.f != nil {
+		_ = j.f.Close()
+		j.f = nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), "journal_*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header{Id: j.id}); err != nil {
+		tmp.Close()
+		return err
+	}
+	for _, e := range j.entries {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+
+	j.f, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0600)
+	j.lines = len(j.entries)
+	return err
+}
+
+func (j *Journal) trim() {
+	if len(j.entries) > j.size {
+		j.entries = append([]Entry(nil), j.entries[len(j.entries)-j.size:]...)
+	}
+}
+
+// Id
+// identity of the sequence numbers of this journal.
+func (j *Journal) Id() string {
+	return j.id
+}
+
+// Path
+// file journal is persisted to, empty for an in memory journal.
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Last
+// sequence number of the latest event, 0 when there is none.
+func (j *Journal) Last() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.last
+}
+
+// Append
+// assign next sequence number to given event and record it. the entry is
+// returned even when persisting fails, it is kept in memory anyway.
+func (j *Journal) Append(e model.Event) (Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.last++
+	entry := Entry{
+		Seq:     j.last,
+		Time:    time.Now(),
+		Name:    e.Name,
+		Op:      e.Op,
+		OldName: e.OldName,
+	}
+	j.entries = append(j.entries, entry)
+	j.trim()
+
+	if j.f == nil {
+		return entry, nil
+	}
+
+	if j.lines >= 2*j.size {
+		return entry, j.rewrite()
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+
+	j.lines++
+	_, err = j.f.Write(append(b, '\n'))
+	return entry, err
+}
+
+// Since
+// entries after given sequence number, ok is false when the journal doesn't
+// retain all of them (too old or unknown sequence number).
+func (j *Journal) Since(seq uint64) (entries []Entry, ok bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if seq > j.last {
+		return nil, false
+	}
+
+	if seq == j.last {
+		return nil, true
+	}
+
+	if len(j.entries) == 0 || j.entries[0].Seq > seq+1 {
+		return nil, false
+	}
+
+	first := seq + 1 - j.entries[0].Seq
+	return append([]Entry(nil), j.entries[first:]...), true
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
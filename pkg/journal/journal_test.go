@@ -0,0 +1,91 @@
+package journal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal_Since(t *testing.T) {
+	j, err := Open("", 3)
+	require.NoError(t, err)
+
+	entries, ok := j.Since(0)
+	require.True(t, ok, "empty journal is up to date")
+	require.Empty(t, entries)
+
+	for i := 1; i <= 5; i++ {
+		e, err := j.Append(model.Event{Name: fmt.Sprintf("file-%d", i), Op: model.Write})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), e.Seq)
+	}
+	require.Equal(t, uint64(5), j.Last())
+
+	tests := []struct {
+		name  string
+		seq   uint64
+		ok    bool
+		names []string
+	}{
+		{name: "up to date", seq: 5, ok: true},
+		{name: "retained", seq: 3, ok: true, names: []string{"file-4", "file-5"}},
+		{name: "oldest retained", seq: 2, ok: true, names: []string{"file-3", "file-4", "file-5"}},
+		{name: "too old", seq: 1, ok: false},
+		{name: "unknown", seq: 6, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, ok := j.Since(tt.seq)
+			require.Equal(t, tt.ok, ok)
+
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name)
+			}
+			require.Equal(t, tt.names, names)
+		})
+	}
+}
+
+func TestJournal_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := Open(path, 2)
+	require.NoError(t, err)
+	id := j.Id()
+
+	for i := 1; i <= 10; i++ {
+		_, err := j.Append(model.Event{Name: fmt.Sprintf("file-%d", i), Op: model.Remove})
+		require.NoError(t, err)
+	}
+	require.NoError(t, j.Close())
+
+	j, err = Open(path, 2)
+	require.NoError(t, err)
+	defer j.Close()
+
+	require.NotEqual(t, id, j.Id(), "changes made while closed are unknown, journal id changes")
+	require.Equal(t, uint64(10), j.Last(), "sequence is kept")
+
+	entries, ok := j.Since(8)
+	require.True(t, ok)
+	require.Len(t, entries, 2)
+	require.Equal(t, model.Event{Name: "file-10", Op: model.Remove}, entries[1].Event())
+
+	e, err := j.Append(model.Event{Name: "file-11", Op: model.Write})
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), e.Seq)
+}
+
+func TestJournal_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	require.NoError(t, os.WriteFile(path, []byte("{\"id\":\"x\"}\n{\"sq\":1}\n{\"sq\":3}\n"), 0600))
+
+	_, err := Open(path, 2)
+	require.ErrorIs(t, err, ErrJournalFormat)
+}
@@ -16,11 +16,18 @@ const (
 	Rename
 	Chmod
 	Exit
+	Move
+	Mkdir
+	Rmdir
 )
 
+// Event
+// OldName is set only on Move events, it is the name before rename.
+// directories are reported by Mkdir and Rmdir instead of Create and Remove.
 type Event struct {
-	Name string
-	Op   Op
+	Name    string
+	Op      Op
+	OldName string
 }
 
 func (op Op) String() string {
@@ -43,6 +50,15 @@ func (op Op) String() string {
 	if op.Has(Chmod) {
 		b.WriteString("|CHMOD")
 	}
+	if op.Has(Move) {
+		b.WriteString("|MOVE")
+	}
+	if op.Has(Mkdir) {
+		b.WriteString("|MKDIR")
+	}
+	if op.Has(Rmdir) {
+		b.WriteString("|RMDIR")
+	}
 	if b.Len() == 0 {
 		return "[no events]"
 	}
@@ -54,5 +70,8 @@ func (op Op) Has(h Op) bool { return op&h == h }
 func (e Event) Has(op Op) bool { return e.Op.Has(op) }
 
 func (e Event) String() string {
+	if e.Op.Has(Move) {
+		return fmt.Sprintf("event :: %-13s %q -> %q", e.Op.String(), e.OldName, e.Name)
+	}
 	return fmt.Sprintf("event :: %-13s %q", e.Op.String(), e.Name)
 }
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ChunkSize
+// amount of file content carried by a single chunk frame.
+const ChunkSize = 256 << 10
+
+const chunkHeaderSize = 8
+
+var ErrChunkPayload = errors.New("invalid chunk payload")
+
+// WriteChunk
+// write a chunk frame, payload is the file offset (uint64, big endian)
+// followed by the raw content.
+func (e *Encoder) WriteChunk(offset int64, data []byte) error {
+	payload := make([]byte, chunkHeaderSize+len(data))
+	binary.BigEndian.PutUint64(payload, uint64(offset))
+	copy(payload[chunkHeaderSize:], data)
+
+	return e.WriteFrame(FrameChunk, payload)
+}
+
+// Chunk
+// decode chunk frame into its offset and content.
+func (f Frame) Chunk() (int64, []byte, error) {
+	if f.Type != FrameChunk {
+		return 0, nil, errors.Join(ErrFrameType, fmt.Errorf("expect %d(chunk) but received %d", FrameChunk, f.Type))
+	}
+
+	if len(f.Payload) < chunkHeaderSize {
+		return 0, nil, errors.Join(ErrChunkPayload, fmt.Errorf("%d < %d", len(f.Payload), chunkHeaderSize))
+	}
+
+	offset := binary.BigEndian.Uint64(f.Payload[:chunkHeaderSize])
+	return int64(offset), f.Payload[chunkHeaderSize:], nil
+}
+
+// WriteCopy
+// write a copy frame, used in delta transfers to ask receiver to append given
+// range of its current copy. payload is offset and length (uint64, big endian).
+func (e *Encoder) WriteCopy(offset int64, length int64) error {
+	payload := make([]byte, 2*chunkHeaderSize)
+	binary.BigEndian.PutUint64(payload, uint64(offset))
+	binary.BigEndian.PutUint64(payload[chunkHeaderSize:], uint64(length))
+
+	return e.WriteFrame(FrameCopy, payload)
+}
+
+// Copy
+// decode copy frame into its offset and length.
+func (f Frame) Copy() (int64, int64, error) {
+	if f.Type != FrameCopy {
+		return 0, 0, errors.Join(ErrFrameType, fmt.Errorf("expect %d(copy) but received %d", FrameCopy, f.Type))
+	}
+
+	if len(f.Payload) != 2*chunkHeaderSize {
+		return 0, 0, errors.Join(ErrChunkPayload, fmt.Errorf("%d != %d", len(f.Payload), 2*chunkHeaderSize))
+	}
+
+	offset := binary.BigEndian.Uint64(f.Payload[:chunkHeaderSize])
+	length := binary.BigEndian.Uint64(f.Payload[chunkHeaderSize:])
+	return int64(offset), int64(length), nil
+}
@@ -0,0 +1,209 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+	Every packet on the wire is a single frame :
+
+	+---------+------+------------------+-------------------+
+	| version | type | length (uint32)  | payload           |
+	| 1 byte  | 1    | 4 bytes, big end | `length` bytes    |
+	+---------+------+------------------+-------------------+
+
+	the payload is never scanned for delimiters, so file names and file content
+	can carry any byte.
+*/
+
+// Version
+// current version of the wire framing.
+const Version byte = 1
+
+const (
+	headerSize = 6
+
+	// MaxFrameSize
+	// upper bound for a single frame payload, bigger frames are rejected
+	// before any allocation happens.
+	MaxFrameSize = 16 << 20
+)
+
+type FrameType byte
+
+const (
+	// FrameData payload is a json encoded Data packet.
+	FrameData FrameType = iota + 1
+	// FrameChunk payload is a raw piece of file content, see WriteChunk.
+	FrameChunk
+	// FrameCopy payload is a range of receiver copy to reuse, see WriteCopy.
+	FrameCopy
+)
+
+var (
+	ErrFrameVersion    = errors.New("unsupported frame version")
+	ErrFrameType       = errors.New("unexpected frame type")
+	ErrFrameTooLarge   = errors.New("frame payload exceeds maximum size")
+	ErrFrameShortWrite = errors.New("inconsistent frame write: bytes written mismatch")
+	ErrFrameMarshal    = errors.New("failed to marshal frame payload")
+	ErrFrameUnmarshal  = errors.New("failed to unmarshal frame payload")
+)
+
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// Encoder
+// writes frames into the underlying writer, it is safe for concurrent use.
+type Encoder struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) WriteFrame(t FrameType, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return errors.Join(ErrFrameTooLarge, fmt.Errorf("%d > %d", len(payload), MaxFrameSize))
+	}
+
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = Version
+	buf[1] = byte(t)
+	binary.BigEndian.PutUint32(buf[2:headerSize], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n, err := e.w.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	if n != len(buf) {
+		return errors.Join(ErrFrameShortWrite, fmt.Errorf("%d != %d", n, len(buf)))
+	}
+
+	return nil
+}
+
+// Encode
+// marshal given packet and write it as a data frame.
+func (e *Encoder) Encode(d *Data) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return errors.Join(ErrFrameMarshal, err)
+	}
+
+	return e.WriteFrame(FrameData, b)
+}
+
+// Decoder
+// reads frames from the underlying reader. it never reads past the end of a
+// frame, and a read error in the middle of a frame (for example an expired
+// read deadline) keeps the partial frame, so the next call resumes it.
+type Decoder struct {
+	r   io.Reader
+	hdr [headerSize]byte
+	hn  int
+	buf []byte
+	bn  int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+func (d *Decoder) ReadFrame() (Frame, error) {
+	for d.hn < headerSize {
+		n, err := d.r.Read(d.hdr[d.hn:])
+		d.hn += n
+		if d.hn == headerSize {
+			break
+		}
+		if err != nil {
+			if err == io.EOF && d.hn > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return Frame{}, err
+		}
+	}
+
+	if d.hdr[0] != Version {
+		d.reset()
+		return Frame{}, errors.Join(ErrFrameVersion, fmt.Errorf("%d != %d", d.hdr[0], Version))
+	}
+
+	size := binary.BigEndian.Uint32(d.hdr[2:headerSize])
+	if size > MaxFrameSize {
+		d.reset()
+		return Frame{}, errors.Join(ErrFrameTooLarge, fmt.Errorf("%d > %d", size, MaxFrameSize))
+	}
+
+	if d.buf == nil {
+		d.buf = make([]byte, size)
+	}
+
+	for d.bn < len(d.buf) {
+		n, err := d.r.Read(d.buf[d.bn:])
+		d.bn += n
+		if d.bn == len(d.buf) {
+			break
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Frame{}, err
+		}
+	}
+
+	f := Frame{
+		Type:    FrameType(d.hdr[1]),
+		Payload: d.buf,
+	}
+	d.reset()
+
+	return f, nil
+}
+
+// Decode
+// read next frame and unmarshal it into given packet, the frame must be a
+// data frame.
+func (d *Decoder) Decode(v *Data) error {
+	f, err := d.ReadFrame()
+	if err != nil {
+		return err
+	}
+
+	return f.Decode(v)
+}
+
+// Decode
+// unmarshal data frame into given packet.
+func (f Frame) Decode(v *Data) error {
+	if f.Type != FrameData {
+		return errors.Join(ErrFrameType, fmt.Errorf("expect %d(data) but received %d", FrameData, f.Type))
+	}
+
+	if err := json.Unmarshal(f.Payload, v); err != nil {
+		return errors.Join(ErrFrameUnmarshal, err)
+	}
+
+	return nil
+}
+
+func (d *Decoder) reset() {
+	d.hn = 0
+	d.buf = nil
+	d.bn = 0
+}
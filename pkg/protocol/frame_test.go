@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame_EncodeDecode(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	dec := NewDecoder(buf)
+
+	payload, err := json.Marshal(FileMetaPayload{FileName: "foo@bar/b@z.txt"})
+	require.NoError(t, err)
+
+	in := Data{
+		Sec:     1,
+		Type:    ChangeNotify,
+		Heading: map[string]interface{}{"k": "v@w"},
+		Payload: payload,
+	}
+	require.NoError(t, enc.Encode(&in))
+	require.NoError(t, enc.Encode(&in))
+
+	for i := 0; i < 2; i++ {
+		out := Data{}
+		require.NoError(t, dec.Decode(&out))
+		require.Equal(t, in.Type, out.Type)
+		require.Equal(t, in.Payload, out.Payload)
+		require.Equal(t, "v@w", out.Heading["k"])
+	}
+
+	_, err = dec.ReadFrame()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// stutterReader returns a timeout like error every other read, and at most one
+// byte on successful reads.
+type stutterReader struct {
+	r    io.Reader
+	fail bool
+}
+
+var errStutter = errors.New("stutter")
+
+func (s *stutterReader) Read(p []byte) (int, error) {
+	s.fail = !s.fail
+	if s.fail {
+		return 0, errStutter
+	}
+	return s.r.Read(p[:1])
+}
+
+func TestFrame_ResumePartialRead(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, NewEncoder(buf).WriteFrame(FrameData, []byte("some @ payload")))
+
+	dec := NewDecoder(&stutterReader{r: buf})
+	for {
+		f, err := dec.ReadFrame()
+		if errors.Is(err, errStutter) {
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, FrameData, f.Type)
+		require.Equal(t, []byte("some @ payload"), f.Payload)
+		break
+	}
+}
+
+func TestFrame_Invalid(t *testing.T) {
+	t.Run("version", func(t *testing.T) {
+		b := []byte{Version + 1, byte(FrameData), 0, 0, 0, 0}
+		_, err := NewDecoder(bytes.NewReader(b)).ReadFrame()
+		require.ErrorIs(t, err, ErrFrameVersion)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		b := []byte{Version, byte(FrameData), 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[2:], MaxFrameSize+1)
+		_, err := NewDecoder(bytes.NewReader(b)).ReadFrame()
+		require.ErrorIs(t, err, ErrFrameTooLarge)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		b := []byte{Version, byte(FrameData), 0, 0, 0, 10, 'a'}
+		_, err := NewDecoder(bytes.NewReader(b)).ReadFrame()
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("type", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		require.NoError(t, NewEncoder(buf).WriteFrame(FrameData+10, nil))
+		err := NewDecoder(buf).Decode(&Data{})
+		require.ErrorIs(t, err, ErrFrameType)
+	})
+}
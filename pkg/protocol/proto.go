@@ -3,6 +3,7 @@ package protocol
 import (
 	"time"
 
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/delta"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
 )
 
@@ -16,15 +17,50 @@ const (
 	FilesList
 	Join
 	AckJoin
+	FileChecksum
+	Heartbeat
+	Error
+	PushFile
+	AckPush
+	ListSessions
+	SessionsList
+	KillSession
+	AckKillSession
+	AuthChallenge
+	AuthProof
 )
 
 /*
             A  con <----------------- Subscribe path  B
-	        A Change Notify ------------------------> B
+	        A Files List (pages) -------------------> B
+	        A Change Notify / Heartbeat ------------> B
 			A     <------------------- Request File   B
-			A   File -------------------------------> B
+			A   Response File (header) -------------> B
+			A   Chunk (offset, data) ---------------> B
+			A   Copy (delta transfer only) ---------> B
+			A   ...                                   B
+			A   File Checksum ----------------------> B
 
-	TODO :: Change protocol fix download entire file problem.
+	in sync mode client pushes its own changes over a dedicated connection :
+
+			A     <--------------------- Push File    B
+			A     <--------------- Chunk (write only) B
+			A     <------- File Checksum (write only) B
+			A   Ack Push ---------------------------> B
+
+	a password login is a SCRAM-SHA-256 exchange, password never crosses the wire :
+
+			A     <---------- Join (username, nonce)  B
+			A   Auth Challenge ---------------------> B
+			A     <-------------------- Auth Proof    B
+			A   Ack Join (server signature) --------> B
+
+	admin users manage sessions of other users :
+
+			A     <----------------- List Sessions    B
+			A   Sessions List ----------------------> B
+			A     <------------------ Kill Session    B
+			A   Ack Kill Session -------------------> B
 */
 
 // Data
@@ -37,38 +73,234 @@ type Data struct {
 	Payload []byte                 `json:"p"`
 }
 
+// FileMetaPayload
+// on model.Move notifications From is the old name of FileName, client
+// renames its copy instead of downloading it again. directories are sent with
+// model.Mkdir (notifications and listings) and model.Rmdir. Hash is the
+// content hash of the file, client skips the download when its copy matches.
+// Mode holds POSIX mode bits, HasMode tells it is set so mode 000 isn't taken
+// for none. on model.Chmod notifications only Mode, ChangeDate and Owner are
+// applied. Link is set for symbolic links copied as
+// links, client creates a link with that target instead of downloading.
 type FileMetaPayload struct {
-	Path       string    `json:"p"`
-	FileName   string    `json:"f"`
-	Op         model.Op  `json:"op"`
-	Size       int64     `json:"sz"`
-	ChangeDate time.Time `json:"cd"`
+	Path       string     `json:"p"`
+	FileName   string     `json:"f"`
+	Op         model.Op   `json:"op"`
+	Size       int64      `json:"sz"`
+	ChangeDate time.Time  `json:"cd"`
+	From       string     `json:"fr,omitempty"`
+	Hash       string     `json:"h,omitempty"`
+	Mode       uint32     `json:"m,omitempty"`
+	HasMode    bool       `json:"hm,omitempty"`
+	Owner      *FileOwner `json:"o,omitempty"`
+	Link       string     `json:"l,omitempty"`
+}
+
+// FileOwner
+// numeric user and group ids of a file owner.
+type FileOwner struct {
+	Uid int `json:"u"`
+	Gid int `json:"g"`
 }
 
+// RequestFilePayload
+// Signature is set when client has a copy of the file and asks for a delta
+// transfer, it is answered with chunk and copy frames instead of chunks only.
 type RequestFilePayload struct {
-	Path       string    `json:"p"`
-	FileName   string    `json:"f"`
-	ChangeDate time.Time `json:"cd"`
+	Share      string           `json:"sh,omitempty"`
+	Path       string           `json:"p"`
+	FileName   string           `json:"f"`
+	ChangeDate time.Time        `json:"cd"`
+	Signature  *delta.Signature `json:"sig,omitempty"`
 }
 
-type FileResponsePayload []byte
+// FileResponsePayload
+// header of a file transfer, followed by chunk frames carrying file content
+// and a FileChecksum packet. on failure Msg is set and nothing follows.
+type FileResponsePayload struct {
+	FileName   string     `json:"f"`
+	Size       int64      `json:"sz"`
+	ChangeDate time.Time  `json:"cd"`
+	Delta      bool       `json:"d"`
+	Ok         bool       `json:"ok"`
+	Msg        string     `json:"msg"`
+	Mode       uint32     `json:"m,omitempty"`
+	HasMode    bool       `json:"hm,omitempty"`
+	Owner      *FileOwner `json:"o,omitempty"`
+}
+
+// FileChecksumPayload
+// trailer of a file transfer, Sum is hex encoded sha256 of the whole content.
+type FileChecksumPayload struct {
+	Size int64  `json:"sz"`
+	Sum  string `json:"sum"`
+}
 
+// SubscribePathPayload
+// From and Journal are the last change sequence number the client applied and
+// the journal it belongs to, server replays later changes instead of sending
+// its listing when it still has them.
+// Share is the name of requested share, empty for server default one.
+// Path and Paths are sub paths or glob patterns under server root the client
+// subscribes to, only their changes and listing are sent. none means the
+// whole root.
 type SubscribePathPayload struct {
-	Path string `json:"p"`
-	Id   string `json:"id"`
+	Share   string   `json:"sh,omitempty"`
+	Path    string   `json:"p"`
+	Paths   []string `json:"ps,omitempty"`
+	Id      string   `json:"id"`
+	Journal string   `json:"j"`
+	From    uint64   `json:"fr"`
 }
 
+// PathFiles
+// a page of the server listing sent in FilesList packets right after
+// subscription, Last is set on the final page. Sec of the packet is the
+// sequence number the listing is up to date with.
+// when subscription is resumed a single page with Resume set and no files
+// is sent, followed by the missed change notifications.
 type PathFiles struct {
-	Path  string            `json:"p"`
-	Files []FileMetaPayload `json:"fi"`
+	Path    string            `json:"p"`
+	Files   []FileMetaPayload `json:"fi"`
+	Last    bool              `json:"l"`
+	Journal string            `json:"j"`
+	Resume  bool              `json:"r"`
+}
+
+// PushFilePayload
+// a local change pushed by a client in sync mode. model.Write is followed by
+// chunk frames and a FileChecksum packet, other ops carry no content. Base is
+// the hash of the server version the change was made on, empty when client
+// doesn't know it, server detects conflicts with it. Hash is the hash of the
+// pushed content, From is the old name of a model.Move and Host names the
+// client in conflict copies.
+type PushFilePayload struct {
+	Share      string    `json:"sh,omitempty"`
+	FileName   string    `json:"f"`
+	Op         model.Op  `json:"op"`
+	Size       int64     `json:"sz"`
+	ChangeDate time.Time `json:"cd"`
+	Mode       uint32    `json:"m,omitempty"`
+	HasMode    bool      `json:"hm,omitempty"`
+	Hash       string    `json:"h,omitempty"`
+	Base       string    `json:"b,omitempty"`
+	From       string    `json:"fr,omitempty"`
+	Host       string    `json:"ho,omitempty"`
+}
+
+// AckPushPayload
+// result of a push. Conflict is set when server version changed since Base,
+// Name is then where the pushed content was stored, empty when it was
+// discarded in favor of server version.
+type AckPushPayload struct {
+	Ok       bool   `json:"ok"`
+	Msg      string `json:"msg"`
+	Conflict bool   `json:"c,omitempty"`
+	Name     string `json:"n,omitempty"`
 }
 
+// ErrorCode
+// reason of a request rejected by server.
+type ErrorCode string
+
+const (
+	// CodeInvalidPath requested path is not a valid name under server root.
+	CodeInvalidPath ErrorCode = "invalid-path"
+	// CodeUnknownShare requested share is not served.
+	CodeUnknownShare ErrorCode = "unknown-share"
+	// CodePermissionDenied user is not allowed to access what was requested.
+	CodePermissionDenied ErrorCode = "permission-denied"
+	// CodeInvalidPayload request payload can't be parsed.
+	CodeInvalidPayload ErrorCode = "invalid-payload"
+)
+
+// ErrorPayload
+// sent instead of the expected answer when server rejects a request, server
+// closes the connection after a rejected subscription.
+type ErrorPayload struct {
+	Code ErrorCode `json:"c"`
+	Msg  string    `json:"msg"`
+}
+
+// JoinPayload
+// Session is the id of an open session of the same user, transfer connections
+// of a client join its session instead of opening new ones. Token replaces
+// username and password, it joins the session it was issued for. Nonce starts
+// a SCRAM login instead of sending Password, server answers AuthChallenge.
+// Previous is the session of the last subscription of a reconnecting client,
+// login is refused when that session was killed. Admin connections only list
+// or kill sessions, they open no session so they don't count against the
+// sessions limit.
 type JoinPayload struct {
 	Username string `json:"u"`
 	Password string `json:"p"`
+	Session  string `json:"s,omitempty"`
+	Token    string `json:"tk,omitempty"`
+	Nonce    string `json:"n,omitempty"`
+	Previous string `json:"pv,omitempty"`
+	Admin    bool   `json:"ad,omitempty"`
 }
 
+// AckJoinPayload
+// Session is the id of the session connection belongs to, empty when server
+// doesn't authenticate. Token is issued on password login, it is valid until
+// Expires or until server revokes it. Signature of a SCRAM login proves that
+// server knows the password verifier. Busy marks a login refused because user
+// has too many sessions, client may retry later.
 type AckJoinPayload struct {
+	Ok        bool      `json:"ok"`
+	Msg       string    `json:"msg"`
+	Session   string    `json:"s,omitempty"`
+	Token     string    `json:"tk,omitempty"`
+	Expires   time.Time `json:"exp,omitempty"`
+	Signature []byte    `json:"v,omitempty"`
+	Busy      bool      `json:"b,omitempty"`
+}
+
+// AuthChallengePayload
+// server answer to a SCRAM login, Nonce is client nonce followed by server
+// one. Legacy users have a password hash from before SCRAM, client sends its
+// password once in AuthProofPayload and server stores a verifier instead.
+type AuthChallengePayload struct {
+	Nonce      string `json:"r"`
+	Salt       []byte `json:"s"`
+	Iterations int    `json:"i"`
+	Legacy     bool   `json:"l,omitempty"`
+}
+
+// AuthProofPayload
+// client answer to AuthChallenge, Proof shows knowledge of the password.
+type AuthProofPayload struct {
+	Nonce    string `json:"r"`
+	Proof    []byte `json:"p,omitempty"`
+	Password string `json:"pw,omitempty"`
+}
+
+// SessionPayload
+// an open session, Conns is the number of its connections.
+type SessionPayload struct {
+	Id       string    `json:"id"`
+	Username string    `json:"u"`
+	Addr     string    `json:"a"`
+	Started  time.Time `json:"st"`
+	Conns    int       `json:"c"`
+}
+
+// SessionsListPayload
+// answer of ListSessions, oldest session first.
+type SessionsListPayload struct {
+	Sessions []SessionPayload `json:"ss"`
+}
+
+// KillSessionPayload
+// session to end, its connections are closed.
+type KillSessionPayload struct {
+	Id string `json:"id"`
+}
+
+// AckKillSessionPayload
+// result of KillSession, Msg is set on failure.
+type AckKillSessionPayload struct {
 	Ok  bool   `json:"ok"`
 	Msg string `json:"msg"`
 }
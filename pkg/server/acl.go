@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+)
+
+var (
+	ErrServerPermissionDenied = errors.New("permission denied")
+)
+
+// permission
+// what an authenticated user may access, nil scope is the whole root.
+type permission struct {
+	scope *filter.Scope
+	write bool
+	admin bool
+}
+
+// permission
+// look up acl of given user, server without user manager grants everything.
+func (s *Server) permission(username string) (permission, error) {
+	if s.um == nil {
+		return permission{write: true, admin: true}, nil
+	}
+
+	acl, ok := s.um.ACL(username)
+	if !ok {
+		return permission{}, errors.Join(ErrServerPermissionDenied, fmt.Errorf("user %q has no access", username))
+	}
+	if acl.Admin {
+		return permission{write: true, admin: true}, nil
+	}
+
+	clean := make([]string, 0, len(acl.Paths))
+	for _, p := range acl.Paths {
+		c, err := filehandler.CleanName(p)
+		if err != nil {
+			return permission{}, errors.Join(ErrServerPermissionDenied, fmt.Errorf("user %q, acl path %q, %v", username, p, err))
+		}
+		clean = append(clean, c)
+	}
+
+	sc, err := filter.NewScope(clean...)
+	if err != nil {
+		return permission{}, errors.Join(ErrServerPermissionDenied, fmt.Errorf("user %q, %v", username, err))
+	}
+	return permission{scope: sc, write: acl.Write}, nil
+}
+
+// readable
+// check whether user may read given name.
+func (p permission) readable(name string, dir bool) bool {
+	return p.scope.Contains(name, dir)
+}
+
+// writable
+// check whether user may push changes of given name.
+func (p permission) writable(name string, dir bool) bool {
+	return p.write && p.scope.Contains(name, dir)
+}
+
+// readable
+// check whether user may read given name of share, a name reached through a
+// followed link is only readable when its target is too.
+func (sh *Share) readable(p permission, name string, dir bool) bool {
+	return p.readable(name, dir) && sh.followed(p, name, dir)
+}
+
+// writable
+// check whether user may push changes of given name of share, a name reached
+// through a followed link is only writable when its target is too.
+func (sh *Share) writable(p permission, name string, dir bool) bool {
+	return p.writable(name, dir) && sh.followed(p, name, dir)
+}
+
+// followed
+// check whether name, once links followed by the handler are resolved, is
+// still in acl scope. a link in scope must not reveal a target out of it.
+func (sh *Share) followed(p permission, name string, dir bool) bool {
+	if p.scope == nil || sh.f.Symlinks() != filehandler.SymlinkFollowWithinRoot {
+		return true
+	}
+	target, ok := sh.f.Target(name)
+	return ok && p.scope.Contains(target, dir)
+}
+
+// subscribable
+// check whether every subscribed path is readable, patterns are only
+// narrowed by the acl.
+func (p permission) subscribable(paths []string) error {
+	for _, name := range paths {
+		c, err := filehandler.CleanName(name)
+		if err != nil || strings.ContainsAny(c, "*?[\\") {
+			continue
+		}
+		if !p.readable(c, true) && !p.readable(c, false) {
+			return errors.Join(ErrServerPermissionDenied, fmt.Errorf("path %q", name))
+		}
+	}
+	return nil
+}
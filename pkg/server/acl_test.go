@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Permission(t *testing.T) {
+	dir := t.TempDir()
+	aclFile := filepath.Join(dir, "acl")
+	require.NoError(t, os.WriteFile(aclFile, []byte("admin:admin:\nbob:ro:team-a,docs/**/*.md\n"), 0600))
+
+	um := &user.UserManager{PwFile: filepath.Join(dir, "pw"), AclFile: aclFile}
+	require.NoError(t, um.Init())
+	s := &Server{um: um}
+
+	p, err := s.permission("admin")
+	require.NoError(t, err)
+	require.True(t, p.readable("any/file", false))
+	require.True(t, p.writable("any/file", false))
+
+	p, err = s.permission("bob")
+	require.NoError(t, err)
+	require.True(t, p.readable("team-a/x.go", false))
+	require.True(t, p.readable("docs/a/b.md", false))
+	require.False(t, p.readable("team-b/x.go", false))
+	require.False(t, p.writable("team-a/x.go", false), "read only user")
+
+	require.NoError(t, p.subscribable([]string{"team-a/src", "docs/**/*.pdf"}))
+	require.ErrorIs(t, p.subscribable([]string{"team-b"}), ErrServerPermissionDenied)
+
+	_, err = s.permission("eve")
+	require.ErrorIs(t, err, ErrServerPermissionDenied)
+
+	p, err = (&Server{}).permission("")
+	require.NoError(t, err)
+	require.True(t, p.writable("any/file", false), "server without users")
+}
+
+func TestShare_FollowedLinkPermission(t *testing.T) {
+	path := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(path, "public"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(path, "secret"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "public", "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "secret", "x.txt"), []byte("x"), 0644))
+	require.NoError(t, os.Symlink("../secret/x.txt", filepath.Join(path, "public", "link")))
+	require.NoError(t, os.Symlink("../secret", filepath.Join(path, "public", "dir")))
+
+	lg := log.New(io.Discard, "", 0)
+	h, err := filehandler.NewHandler(path, lg, filehandler.WithSymlinks(filehandler.SymlinkFollowWithinRoot))
+	require.NoError(t, err)
+	j, err := journal.Open("", 0)
+	require.NoError(t, err)
+	sh := NewShare("", "", h, WithShareJournal(j))
+	sc, err := filter.NewScope("public")
+	require.NoError(t, err)
+	p := permission{scope: sc}
+
+	require.True(t, sh.readable(p, "public/a.txt", false))
+	require.True(t, sh.readable(p, "public/removed.txt", false), "removal of a file in scope")
+	// links in scope don't reveal targets out of it.
+	require.False(t, sh.readable(p, "public/link", false))
+	require.False(t, sh.readable(p, "public/dir/x.txt", false))
+	require.True(t, sh.readable(permission{}, "public/link", false), "user without acl")
+
+	var buf bytes.Buffer
+	_, err = sh.sendListing(protocol.NewEncoder(&buf), sc, p)
+	require.NoError(t, err)
+	page := protocol.PathFiles{}
+	d := protocol.Data{}
+	require.NoError(t, protocol.NewDecoder(&buf).Decode(&d))
+	require.NoError(t, json.Unmarshal(d.Payload, &page))
+	names := make([]string, 0, len(page.Files))
+	for _, f := range page.Files {
+		names = append(names, f.FileName)
+	}
+	require.ElementsMatch(t, []string{"public", "public/a.txt"}, names)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"slices"
+)
+
+var ErrServerClientCA = errors.New("invalid client CA bundle")
+
+// certUser
+// user a verified client certificate of connection maps to. requested
+// username is used when certificate common name or subject alternative names
+// carry it, otherwise first of those names which is an active user.
+func (s *Server) certUser(conn net.Conn, requested string) (string, bool) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok || s.um == nil {
+		return "", false
+	}
+
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	names := certNames(state.VerifiedChains[0][0])
+	if requested != "" {
+		return requested, slices.Contains(names, requested) && s.um.Active(requested)
+	}
+
+	for _, name := range names {
+		if s.um.Active(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// certNames
+// common name followed by DNS and email subject alternative names.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	return append(names, cert.EmailAddresses...)
+}
@@ -1,18 +1,28 @@
 package server
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/delta"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
 )
 
+const listingPageSize = 1000
+
 var (
 	ErrServerReadPacket            = errors.New("failed to read packet from connection")
 	ErrServerUnmarshalPacket       = errors.New("failed to unmarshal packet data")
@@ -21,23 +31,36 @@ var (
 	ErrServerAuthenticationFailed  = errors.New("authentication failed")
 	ErrServerInvalidPacketType     = errors.New("invalid packet type received")
 	ErrServerMarshalResponsePacket = errors.New("failed to marshal response packet data")
+	ErrServerSubscriptionPath      = errors.New("invalid subscription path")
+
+	errJournalGap  = errors.New("journal doesn't retain requested events")
+	errScopeResync = errors.New("directory moved into subscribed scope")
 )
 
-func (s *Server) joinHandler(conn net.Conn) (string, error) {
-	r := bufio.NewReader(conn)
-	var data []byte
-	data, err := r.ReadBytes('@')
-	if err != nil {
-		return "", errors.Join(ErrServerReadPacket, err)
+// joinHandler
+// authenticate a new connection, it opens a session or joins the one given
+// by client. a password or client certificate login is answered with a
+// token, later connections of the session present it instead. passwords are
+// checked with a SCRAM exchange, see login. returns username and
+// session id, both empty when server doesn't authenticate. an admin
+// connection has no session.
+func (s *Server) joinHandler(conn net.Conn, enc *protocol.Encoder, dec *protocol.Decoder) (string, string, bool, error) {
+	// join and SCRAM proof are read within join timeout, later requests
+	// have no deadline.
+	if err := conn.SetReadDeadline(time.Now().Add(s.join)); err != nil {
+		return "", "", false, errors.Join(ErrServerReadPacket, err)
 	}
+	defer conn.SetReadDeadline(time.Time{})
+
 	req := protocol.Data{}
-	err = json.Unmarshal(data[:len(data)-1], &req)
+	err := dec.Decode(&req)
 	if err != nil {
-		return "", errors.Join(ErrServerUnmarshalPacket, err)
+		return "", "", false, errors.Join(ErrServerReadPacket, err)
 	}
 
 	var username string
-	var connIP string
+	var session user.Session
+	var admin bool
 	ackJoinPayload := &protocol.AckJoinPayload{Ok: false}
 
 	if s.um == nil {
@@ -48,16 +71,52 @@ func (s *Server) joinHandler(conn net.Conn) (string, error) {
 		if err != nil {
 			ackJoinPayload.Ok = false
 			ackJoinPayload.Msg = fmt.Sprintf("invalid payload. %v", err)
-		} else if s.um.CheckUserPassword(joinPayload.Username, joinPayload.Password) {
-			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		} else if joinPayload.Token != "" {
+			// token was issued on password login, no password check.
+			name, id, err := s.um.CheckToken(joinPayload.Token)
+			if err == nil {
+				session, err = s.um.JoinSession(id, name, conn)
+			}
+
+			if err != nil {
+				ackJoinPayload.Ok = false
+				ackJoinPayload.Msg = err.Error()
+			} else {
+				ackJoinPayload.Ok = true
+				ackJoinPayload.Session = session.Id
+				username = name
+			}
+		} else if name, signature, err := s.login(conn, enc, dec, joinPayload); err != nil {
+			return "", "", false, err
+		} else if name != "" {
+			switch {
+			case joinPayload.Previous != "" && s.um.Killed(joinPayload.Previous):
+				// an admin killed the session, its client doesn't come back.
+				err = errors.Join(user.ErrSessionKilled, fmt.Errorf("session %q", joinPayload.Previous))
+			case joinPayload.Admin:
+				admin = true
+			case joinPayload.Session != "":
+				session, err = s.um.JoinSession(joinPayload.Session, name, conn)
+			default:
+				session, err = s.um.OpenSession(name, conn.RemoteAddr().String(), joinPayload.Previous, conn)
+			}
+
+			if err == nil && !admin {
+				ackJoinPayload.Token, ackJoinPayload.Expires, err = s.um.IssueToken(name, session.Id)
+				if err != nil {
+					s.um.LeaveSession(session.Id, conn)
+				}
+			}
 
-			if s.um.CheckUserIP(joinPayload.Username, host) {
+			if err != nil {
 				ackJoinPayload.Ok = false
-				ackJoinPayload.Msg = "another system has logged in. if something is wrong call the server admin."
+				ackJoinPayload.Msg = err.Error()
+				ackJoinPayload.Busy = errors.Is(err, user.ErrTooManySessions)
 			} else {
 				ackJoinPayload.Ok = true
-				username = joinPayload.Username
-				connIP = host
+				ackJoinPayload.Session = session.Id
+				ackJoinPayload.Signature = signature
+				username = name
 			}
 		} else {
 			ackJoinPayload.Ok = false
@@ -75,62 +134,131 @@ func (s *Server) joinHandler(conn net.Conn) (string, error) {
 		Heading: nil,
 		Payload: ackJoinBytes,
 	}
-	resDataByte, _ := json.Marshal(resData)
-	resDataByte = append(resDataByte, '@')
 
-	n, err := conn.Write(resDataByte)
+	err = enc.Encode(resData)
 	if err != nil {
-		return "", errors.Join(ErrServerWritePacket, err)
+		if session.Id != "" {
+			s.um.LeaveSession(session.Id, conn)
+		}
+		return "", "", false, errors.Join(ErrServerWritePacket, err)
 	}
 
-	if n != len(resDataByte) {
-		subErr := fmt.Errorf("%d != %d", n, len(resDataByte))
-		return "", errors.Join(ErrServerInconsistentWrite, subErr)
+	if ackJoinPayload.Ok {
+		return username, session.Id, admin, nil
 	}
 
-	if s.um != nil && username != "" && connIP != "" {
-		s.um.SetAuthenticatedUser(username, connIP)
-		return username, nil
+	subErr := fmt.Errorf("address: %q, %s", conn.RemoteAddr(), ackJoinPayload.Msg)
+	return "", "", false, errors.Join(ErrServerAuthenticationFailed, subErr)
+}
+
+// login
+// user of a connection logging in without token, empty when login fails. a
+// verified client certificate mapped to a user needs no password, a SCRAM
+// login exchanges challenge and proof over the connection and returns server
+// signature.
+func (s *Server) login(conn net.Conn, enc *protocol.Encoder, dec *protocol.Decoder, p *protocol.JoinPayload) (string, []byte, error) {
+	if name, ok := s.certUser(conn, p.Username); ok {
+		return name, nil, nil
 	}
 
-	if ackJoinPayload.Ok {
-		return "", nil
+	// a password sent over tls isn't seen by observers of the connection,
+	// plaintext connections only take one when server is configured to.
+	_, secure := conn.(*tls.Conn)
+	if p.Nonce == "" {
+		// client from before SCRAM, password is sent in clear.
+		if (secure || s.um.Cleartext) && s.um.CheckUserPassword(p.Username, p.Password) {
+			return p.Username, nil, nil
+		}
+		return "", nil, nil
+	}
+
+	l, err := s.um.StartScram(p.Username, p.Nonce, secure)
+	if err != nil {
+		return "", nil, err
+	}
+
+	challenge, _ := json.Marshal(protocol.AuthChallengePayload{
+		Nonce:      l.Nonce,
+		Salt:       l.Salt,
+		Iterations: l.Iterations,
+		Legacy:     l.Legacy,
+	})
+	err = enc.Encode(&protocol.Data{
+		Sec:     0,
+		Time:    time.Now(),
+		Type:    protocol.AuthChallenge,
+		Heading: nil,
+		Payload: challenge,
+	})
+	if err != nil {
+		return "", nil, errors.Join(ErrServerWritePacket, err)
+	}
+
+	req := protocol.Data{}
+	if err := dec.Decode(&req); err != nil {
+		return "", nil, errors.Join(ErrServerReadPacket, err)
+	}
+	if req.Type != protocol.AuthProof {
+		subErr := fmt.Errorf("expect %d(auth proof) but received %d", protocol.AuthProof, req.Type)
+		return "", nil, errors.Join(ErrServerInvalidPacketType, subErr)
 	}
 
-	subErr := fmt.Errorf("username: %q, ip: %q", username, connIP)
-	return "", errors.Join(ErrServerAuthenticationFailed, subErr)
+	proof := protocol.AuthProofPayload{}
+	if err := json.Unmarshal(req.Payload, &proof); err != nil {
+		return "", nil, errors.Join(ErrServerUnmarshalPacket, err)
+	}
+
+	if l.Legacy {
+		// password is checked against bcrypt hash once, a verifier replaces it.
+		if proof.Nonce == l.Nonce && s.um.CheckUserPassword(p.Username, proof.Password) {
+			return p.Username, nil, nil
+		}
+		return "", nil, nil
+	}
+
+	if signature, ok := s.um.FinishScram(l, proof.Nonce, proof.Proof); ok {
+		return p.Username, signature, nil
+	}
+	return "", nil, nil
 }
 
-func (s *Server) handleAuthenticatedConnection(conn net.Conn, username string) {
+func (s *Server) handleAuthenticatedConnection(conn net.Conn, enc *protocol.Encoder, dec *protocol.Decoder, username string, session string) {
 	defer func() {
 		conn.Close()
 
-		if s.um != nil {
-			s.um.UnsetAuthenticatedUser(username)
+		if s.um != nil && session != "" {
+			s.um.LeaveSession(session, conn)
 		}
 	}()
 
-	r := bufio.NewReader(conn)
-
 	for {
-		data, err := r.ReadBytes('@')
-		if err != nil {
-			s.logger.Printf("server error :: %v\n", errors.Join(ErrServerReadPacket, err))
-			continue
-		}
-
 		req := protocol.Data{}
-		err = json.Unmarshal(data[:len(data)-1], &req)
+		err := dec.Decode(&req)
 		if err != nil {
-			s.logger.Printf("server error :: %v\n", errors.Join(ErrServerUnmarshalPacket, err))
-			continue
+			// framing is lost after a failed read, so the connection can't be reused.
+			if !errors.Is(err, io.EOF) {
+				s.logger.Printf("server error :: %v\n", errors.Join(ErrServerReadPacket, err))
+			}
+			return
 		}
 
 		switch req.Type {
 		case protocol.SubscribePath:
-			s.handleSubscription(conn)
+			s.handleSubscription(conn, enc, &req, username)
+			return
 		case protocol.RequestFile:
-			if err := s.handleFileRequest(conn, &req); err != nil {
+			// a failed transfer is cut short, closing the connection tells the
+			// client right away instead of after its read deadline.
+			if err := s.handleFileRequest(enc, &req, username); err != nil {
+				s.logger.Println(err)
+				return
+			}
+		case protocol.PushFile:
+			if err := s.handlePush(conn, enc, dec, &req, username); err != nil {
+				s.logger.Println(err)
+			}
+		case protocol.ListSessions, protocol.KillSession:
+			if err := s.handleSessions(enc, &req, username); err != nil {
 				s.logger.Println(err)
 			}
 		default:
@@ -140,93 +268,551 @@ func (s *Server) handleAuthenticatedConnection(conn net.Conn, username string) {
 	}
 }
 
-func (s *Server) handleSubscription(conn net.Conn) {
+func (s *Server) handleSubscription(conn net.Conn, enc *protocol.Encoder, req *protocol.Data, username string) {
+	reqPayload := protocol.SubscribePathPayload{}
+	if len(req.Payload) > 0 {
+		if err := json.Unmarshal(req.Payload, &reqPayload); err != nil {
+			// a subscription of unknown scope is never widened to the whole share.
+			err = errors.Join(ErrServerUnmarshalPacket, err)
+			s.logger.Printf("server error :: subscription from %s, %v\n", conn.RemoteAddr(), err)
+			_ = s.sendError(enc, protocol.CodeInvalidPayload, err.Error())
+			return
+		}
+	}
+
+	sh, err := s.share(reqPayload.Share, username)
+	if err != nil {
+		s.logger.Printf("server error :: subscription from %s, %v\n", conn.RemoteAddr(), err)
+		_ = s.sendError(enc, shareErrorCode(err), err.Error())
+		return
+	}
+
+	sc, err := subscriptionScope(reqPayload)
+	if err != nil {
+		s.logger.Printf("server error :: subscription from %s, %v\n", conn.RemoteAddr(), err)
+		_ = s.sendError(enc, protocol.CodeInvalidPath, err.Error())
+		return
+	}
+
+	perm, err := s.permission(username)
+	if err == nil {
+		err = perm.subscribable(subscribedPaths(reqPayload))
+	}
+	if err != nil {
+		s.logger.Printf("server error :: subscription from %s, %v\n", conn.RemoteAddr(), err)
+		_ = s.sendError(enc, protocol.CodePermissionDenied, err.Error())
+		return
+	}
+	// only names user may read are listed and sent.
+	sc = sc.Intersect(perm.scope)
+
+	sub := sh.subs.subscribe()
+	defer sh.subs.unsubscribe(sub)
+
+	s.logger.Printf("server :: new subscriber %d of share %q from %s, %d subscribers\n", sub.id, sh.name, conn.RemoteAddr(), sh.subs.len())
+	if sc != nil {
+		s.logger.Printf("server :: subscriber %d subscribed to %q\n", sub.id, subscribedPaths(reqPayload))
+	}
+
+	// subscriber is registered before journal is read, so no event is missed,
+	// events which are both replayed (or in listing) and queued are skipped by
+	// their sequence number.
+	var sent uint64
+	if reqPayload.Journal == sh.j.Id() && reqPayload.From > 0 {
+		sent, err = sh.sendReplay(enc, reqPayload.From, sc, perm)
+		if errors.Is(err, errJournalGap) || errors.Is(err, errScopeResync) {
+			s.logger.Printf("server warn :: subscriber %d can't resume from %d, send full listing\n", sub.id, reqPayload.From)
+			sent, err = sh.sendListing(enc, sc, perm)
+		}
+	} else {
+		sent, err = sh.sendListing(enc, sc, perm)
+	}
+	if err != nil {
+		s.logger.Printf("server error :: %v\n", errors.Join(ErrServerWritePacket, err))
+		conn.Close()
+		return
+	}
+
+	// client sends nothing once subscribed, its read ends when it goes away
+	// and the session is left without waiting for a failed write.
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
 	for {
 		select {
-		case e := <-s.e:
+		case <-gone:
+			s.logger.Printf("server :: subscriber %d disconnected\n", sub.id)
+			conn.Close()
+			return
+		case <-heartbeat.C:
+			err := enc.Encode(&protocol.Data{
+				Sec:  0,
+				Time: time.Now(),
+				Type: protocol.Heartbeat,
+			})
+			if err != nil {
+				s.logger.Printf("server error :: subscriber %d, %v\n", sub.id, errors.Join(ErrServerWritePacket, err))
+				conn.Close()
+				return
+			}
+		case c := <-sub.events:
 			{
-				if strings.HasPrefix(e.Name, "exit") ||
-					e.Op.Has(model.Create) {
-					continue
+				resync := false
+				if c.Seq > sent {
+					e, ok, moved := sh.scoped(sc, perm, c.Entry)
+					if ok {
+						meta := c.meta
+						if e != c.Entry {
+							meta = sh.changeMeta(e)
+						}
+						if err := sh.sendChange(enc, e, meta); err != nil {
+							s.logger.Printf("server error :: subscriber %d, %v\n", sub.id, errors.Join(ErrServerWritePacket, err))
+							conn.Close()
+							return
+						}
+					}
+					resync = moved
+					sent = e.Seq
 				}
 
-				e.Name = strings.TrimPrefix(e.Name, s.path)
-				fMeta := s.f.GetMeta(e.Name)
-				if fMeta == nil {
-					s.logger.Printf("server error :: nil meta data !! for event %v\n", e)
-					continue
-				}
+				if sub.resync.Swap(false) || resync {
+					// events were dropped while subscriber was behind, queued
+					// events are covered by the listing.
+					s.logger.Printf("server warn :: subscriber %d is behind, resync with full listing\n", sub.id)
+					for len(sub.events) > 0 {
+						<-sub.events
+					}
 
-				resPaylod, _ := json.Marshal(protocol.FileMetaPayload{
-					Path:       s.path,
-					FileName:   e.Name,
-					Op:         e.Op,
-					Size:       fMeta.Size,
-					ChangeDate: fMeta.ModifyTime,
-				})
-				resData := protocol.Data{
-					Sec:     0,
-					Time:    time.Now(),
-					Type:    protocol.ChangeNotify,
-					Heading: nil,
-					Payload: resPaylod,
+					sent, err = sh.sendListing(enc, sc, perm)
+					if err != nil {
+						s.logger.Printf("server error :: subscriber %d, %v\n", sub.id, errors.Join(ErrServerWritePacket, err))
+						conn.Close()
+						return
+					}
 				}
+			}
+		case <-sub.kick:
+			s.logger.Printf("server warn :: subscriber %d is too slow, disconnect\n", sub.id)
+			conn.Close()
+			return
+		case <-s.exit:
+			conn.Close()
+			return
+		}
+	}
+}
 
-				dataByte, cerr := json.Marshal(resData)
-				if cerr != nil {
-					s.logger.Printf("server error :: %v\n", errors.Join(ErrServerMarshalResponsePacket, cerr))
-					continue
-				}
+// changeMeta
+// meta data sent with a change notification.
+func (sh *Share) changeMeta(e journal.Entry) *filehandler.Meta {
+	name := strings.TrimPrefix(e.Name, sh.path)
+	if freshMeta(e.Op) {
+		// handler hook may not have seen the change yet, clients rely on
+		// the hash and attributes so they must be current.
+		m, _ := sh.f.Stat(name)
+		return m
+	}
+	return sh.f.GetMeta(name)
+}
 
-				dataByte = append(dataByte, '@')
+func freshMeta(op model.Op) bool {
+	return op.Has(model.Write) || op.Has(model.Chmod) || op.Has(model.Mkdir)
+}
 
-				n, werr := conn.Write(dataByte)
-				if werr != nil {
-					s.logger.Printf("server error :: %v\n", errors.Join(ErrServerWritePacket, werr))
-					continue
-				}
+// sendChange
+// send change notification of given journal entry with meta data from
+// changeMeta.
+func (sh *Share) sendChange(enc *protocol.Encoder, e journal.Entry, fMeta *filehandler.Meta) error {
+	name := strings.TrimPrefix(e.Name, sh.path)
+	if fMeta == nil && freshMeta(e.Op) {
+		sh.logger.Printf("server error :: nil meta data !! for event %v\n", e.Event())
+		return nil
+	}
+	if fMeta != nil && fMeta.Dir && e.Op.Has(model.Write) {
+		return nil // content of directories is sent entry by entry.
+	}
+
+	fileMeta := protocol.FileMetaPayload{
+		Path:     sh.path,
+		FileName: name,
+		Op:       e.Op,
+	}
+	if e.Op.Has(model.Move) {
+		fileMeta.From = strings.TrimPrefix(e.OldName, sh.path)
+	}
+	if fMeta != nil {
+		fileMeta.Size = fMeta.Size
+		fileMeta.ChangeDate = fMeta.ModifyTime
+		fileMeta.Hash = fMeta.Hash
+		fileMeta.Mode, fileMeta.HasMode = filehandler.PosixMode(fMeta.Mode), true
+		fileMeta.Owner = fileOwner(fMeta.Owner)
+		fileMeta.Link = fMeta.Link
+	}
+
+	resPaylod, _ := json.Marshal(fileMeta)
+	return enc.Encode(&protocol.Data{
+		Sec:     e.Seq,
+		Time:    time.Now(),
+		Type:    protocol.ChangeNotify,
+		Heading: nil,
+		Payload: resPaylod,
+	})
+}
+
+// subscriptionScope
+// scope of subscribed paths, they must stay inside served root.
+func subscriptionScope(p protocol.SubscribePathPayload) (*filter.Scope, error) {
+	paths := subscribedPaths(p)
+	clean := make([]string, 0, len(paths))
+	for _, name := range paths {
+		c, err := filehandler.CleanName(name)
+		if err != nil {
+			return nil, errors.Join(ErrServerSubscriptionPath, err)
+		}
+		clean = append(clean, c)
+	}
+
+	sc, err := filter.NewScope(clean...)
+	if err != nil {
+		return nil, errors.Join(ErrServerSubscriptionPath, err)
+	}
+	return sc, nil
+}
+
+func subscribedPaths(p protocol.SubscribePathPayload) []string {
+	if p.Path == "" {
+		return p.Paths
+	}
+	return append([]string{p.Path}, p.Paths...)
+}
+
+// scoped
+// translate a change for a subscriber of given scope and permission. ok is
+// false when the change is out of scope. a move across scope boundary is sent as removal or
+// write, resync is set when a directory is moved into scope, its content is
+// only known from the listing.
+func (sh *Share) scoped(sc *filter.Scope, perm permission, e journal.Entry) (out journal.Entry, ok bool, resync bool) {
+	if sc == nil {
+		return e, true, false
+	}
+
+	name := strings.TrimPrefix(e.Name, sh.path)
+	dir := e.Op.Has(model.Mkdir) || e.Op.Has(model.Rmdir)
+	if m := sh.f.GetMeta(name); m != nil {
+		dir = dir || m.Dir
+	}
+
+	in := sc.Contains(name, dir) && sh.followed(perm, name, dir)
+	if !e.Op.Has(model.Move) {
+		return e, in, false
+	}
+
+	oldName := strings.TrimPrefix(e.OldName, sh.path)
+	from := sc.Contains(oldName, dir) && sh.followed(perm, oldName, dir)
+	switch {
+	case in && from:
+		return e, true, false
+	case in && dir:
+		return e, false, true
+	case in:
+		e.Op, e.OldName = model.Write, ""
+		return e, true, false
+	case from:
+		e.Name, e.OldName, e.Op = e.OldName, "", model.Rename
+		if dir {
+			e.Op = model.Rmdir
+		}
+		return e, true, false
+	default:
+		return e, false, false
+	}
+}
+
+// shareErrorCode
+// error code of a failed share look up.
+func shareErrorCode(err error) protocol.ErrorCode {
+	if errors.Is(err, ErrServerShareDenied) {
+		return protocol.CodePermissionDenied
+	}
+	return protocol.CodeUnknownShare
+}
+
+// sendError
+// reject a request with given code.
+func (s *Server) sendError(enc *protocol.Encoder, code protocol.ErrorCode, msg string) error {
+	payload, _ := json.Marshal(protocol.ErrorPayload{Code: code, Msg: msg})
+	return enc.Encode(&protocol.Data{
+		Sec:     0,
+		Time:    time.Now(),
+		Type:    protocol.Error,
+		Heading: nil,
+		Payload: payload,
+	})
+}
+
+// sendReplay
+// send resume marker and every change after given sequence number, returns
+// sequence number of the last sent change. changes are scoped before anything
+// is sent, a replay which needs a listing sends nothing.
+func (sh *Share) sendReplay(enc *protocol.Encoder, from uint64, sc *filter.Scope, perm permission) (uint64, error) {
+	entries, ok := sh.j.Since(from)
+	if !ok {
+		return 0, errJournalGap
+	}
+
+	scoped := make([]journal.Entry, 0, len(entries))
+	for _, e := range entries {
+		e, ok, moved := sh.scoped(sc, perm, e)
+		if moved {
+			return 0, errScopeResync
+		}
+		if ok {
+			scoped = append(scoped, e)
+		}
+	}
+
+	pagePayload, _ := json.Marshal(protocol.PathFiles{
+		Path:    sh.path,
+		Last:    true,
+		Journal: sh.j.Id(),
+		Resume:  true,
+	})
+	err := enc.Encode(&protocol.Data{
+		Sec:     from,
+		Time:    time.Now(),
+		Type:    protocol.FilesList,
+		Heading: nil,
+		Payload: pagePayload,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range scoped {
+		if err := sh.sendChange(enc, e, sh.changeMeta(e)); err != nil {
+			return 0, err
+		}
+	}
+
+	sent := from
+	if len(entries) > 0 {
+		sent = entries[len(entries)-1].Seq
+	}
+	return sent, nil
+}
+
+// sendListing
+// send every tracked file in scope to the subscriber, paged to keep frames
+// small. returns sequence number the listing is up to date with.
+func (sh *Share) sendListing(enc *protocol.Encoder, sc *filter.Scope, perm permission) (uint64, error) {
+	seq := sh.j.Last()
+	list := sh.f.List()
+	if sc != nil {
+		scoped := list[:0]
+		for _, m := range list {
+			if sc.Contains(m.Name, m.Dir) && sh.followed(perm, m.Name, m.Dir) {
+				scoped = append(scoped, m)
+			}
+		}
+		list = scoped
+	}
+
+	for start := 0; ; start += listingPageSize {
+		end := min(start+listingPageSize, len(list))
 
-				if n != len(dataByte) {
-					subErr := fmt.Errorf("%d != %d", n, len(dataByte))
-					s.logger.Printf("server error :: %v\n", errors.Join(ErrServerInconsistentWrite, subErr))
-					continue
+		page := protocol.PathFiles{
+			Path:    sh.path,
+			Files:   make([]protocol.FileMetaPayload, 0, end-start),
+			Last:    end == len(list),
+			Journal: sh.j.Id(),
+		}
+		for _, m := range list[start:end] {
+			if !m.Dir && m.Link == "" && m.Hash == "" {
+				// written since last stat, it isn't hashed yet.
+				if fm, err := sh.f.Stat(m.Name); err == nil {
+					m = *fm
 				}
 			}
-		case <-s.exit:
-			conn.Close()
-			return
+			op := model.Write
+			if m.Dir {
+				op = model.Mkdir
+			}
+			page.Files = append(page.Files, protocol.FileMetaPayload{
+				Path:       sh.path,
+				FileName:   m.Name,
+				Op:         op,
+				Size:       m.Size,
+				ChangeDate: m.ModifyTime,
+				Hash:       m.Hash,
+				Mode:       filehandler.PosixMode(m.Mode),
+				HasMode:    true,
+				Owner:      fileOwner(m.Owner),
+				Link:       m.Link,
+			})
+		}
+
+		pagePayload, _ := json.Marshal(page)
+		err := enc.Encode(&protocol.Data{
+			Sec:     seq,
+			Time:    time.Now(),
+			Type:    protocol.FilesList,
+			Heading: nil,
+			Payload: pagePayload,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		if page.Last {
+			return seq, nil
 		}
 	}
 }
 
-func (s *Server) handleFileRequest(conn net.Conn, req *protocol.Data) error {
+func (s *Server) handleFileRequest(enc *protocol.Encoder, req *protocol.Data, username string) error {
 	reqPayload := protocol.RequestFilePayload{}
 	err := json.Unmarshal(req.Payload, &reqPayload)
 	if err != nil {
 		return fmt.Errorf("server error :: %v", errors.Join(ErrServerUnmarshalPacket, err))
 	}
-	data, err := s.f.ReadFile(reqPayload.FileName)
+
+	sh, err := s.share(reqPayload.Share, username)
+	if err != nil {
+		_ = s.sendFileHeader(enc, req, protocol.FileResponsePayload{
+			FileName: reqPayload.FileName,
+			Msg:      err.Error(),
+		})
+		return fmt.Errorf("server error :: %v", err)
+	}
+
+	perm, err := s.permission(username)
+	if err == nil && !sh.readable(perm, reqPayload.FileName, false) {
+		err = errors.Join(ErrServerPermissionDenied, fmt.Errorf("user %q, file %q", username, reqPayload.FileName))
+	}
 	if err != nil {
+		_ = s.sendError(enc, protocol.CodePermissionDenied, err.Error())
+		return fmt.Errorf("server error :: %v", err)
+	}
+
+	f, meta, err := sh.f.OpenFile(reqPayload.FileName)
+	if errors.Is(err, filehandler.ErrUnsafePath) {
+		s.rejected.Add(1)
+		s.logger.Printf("server warn :: rejected file request for %q, %v\n", reqPayload.FileName, err)
+	}
+	if err != nil {
+		_ = s.sendFileHeader(enc, req, protocol.FileResponsePayload{
+			FileName: reqPayload.FileName,
+			Msg:      err.Error(),
+		})
 		return fmt.Errorf("server error :: %v", errors.Join(ErrServerReadPacket, err))
 	}
+	defer f.Close()
 
-	res := protocol.Data{
-		Sec:     req.Sec + 1,
-		Time:    time.Now(),
-		Type:    protocol.ResponseFile,
-		Heading: req.Heading,
-		Payload: data,
+	sig := reqPayload.Signature
+	if sig != nil {
+		if err := sig.Validate(); err != nil {
+			s.logger.Printf("server warn :: ignore delta request for %s, %v\n", reqPayload.FileName, err)
+			sig = nil
+		}
 	}
 
-	data, err = json.Marshal(res)
+	err = s.sendFileHeader(enc, req, protocol.FileResponsePayload{
+		FileName:   reqPayload.FileName,
+		Size:       meta.Size,
+		ChangeDate: meta.ModifyTime,
+		Delta:      sig != nil,
+		Ok:         true,
+		Mode:       filehandler.PosixMode(meta.Mode),
+		HasMode:    true,
+		Owner:      fileOwner(meta.Owner),
+	})
 	if err != nil {
-		return fmt.Errorf("server error :: %v\n", errors.Join(ErrServerMarshalResponsePacket, err))
+		return fmt.Errorf("server error :: %v", errors.Join(ErrServerWritePacket, err))
+	}
+
+	// stream file content, size in header is only a hint since the file may
+	// change while it is being sent, checksum covers what was actually sent.
+	// on error no checksum is sent, connection is closed and client drops the transfer.
+	h := sha256.New()
+	var offset int64
+	if sig != nil {
+		var literal int64
+		err = delta.Diff(io.TeeReader(f, h), sig, protocol.ChunkSize, func(op delta.Op) error {
+			if op.Copy {
+				offset += op.Length
+				return enc.WriteCopy(op.Offset, op.Length)
+			}
+
+			if err := enc.WriteChunk(offset, op.Data); err != nil {
+				return err
+			}
+			offset += int64(len(op.Data))
+			literal += int64(len(op.Data))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("server error :: %v", errors.Join(ErrServerWritePacket, err))
+		}
+
+		s.logger.Printf("server :: delta transfer of %s, sent %d of %d bytes\n", reqPayload.FileName, literal, offset)
+	} else {
+		buf := make([]byte, protocol.ChunkSize)
+		for {
+			n, rerr := f.Read(buf)
+			if n > 0 {
+				h.Write(buf[:n])
+				if err := enc.WriteChunk(offset, buf[:n]); err != nil {
+					return fmt.Errorf("server error :: %v", errors.Join(ErrServerWritePacket, err))
+				}
+				offset += int64(n)
+			}
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return fmt.Errorf("server error :: %v", errors.Join(ErrServerReadPacket, rerr))
+			}
+		}
 	}
-	data = append(data, '@')
-	_, err = conn.Write(data)
+
+	sumPayload, _ := json.Marshal(protocol.FileChecksumPayload{
+		Size: offset,
+		Sum:  hex.EncodeToString(h.Sum(nil)),
+	})
+	err = enc.Encode(&protocol.Data{
+		Sec:     req.Sec + 1,
+		Time:    time.Now(),
+		Type:    protocol.FileChecksum,
+		Heading: req.Heading,
+		Payload: sumPayload,
+	})
 	if err != nil {
 		return fmt.Errorf("server error :: %v", errors.Join(ErrServerWritePacket, err))
 	}
 
 	return nil
 }
+
+func fileOwner(o *filehandler.Owner) *protocol.FileOwner {
+	if o == nil {
+		return nil
+	}
+	return &protocol.FileOwner{Uid: o.Uid, Gid: o.Gid}
+}
+
+func (s *Server) sendFileHeader(enc *protocol.Encoder, req *protocol.Data, header protocol.FileResponsePayload) error {
+	headerPayload, _ := json.Marshal(header)
+	return enc.Encode(&protocol.Data{
+		Sec:     req.Sec + 1,
+		Time:    time.Now(),
+		Type:    protocol.ResponseFile,
+		Heading: req.Heading,
+		Payload: headerPayload,
+	})
+}
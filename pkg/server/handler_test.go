@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_FileRequestError(t *testing.T) {
+	lg := log.New(io.Discard, "", 0)
+	h, err := filehandler.NewHandler(t.TempDir(), lg)
+	require.NoError(t, err)
+	s := NewServer("", "", nil, nil, lg, h)
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.handleAuthenticatedConnection(srv, protocol.NewEncoder(srv), protocol.NewDecoder(srv), "", "")
+
+	payload, _ := json.Marshal(protocol.RequestFilePayload{FileName: "missing.txt"})
+	require.NoError(t, protocol.NewEncoder(cli).Encode(&protocol.Data{Type: protocol.RequestFile, Payload: payload}))
+	require.NoError(t, cli.SetReadDeadline(time.Now().Add(time.Second*5)))
+
+	dec := protocol.NewDecoder(cli)
+	header := protocol.Data{}
+	require.NoError(t, dec.Decode(&header))
+	res := protocol.FileResponsePayload{}
+	require.NoError(t, json.Unmarshal(header.Payload, &res))
+	require.False(t, res.Ok)
+
+	// connection is closed after a failed request, client doesn't wait for its deadline.
+	require.ErrorIs(t, dec.Decode(&protocol.Data{}), io.EOF)
+}
+
+func TestShare_ReplayScopeResync(t *testing.T) {
+	lg := log.New(io.Discard, "", 0)
+	path := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(path, "in", "sub"), 0755))
+	h, err := filehandler.NewHandler(path, lg)
+	require.NoError(t, err)
+	j, err := journal.Open("", 0)
+	require.NoError(t, err)
+	sh := NewShare("", "", h, WithShareJournal(j))
+	sc, err := filter.NewScope("in")
+	require.NoError(t, err)
+
+	_, err = j.Append(model.Event{Name: "in/a.txt", Op: model.Write})
+	require.NoError(t, err)
+	// directory moved into scope, its content is only known from a listing.
+	_, err = j.Append(model.Event{Name: "in/sub", OldName: "out/sub", Op: model.Move})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = sh.sendReplay(protocol.NewEncoder(&buf), 0, sc, permission{})
+	require.ErrorIs(t, err, errScopeResync)
+	require.Zero(t, buf.Len(), "nothing is sent before a listing")
+}
+
+func TestSubscriptionScope(t *testing.T) {
+	sc, err := subscriptionScope(protocol.SubscribePathPayload{Path: "/team-a", Paths: []string{"team-b/src"}})
+	require.NoError(t, err)
+	require.True(t, sc.Contains("team-a/a.go", false))
+	require.True(t, sc.Contains("team-b/src/b.go", false))
+	require.False(t, sc.Contains("team-b/b.go", false))
+
+	for _, p := range []string{"../", "team-a/../../etc"} {
+		_, err := subscriptionScope(protocol.SubscribePathPayload{Paths: []string{p}})
+		require.ErrorIs(t, err, ErrServerSubscriptionPath, p)
+	}
+}
+
+func TestServer_SubscribeInvalidPayload(t *testing.T) {
+	lg := log.New(io.Discard, "", 0)
+	h, err := filehandler.NewHandler(t.TempDir(), lg)
+	require.NoError(t, err)
+	s := NewServer("", "", nil, nil, lg, h)
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go s.handleAuthenticatedConnection(srv, protocol.NewEncoder(srv), protocol.NewDecoder(srv), "", "")
+
+	require.NoError(t, protocol.NewEncoder(cli).Encode(&protocol.Data{Type: protocol.SubscribePath, Payload: []byte(`{"ps":"team-a"}`)}))
+	require.NoError(t, cli.SetReadDeadline(time.Now().Add(time.Second*5)))
+
+	// subscription is rejected instead of covering the whole share.
+	dec := protocol.NewDecoder(cli)
+	d := protocol.Data{}
+	require.NoError(t, dec.Decode(&d))
+	require.Equal(t, protocol.Error, d.Type)
+	res := protocol.ErrorPayload{}
+	require.NoError(t, json.Unmarshal(d.Payload, &res))
+	require.Equal(t, protocol.CodeInvalidPayload, res.Code)
+}
+
+func TestServer_JoinTimeout(t *testing.T) {
+	s := NewServer("", "", nil, nil, log.New(io.Discard, "", 0), nil)
+	s.join = time.Millisecond * 100
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	// client connects and never sends its join.
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := s.joinHandler(srv, protocol.NewEncoder(srv), protocol.NewDecoder(srv))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, ErrServerReadPacket)
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(time.Second * 5):
+		t.Fatal("join read has no deadline")
+	}
+}
+
+func TestServer_CleartextLogin(t *testing.T) {
+	dir := t.TempDir()
+	um := &user.UserManager{PwFile: filepath.Join(dir, "pwfile")}
+	require.NoError(t, os.WriteFile(um.PwFile, nil, 0600))
+	require.NoError(t, um.Init())
+	require.NoError(t, um.CreateUser(&user.Creadential{Username: "user1", Password: "secret"}))
+	s := NewServer("", "", nil, um, log.New(io.Discard, "", 0), nil)
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	// client from before SCRAM sends its password without a nonce.
+	p := &protocol.JoinPayload{Username: "user1", Password: "secret"}
+	name, _, err := s.login(srv, protocol.NewEncoder(srv), protocol.NewDecoder(srv), p)
+	require.NoError(t, err)
+	require.Empty(t, name, "password in clear is accepted without cleartext")
+
+	um.Cleartext = true
+	name, _, err = s.login(srv, protocol.NewEncoder(srv), protocol.NewDecoder(srv), p)
+	require.NoError(t, err)
+	require.Equal(t, "user1", name)
+}
+
+func TestServer_SubscriberDisconnect(t *testing.T) {
+	dir := t.TempDir()
+	um := &user.UserManager{PwFile: filepath.Join(dir, "pwfile")}
+	require.NoError(t, os.WriteFile(um.PwFile, nil, 0600))
+	require.NoError(t, um.Init())
+	lg := log.New(io.Discard, "", 0)
+	h, err := filehandler.NewHandler(t.TempDir(), lg)
+	require.NoError(t, err)
+	// no heartbeat write fails before the test ends.
+	s := NewServer("", "", nil, um, lg, h, WithHeartbeat(time.Hour))
+
+	srv, cli := net.Pipe()
+	session, err := um.OpenSession("user1", "pipe", "", srv)
+	require.NoError(t, err)
+	go s.handleAuthenticatedConnection(srv, protocol.NewEncoder(srv), protocol.NewDecoder(srv), "user1", session.Id)
+
+	require.NoError(t, protocol.NewEncoder(cli).Encode(&protocol.Data{Type: protocol.SubscribePath}))
+	require.NoError(t, cli.SetReadDeadline(time.Now().Add(time.Second*5)))
+	require.NoError(t, protocol.NewDecoder(cli).Decode(&protocol.Data{}), "listing")
+	require.Len(t, um.Sessions(), 1)
+
+	// session ends with the subscription, not with a failed heartbeat.
+	require.NoError(t, cli.Close())
+	require.Eventually(t, func() bool { return len(um.Sessions()) == 0 }, time.Second*5, time.Millisecond*10)
+}
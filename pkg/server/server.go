@@ -2,70 +2,239 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"net"
-	"strings"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
 )
 
+var ErrServerConfig = errors.New("invalid server configuration")
+
 type Mode int
 
+const defaultHeartbeat = time.Second * 10
+
+// defaultJoinTimeout
+// time a new connection has to log in, a connection which sends nothing
+// doesn't hold its handler forever.
+const defaultJoinTimeout = time.Second * 30
+
+// ServerTLS
+// ClientCA is a bundle of CA certificates client certificates are verified
+// with, a client with a verified certificate logs in as the user its common
+// name or subject alternative names map to, without password.
+// RequireClientCert rejects clients without certificate.
 type ServerTLS struct {
-	Cert string `yaml:"cert"`
-	Key  string `yaml:"key"`
+	Cert              string `yaml:"cert"`
+	Key               string `yaml:"key"`
+	ClientCA          string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+type Option func(s *Server)
+
+// WithQueueSize
+// number of events buffered for each subscriber.
+func WithQueueSize(size int) Option {
+	return func(s *Server) {
+		s.queueSize = size
+	}
+}
+
+// WithSlowConsumerPolicy
+// policy applied to subscribers which can't keep up with events.
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) Option {
+	return func(s *Server) {
+		s.policy = policy
+	}
+}
+
+// WithHeartbeat
+// interval of heartbeat packets sent to subscribers, so clients can detect
+// dead connections.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(s *Server) {
+		if interval > 0 {
+			s.heartbeat = interval
+		}
+	}
+}
+
+// WithJournal
+// journal used to number change events and replay them to resuming clients,
+// without it events are kept in memory only. server without default share
+// fails to run.
+func WithJournal(j *journal.Journal) Option {
+	return func(s *Server) {
+		sh, ok := s.shares[""]
+		if !ok {
+			s.configError("journal without default share")
+			return
+		}
+		sh.j = j
+	}
+}
+
+// WithFilter
+// changes of names matching filter are not sent to clients of default share.
+// server without default share fails to run.
+func WithFilter(f *filter.Filter) Option {
+	return func(s *Server) {
+		sh, ok := s.shares[""]
+		if !ok {
+			s.configError("filter without default share")
+			return
+		}
+		sh.filter = f
+	}
+}
+
+// WithShare
+// serve a named share next to the default one, clients ask for it by name.
+func WithShare(sh *Share) Option {
+	return func(s *Server) {
+		s.shares[sh.name] = sh
+	}
 }
 
 type Server struct {
-	address string
-	logger  *log.Logger
-	e       chan model.Event
-	f       *filehandler.Handler
-	exit    chan struct{}
-	path    string
-	tls     *ServerTLS
-	um      *user.UserManager
+	address   string
+	logger    *log.Logger
+	shares    map[string]*Share
+	exit      chan struct{}
+	ready     chan struct{} // closed once Run listens
+	tls       *ServerTLS
+	um        *user.UserManager
+	queueSize int
+	policy    SlowConsumerPolicy
+	heartbeat time.Duration
+	join      time.Duration
+	sync      bool
+	conflict  ConflictPolicy
+
+	// config
+	// errors of options, options can't return them so Run does.
+	config []error
+
+	// rejected
+	// number of file requests refused for names escaping served path.
+	rejected atomic.Uint64
 }
 
-func NewServer(address string, path string, tls *ServerTLS, um *user.UserManager, logger *log.Logger, f *filehandler.Handler) *Server {
+// NewServer
+// path and f are the default share, served to clients which ask for no share
+// by name. server without default share has nil f.
+func NewServer(address string, path string, tls *ServerTLS, um *user.UserManager, logger *log.Logger, f *filehandler.Handler, options ...Option) *Server {
 	s := Server{
-		address: address,
-		logger:  logger,
-		e:       make(chan model.Event, 2),
-		f:       f,
-		exit:    make(chan struct{}, 0),
-		path:    path,
-		tls:     tls,
-		um:      um,
+		address:   address,
+		logger:    logger,
+		shares:    make(map[string]*Share),
+		exit:      make(chan struct{}, 0),
+		ready:     make(chan struct{}),
+		tls:       tls,
+		um:        um,
+		heartbeat: defaultHeartbeat,
+		join:      defaultJoinTimeout,
+	}
+	if f != nil {
+		s.shares[""] = NewShare("", path, f)
+	}
+
+	for _, op := range options {
+		op(&s)
+	}
+
+	for _, sh := range s.shares {
+		sh.logger = logger
+		sh.subs = newRegistry(s.queueSize, s.policy)
+		if sh.j == nil {
+			sh.j, _ = journal.Open("", 0)
+		}
 	}
 
 	return &s
 }
 
+// RejectedPaths
+// number of file requests refused because their name escapes served path.
+func (s *Server) RejectedPaths() uint64 {
+	return s.rejected.Load()
+}
+
+func (s *Server) configError(format string, a ...any) {
+	s.config = append(s.config, fmt.Errorf(format, a...))
+}
+
+// validate
+// configuration errors of options, shares sharing a journal file, which
+// would number events of both in one sequence, and tls settings which would
+// silently serve without the requested tls or client certificates.
+func (s *Server) validate() error {
+	errs := s.config
+	if s.tls != nil && (s.tls.Cert == "" || s.tls.Key == "") {
+		errs = append(errs, errors.New("tls needs cert and key"))
+	}
+	if s.tls != nil && s.tls.RequireClientCert && s.tls.ClientCA == "" {
+		errs = append(errs, errors.New("require_client_cert needs client_ca"))
+	}
+	journals := make(map[string]string)
+	for name, sh := range s.shares {
+		path := sh.j.Path()
+		if path == "" {
+			continue
+		}
+		if other, ok := journals[path]; ok {
+			errs = append(errs, fmt.Errorf("shares %q and %q use journal %s", other, name, path))
+			continue
+		}
+		journals[path] = name
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.Join(append([]error{ErrServerConfig}, errs...)...)
+}
+
 func (s *Server) Exit() error {
 	close(s.exit)
 	return nil
 }
 
-func (s *Server) EventHook(event model.Event, err error) {
-	if err != nil {
-		s.logger.Printf("server error :: receive error %v on hook\n", err)
-		return
-	}
+// Ready
+// closed once Run listens and clients can connect, it is never closed when
+// Run fails before.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
 
-	if strings.Contains(event.Name, "swp") ||
-		strings.Contains(event.Name, ".goutputstream") ||
-		strings.HasSuffix(event.Name, "~") ||
-		event.Op.Has(model.Chmod) {
+// EventHook
+// watcher hook of default share.
+func (s *Server) EventHook(event model.Event, err error) {
+	sh, ok := s.shares[""]
+	if !ok {
+		s.logger.Printf("server error :: event %v without default share\n", event)
 		return
 	}
-
-	s.e <- event
+	sh.EventHook(event, err)
 }
 
 func (s *Server) Run() error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
 	var l net.Listener
 
 	if s.tls == nil {
@@ -83,6 +252,22 @@ func (s *Server) Run() error {
 		}
 
 		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if s.tls.ClientCA != "" {
+			pem, err := os.ReadFile(s.tls.ClientCA)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return errors.Join(ErrServerClientCA, fmt.Errorf("no certificate in %s", s.tls.ClientCA))
+			}
+
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if s.tls.RequireClientCert {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
 		ln, err := tls.Listen("tcp", s.address, tlsConfig)
 		if err != nil {
 			return err
@@ -97,6 +282,7 @@ func (s *Server) Run() error {
 	}
 
 	s.logger.Printf("server :: running on host %s, port %s ...\n", host, port)
+	close(s.ready)
 
 	for {
 		var conn net.Conn
@@ -105,13 +291,23 @@ func (s *Server) Run() error {
 			return err
 		}
 
-		username, err := s.joinHandler(conn)
-		if err != nil {
-			s.logger.Printf("server error :: %v\n", err)
-			conn.Close()
-			continue
-		}
+		// password check is slow, it doesn't hold other connections back.
+		go func() {
+			enc := protocol.NewEncoder(conn)
+			dec := protocol.NewDecoder(conn)
+
+			username, session, admin, err := s.joinHandler(conn, enc, dec)
+			if err != nil {
+				s.logger.Printf("server error :: %v\n", err)
+				conn.Close()
+				return
+			}
 
-		go s.handleAuthenticatedConnection(conn, username)
+			if admin {
+				s.handleAdminConnection(conn, enc, dec, username)
+				return
+			}
+			s.handleAuthenticatedConnection(conn, enc, dec, username, session)
+		}()
 	}
 }
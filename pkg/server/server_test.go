@@ -0,0 +1,56 @@
+package server
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Config(t *testing.T) {
+	lg := log.New(io.Discard, "", 0)
+	share := func(name string, options ...ShareOption) *Share {
+		h, err := filehandler.NewHandler(t.TempDir(), lg)
+		require.NoError(t, err)
+		return NewShare(name, "", h, options...)
+	}
+	open := func(path string) *journal.Journal {
+		j, err := journal.Open(path, 0)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = j.Close() })
+		return j
+	}
+
+	// options of default share on a server without one.
+	s := NewServer("", "", nil, nil, lg, nil, WithJournal(open("")), WithFilter(filter.Default()), WithShare(share("docs")))
+	err := s.Run()
+	require.ErrorIs(t, err, ErrServerConfig)
+	require.ErrorContains(t, err, "journal without default share")
+	require.ErrorContains(t, err, "filter without default share")
+
+	path := filepath.Join(t.TempDir(), "journal")
+	s = NewServer("", "", nil, nil, lg, nil,
+		WithShare(share("docs", WithShareJournal(open(path)))),
+		WithShare(share("media", WithShareJournal(open(path)))))
+	err = s.Run()
+	require.ErrorIs(t, err, ErrServerConfig)
+	require.ErrorContains(t, err, path)
+
+	s = NewServer("", "", nil, nil, lg, nil,
+		WithShare(share("docs", WithShareJournal(open(filepath.Join(t.TempDir(), "journal"))))),
+		WithShare(share("media")))
+	require.NoError(t, s.validate())
+
+	s = NewServer("", "", &ServerTLS{Cert: "cert.pem", Key: "key.pem", RequireClientCert: true}, nil, lg, nil)
+	err = s.Run()
+	require.ErrorIs(t, err, ErrServerConfig)
+	require.ErrorContains(t, err, "require_client_cert needs client_ca")
+
+	s = NewServer("", "", &ServerTLS{ClientCA: "ca.pem"}, nil, lg, nil)
+	require.ErrorContains(t, s.validate(), "tls needs cert and key")
+}
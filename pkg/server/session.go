@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/user"
+)
+
+// handleAdminConnection
+// serve session requests of an admin connection, it has no session and
+// can't subscribe or transfer files.
+func (s *Server) handleAdminConnection(conn net.Conn, enc *protocol.Encoder, dec *protocol.Decoder, username string) {
+	defer conn.Close()
+
+	for {
+		req := protocol.Data{}
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.Printf("server error :: %v\n", errors.Join(ErrServerReadPacket, err))
+			}
+			return
+		}
+
+		if req.Type != protocol.ListSessions && req.Type != protocol.KillSession {
+			s.logger.Printf("server error :: admin connection of %q, %v\n", username, ErrServerInvalidPacketType)
+			return
+		}
+		if err := s.handleSessions(enc, &req, username); err != nil {
+			s.logger.Println(err)
+		}
+	}
+}
+
+// handleSessions
+// list or kill sessions on behalf of an admin user.
+func (s *Server) handleSessions(enc *protocol.Encoder, req *protocol.Data, username string) error {
+	perm, err := s.permission(username)
+	if err == nil && !perm.admin {
+		err = errors.Join(ErrServerPermissionDenied, fmt.Errorf("user %q is not admin", username))
+	}
+	if err != nil {
+		_ = s.sendError(enc, protocol.CodePermissionDenied, err.Error())
+		return fmt.Errorf("server error :: %v", err)
+	}
+
+	var res protocol.Data
+	switch req.Type {
+	case protocol.ListSessions:
+		list := protocol.SessionsListPayload{Sessions: []protocol.SessionPayload{}}
+		if s.um != nil {
+			for _, ss := range s.um.Sessions() {
+				list.Sessions = append(list.Sessions, protocol.SessionPayload{
+					Id:       ss.Id,
+					Username: ss.Username,
+					Addr:     ss.Addr,
+					Started:  ss.Started,
+					Conns:    ss.Conns,
+				})
+			}
+		}
+
+		payload, _ := json.Marshal(list)
+		res = protocol.Data{Type: protocol.SessionsList, Payload: payload}
+	case protocol.KillSession:
+		kill := protocol.KillSessionPayload{}
+		if err := json.Unmarshal(req.Payload, &kill); err != nil {
+			return fmt.Errorf("server error :: %v", errors.Join(ErrServerUnmarshalPacket, err))
+		}
+
+		ack := protocol.AckKillSessionPayload{Msg: fmt.Sprintf("%v, session %q", user.ErrUnknownSession, kill.Id)}
+		if s.um != nil && slices.ContainsFunc(s.um.Sessions(), func(ss user.Session) bool { return ss.Id == kill.Id }) {
+			ack = protocol.AckKillSessionPayload{Ok: true}
+		}
+
+		payload, _ := json.Marshal(ack)
+		res = protocol.Data{Type: protocol.AckKillSession, Payload: payload}
+		if ack.Ok {
+			// acknowledged before the kill, request may come from the killed session.
+			defer func() {
+				if err := s.um.KillSession(kill.Id); err == nil {
+					s.logger.Printf("server :: session %s killed by %q\n", kill.Id, username)
+				}
+			}()
+		}
+	}
+
+	res.Time = time.Now()
+	if err := enc.Encode(&res); err != nil {
+		return fmt.Errorf("server error :: %v", errors.Join(ErrServerWritePacket, err))
+	}
+	return nil
+}
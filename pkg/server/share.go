@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+)
+
+var (
+	ErrServerUnknownShare = errors.New("unknown share")
+	ErrServerShareDenied  = errors.New("access to share denied")
+)
+
+type ShareOption func(sh *Share)
+
+// WithShareJournal
+// journal of share changes, in memory one when not set.
+func WithShareJournal(j *journal.Journal) ShareOption {
+	return func(sh *Share) {
+		sh.j = j
+	}
+}
+
+// WithShareFilter
+// changes of names matching filter are not sent to clients.
+func WithShareFilter(f *filter.Filter) ShareOption {
+	return func(sh *Share) {
+		sh.filter = f
+	}
+}
+
+// WithShareUsers
+// users allowed to access the share, everyone when none is given. a share
+// with users can't be accessed without authentication.
+func WithShareUsers(users ...string) ShareOption {
+	return func(sh *Share) {
+		for _, u := range users {
+			sh.users[u] = struct{}{}
+		}
+	}
+}
+
+// Share
+// a named directory served to clients, with its own file handler, journal,
+// filter, access list and subscribers. the default share of a server has an
+// empty name.
+type Share struct {
+	name   string
+	path   string
+	f      *filehandler.Handler
+	j      *journal.Journal
+	filter *filter.Filter
+	users  map[string]struct{}
+	subs   *registry
+	logger *log.Logger
+	writes *writeBatch
+}
+
+func NewShare(name string, path string, f *filehandler.Handler, options ...ShareOption) *Share {
+	sh := Share{
+		name:   name,
+		path:   path,
+		f:      f,
+		filter: filter.Default(),
+		users:  make(map[string]struct{}),
+	}
+
+	for _, op := range options {
+		op(&sh)
+	}
+	sh.writes = newWriteBatch(writeDelay, writeMaxDelay, sh.publish)
+
+	return &sh
+}
+
+func (sh *Share) Name() string {
+	return sh.name
+}
+
+// allowed
+// check whether given user may access the share, username is empty when
+// server doesn't authenticate.
+func (sh *Share) allowed(username string) bool {
+	if len(sh.users) == 0 {
+		return true
+	}
+	_, ok := sh.users[username]
+	return ok
+}
+
+// EventHook
+// watcher hook of share path, changes are journaled and sent to subscribers.
+func (sh *Share) EventHook(event model.Event, err error) {
+	if err != nil {
+		sh.logger.Printf("server error :: receive error %v on hook of share %q\n", err, sh.name)
+		return
+	}
+
+	// a symbolic link is complete once created, it has no write to wait for.
+	// links to directories are reported as mkdir by a watcher following them.
+	if event.Op == model.Create && sh.f.Symlinks() != filehandler.SymlinkIgnore && isSymlink(event.Name) {
+		event.Op = model.Write
+	}
+
+	// new files are sent on their first write, new directories arrive as mkdir.
+	if sh.ignored(event.Name, event.Op) ||
+		strings.HasPrefix(event.Name, model.ExitName) ||
+		event.Op.Has(model.Create) {
+		return
+	}
+
+	// temporary file renamed into place, clients don't have the old name.
+	if event.Op.Has(model.Move) && sh.ignored(event.OldName, event.Op) {
+		event = model.Event{Name: event.Name, Op: model.Write}
+	}
+
+	if event.Op == model.Write {
+		sh.writes.write(event)
+		return
+	}
+	sh.writes.event(event)
+}
+
+// publish
+// journal a change and send it to subscribers.
+func (sh *Share) publish(event model.Event) {
+	entry, err := sh.j.Append(event)
+	if err != nil {
+		sh.logger.Printf("server error :: failed to persist event %v into journal of share %q, %v\n", entry.Seq, sh.name, err)
+	}
+
+	c := change{Entry: entry}
+	if sh.subs.len() > 0 {
+		c.meta = sh.changeMeta(entry)
+	}
+	sh.subs.broadcast(c)
+}
+
+func isSymlink(name string) bool {
+	fs, err := os.Lstat(name)
+	return err == nil && fs.Mode()&os.ModeSymlink != 0
+}
+
+// ignored
+// check whether changes of given name are filtered out.
+func (sh *Share) ignored(name string, op model.Op) bool {
+	name = strings.TrimPrefix(name, strings.TrimSuffix(sh.path, "/")+"/")
+	dir := op.Has(model.Mkdir) || op.Has(model.Rmdir)
+	if m := sh.f.GetMeta(name); m != nil {
+		dir = dir || m.Dir
+	}
+	return sh.filter.Match(name, dir)
+}
+
+// share
+// look up share requested by a client.
+func (s *Server) share(name string, username string) (*Share, error) {
+	sh, ok := s.shares[name]
+	if !ok {
+		return nil, errors.Join(ErrServerUnknownShare, fmt.Errorf("share %q", name))
+	}
+	if !sh.allowed(username) {
+		return nil, errors.Join(ErrServerShareDenied, fmt.Errorf("share %q, user %q", name, username))
+	}
+	return sh, nil
+}
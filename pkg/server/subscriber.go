@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
+)
+
+// SlowConsumerPolicy
+// what to do with a subscriber whose queue is full when an event arrives.
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerResync drop the event and send the full listing to the
+	// subscriber once it catches up, so it converges anyway.
+	SlowConsumerResync SlowConsumerPolicy = "resync"
+	// SlowConsumerDisconnect close the subscriber connection.
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+)
+
+var ErrServerSlowConsumerPolicy = errors.New("unknown slow consumer policy")
+
+// ParseSlowConsumerPolicy
+// validate policy name from configuration, empty name is resync.
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	switch p := SlowConsumerPolicy(strings.ToLower(name)); p {
+	case "":
+		return SlowConsumerResync, nil
+	case SlowConsumerResync, SlowConsumerDisconnect:
+		return p, nil
+	default:
+		return "", errors.Join(ErrServerSlowConsumerPolicy, fmt.Errorf("policy %q", name))
+	}
+}
+
+const defaultQueueSize = 256
+
+// change
+// journaled event with meta data of its file, the file is stat once when the
+// event is published instead of once for every subscriber.
+type change struct {
+	journal.Entry
+	meta *filehandler.Meta
+}
+
+type subscriber struct {
+	id     uint64
+	events chan change
+	resync atomic.Bool
+	kick   chan struct{}
+	once   sync.Once
+}
+
+func (s *subscriber) disconnect() {
+	s.once.Do(func() { close(s.kick) })
+}
+
+// registry
+// keeps every subscribed connection with its own bounded queue, each event
+// is broadcast to all of them.
+type registry struct {
+	mu        sync.RWMutex
+	subs      map[uint64]*subscriber
+	next      uint64
+	queueSize int
+	policy    SlowConsumerPolicy
+}
+
+func newRegistry(queueSize int, policy SlowConsumerPolicy) *registry {
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	if policy == "" {
+		policy = SlowConsumerResync
+	}
+
+	return &registry{
+		subs:      make(map[uint64]*subscriber),
+		queueSize: queueSize,
+		policy:    policy,
+	}
+}
+
+func (r *registry) subscribe() *subscriber {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.next++
+	sub := &subscriber{
+		id:     r.next,
+		events: make(chan change, r.queueSize),
+		kick:   make(chan struct{}),
+	}
+	r.subs[sub.id] = sub
+
+	return sub
+}
+
+func (r *registry) unsubscribe(sub *subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.subs, sub.id)
+}
+
+func (r *registry) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.subs)
+}
+
+// broadcast
+// never blocks, full queues are handled by the slow consumer policy.
+func (r *registry) broadcast(e change) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, sub := range r.subs {
+		select {
+		case sub.events <- e:
+		default:
+			switch r.policy {
+			case SlowConsumerDisconnect:
+				sub.disconnect()
+			default:
+				sub.resync.Store(true)
+			}
+		}
+	}
+}
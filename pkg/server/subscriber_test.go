@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/journal"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Broadcast(t *testing.T) {
+	r := newRegistry(2, SlowConsumerResync)
+	s1 := r.subscribe()
+	s2 := r.subscribe()
+	require.Equal(t, 2, r.len())
+
+	e := change{Entry: journal.Entry{Seq: 1, Name: "foo", Op: model.Write}}
+	r.broadcast(e)
+
+	require.Equal(t, e, <-s1.events)
+	require.Equal(t, e, <-s2.events)
+
+	r.unsubscribe(s2)
+	r.broadcast(e)
+	require.Len(t, s1.events, 1)
+	require.Len(t, s2.events, 0)
+}
+
+func TestRegistry_SlowConsumer(t *testing.T) {
+	t.Run("resync", func(t *testing.T) {
+		r := newRegistry(1, SlowConsumerResync)
+		sub := r.subscribe()
+
+		r.broadcast(change{Entry: journal.Entry{Name: "foo", Op: model.Write}})
+		require.False(t, sub.resync.Load())
+
+		r.broadcast(change{Entry: journal.Entry{Name: "bar", Op: model.Write}})
+		require.True(t, sub.resync.Load())
+		require.Len(t, sub.events, 1)
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		r := newRegistry(1, SlowConsumerDisconnect)
+		sub := r.subscribe()
+
+		r.broadcast(change{Entry: journal.Entry{Name: "foo", Op: model.Write}})
+		r.broadcast(change{Entry: journal.Entry{Name: "bar", Op: model.Write}})
+		r.broadcast(change{Entry: journal.Entry{Name: "baz", Op: model.Write}})
+
+		select {
+		case <-sub.kick:
+		default:
+			t.Fatal("slow subscriber isn't disconnected")
+		}
+	})
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	p, err := ParseSlowConsumerPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, SlowConsumerResync, p)
+
+	p, err = ParseSlowConsumerPolicy("Disconnect")
+	require.NoError(t, err)
+	require.Equal(t, SlowConsumerDisconnect, p)
+
+	_, err = ParseSlowConsumerPolicy("disconect")
+	require.ErrorIs(t, err, ErrServerSlowConsumerPolicy)
+}
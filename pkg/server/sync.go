@@ -0,0 +1,277 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+)
+
+// ConflictPolicy
+// how a change pushed by a client is resolved when the server version changed
+// since the version the client edited.
+type ConflictPolicy string
+
+const (
+	// ConflictServerWins keep server version, pushed change is discarded.
+	ConflictServerWins ConflictPolicy = "server-wins"
+	// ConflictNewestWins keep the most recently modified version.
+	ConflictNewestWins ConflictPolicy = "newest-wins"
+	// ConflictKeepBoth keep server version and store pushed content next to
+	// it as <name>.conflict-<host>-<timestamp>.
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+)
+
+var (
+	ErrServerConflictPolicy = errors.New("unknown conflict policy")
+	ErrServerReadOnly       = errors.New("server doesn't accept pushed changes")
+	ErrServerChecksum       = errors.New("pushed content checksum mismatch")
+)
+
+// ParseConflictPolicy
+// validate policy name from configuration, empty name is server-wins.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(name)); p {
+	case "":
+		return ConflictServerWins, nil
+	case ConflictServerWins, ConflictNewestWins, ConflictKeepBoth:
+		return p, nil
+	default:
+		return "", errors.Join(ErrServerConflictPolicy, fmt.Errorf("policy %q", name))
+	}
+}
+
+// WithSync
+// accept changes pushed by clients in sync mode, conflicts are resolved with
+// given policy. pushed changes are applied to share path, so watcher reports
+// them to every subscriber.
+func WithSync(policy ConflictPolicy) Option {
+	return func(s *Server) {
+		s.sync = true
+		s.conflict = policy
+	}
+}
+
+// handlePush
+// apply a change pushed by a client and acknowledge it.
+func (s *Server) handlePush(conn net.Conn, enc *protocol.Encoder, dec *protocol.Decoder, req *protocol.Data, username string) error {
+	p := protocol.PushFilePayload{}
+	if err := json.Unmarshal(req.Payload, &p); err != nil {
+		return fmt.Errorf("server error :: %v", errors.Join(ErrServerUnmarshalPacket, err))
+	}
+
+	ack, err := s.push(conn, dec, p, username)
+	if errors.Is(err, ErrServerPermissionDenied) {
+		if werr := s.sendError(enc, protocol.CodePermissionDenied, err.Error()); werr != nil {
+			return fmt.Errorf("server error :: %v", errors.Join(ErrServerWritePacket, werr))
+		}
+		return fmt.Errorf("server error :: push of %q, %v", p.FileName, err)
+	}
+	if err != nil {
+		ack = protocol.AckPushPayload{Msg: err.Error()}
+		if errors.Is(err, filehandler.ErrUnsafePath) {
+			s.rejected.Add(1)
+		}
+	}
+
+	payload, _ := json.Marshal(ack)
+	if werr := enc.Encode(&protocol.Data{
+		Sec:     0,
+		Time:    time.Now(),
+		Type:    protocol.AckPush,
+		Heading: nil,
+		Payload: payload,
+	}); werr != nil {
+		return fmt.Errorf("server error :: %v", errors.Join(ErrServerWritePacket, werr))
+	}
+
+	if err != nil {
+		return fmt.Errorf("server error :: push of %q, %v", p.FileName, err)
+	}
+	if ack.Conflict {
+		s.logger.Printf("server warn :: conflict on push of %q by %q, policy %s, stored as %q\n", p.FileName, p.Host, s.conflict, ack.Name)
+	}
+	return nil
+}
+
+func (s *Server) push(conn net.Conn, dec *protocol.Decoder, p protocol.PushFilePayload, username string) (ack protocol.AckPushPayload, err error) {
+	// content of a rejected write is drained, so acknowledge is read by client.
+	consumed := !p.Op.Has(model.Write)
+	defer func() {
+		if !consumed {
+			_ = s.receivePush(conn, dec, nil)
+		}
+	}()
+
+	if !s.sync {
+		return protocol.AckPushPayload{}, ErrServerReadOnly
+	}
+
+	sh, err := s.share(p.Share, username)
+	if err != nil {
+		return protocol.AckPushPayload{}, err
+	}
+
+	name, err := filehandler.CleanName(p.FileName)
+	if err != nil {
+		return protocol.AckPushPayload{}, err
+	}
+	dir := p.Op.Has(model.Mkdir) || p.Op.Has(model.Rmdir)
+	if name == "" || sh.filter.Match(name, dir) {
+		return protocol.AckPushPayload{}, fmt.Errorf("name %q is not synchronized", p.FileName)
+	}
+
+	perm, err := s.permission(username)
+	if err != nil {
+		return protocol.AckPushPayload{}, err
+	}
+	if !sh.writable(perm, name, dir) || (p.Op.Has(model.Move) && !sh.writable(perm, p.From, dir)) {
+		return protocol.AckPushPayload{}, errors.Join(ErrServerPermissionDenied, fmt.Errorf("user %q can't change %q", username, p.FileName))
+	}
+
+	// hash of tracked meta data may be outdated, it is computed on stat.
+	cur, _ := sh.f.Stat(name)
+	// server version changed since client saw it, a client which didn't know
+	// the file conflicts with any existing version.
+	conflict := cur != nil && !cur.Dir && cur.Hash != p.Base
+	keep := !conflict || (s.conflict == ConflictNewestWins && p.ChangeDate.After(cur.ModifyTime))
+
+	switch {
+	case p.Op.Has(model.Write):
+		if cur != nil && sh.f.SameContent(name, p.Hash) {
+			return protocol.AckPushPayload{Ok: true, Name: name}, nil
+		}
+
+		target := name
+		if !keep && s.conflict == ConflictKeepBoth {
+			target, keep = conflictName(name, p.Host, conn, time.Now()), true
+		}
+		if !keep {
+			return protocol.AckPushPayload{Ok: true, Conflict: true}, nil
+		}
+
+		w, err := sh.f.NewFileWriter(target)
+		if err != nil {
+			return protocol.AckPushPayload{}, err
+		}
+		consumed = true
+		if err := s.receivePush(conn, dec, w); err != nil {
+			_ = w.Abort()
+			return protocol.AckPushPayload{}, err
+		}
+
+		w.SetAttr(filehandler.Attr{Mode: filehandler.FileMode(p.Mode), HasMode: p.HasMode, ModTime: p.ChangeDate})
+		if err := w.Commit(); err != nil {
+			return protocol.AckPushPayload{}, err
+		}
+		return protocol.AckPushPayload{Ok: true, Conflict: conflict, Name: target}, nil
+	case p.Op.Has(model.Mkdir):
+		return protocol.AckPushPayload{Ok: true, Name: name}, sh.f.MakeDir(name, filehandler.Attr{Mode: filehandler.FileMode(p.Mode), HasMode: p.HasMode})
+	case p.Op.Has(model.Rmdir):
+		// only an empty directory is removed, anything added meanwhile stays.
+		return protocol.AckPushPayload{Ok: true, Name: name}, sh.f.RemoveDir(name, func(n string) bool { return n != name })
+	case p.Op.Has(model.Move):
+		from, err := filehandler.CleanName(p.From)
+		if err != nil {
+			return protocol.AckPushPayload{}, err
+		}
+		src, _ := sh.f.Stat(from)
+		if src == nil || cur != nil || (!src.Dir && src.Hash != p.Base) {
+			// source changed or is gone, or destination exists, client pushes
+			// its copy as a new file instead.
+			return protocol.AckPushPayload{Ok: true, Conflict: true}, nil
+		}
+		return protocol.AckPushPayload{Ok: true, Name: name}, sh.f.MoveFile(from, name)
+	case p.Op.Has(model.Remove) || p.Op.Has(model.Rename):
+		if cur == nil {
+			return protocol.AckPushPayload{Ok: true}, nil
+		}
+		if !keep {
+			return protocol.AckPushPayload{Ok: true, Conflict: true}, nil
+		}
+		return protocol.AckPushPayload{Ok: true, Conflict: conflict, Name: name}, sh.f.RemoveFile(name)
+	default:
+		return protocol.AckPushPayload{}, fmt.Errorf("unsupported push operation %v", p.Op)
+	}
+}
+
+// receivePush
+// read pushed content (chunks and checksum) into given writer, with nil writer
+// content is only drained.
+func (s *Server) receivePush(conn net.Conn, dec *protocol.Decoder, w *filehandler.FileWriter) error {
+	h := sha256.New()
+	var size int64
+	for {
+		// every frame gets its own deadline, big files may take a long time.
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second * 30)); err != nil {
+			return errors.Join(ErrServerReadPacket, err)
+		}
+
+		frame, err := dec.ReadFrame()
+		if err != nil {
+			return errors.Join(ErrServerReadPacket, err)
+		}
+
+		if frame.Type == protocol.FrameChunk {
+			offset, data, err := frame.Chunk()
+			if err != nil || offset != size {
+				return errors.Join(ErrServerUnmarshalPacket, fmt.Errorf("chunk at %d of %d, %v", offset, size, err))
+			}
+
+			h.Write(data)
+			size += int64(len(data))
+			if w != nil {
+				if _, err := w.Write(data); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		trailer := protocol.Data{}
+		if err := frame.Decode(&trailer); err != nil || trailer.Type != protocol.FileChecksum {
+			return errors.Join(ErrServerInvalidPacketType, fmt.Errorf("expect %d(file checksum), %v", protocol.FileChecksum, err))
+		}
+
+		sum := protocol.FileChecksumPayload{}
+		if err := json.Unmarshal(trailer.Payload, &sum); err != nil {
+			return errors.Join(ErrServerUnmarshalPacket, err)
+		}
+		if sum.Size != size || sum.Sum != hex.EncodeToString(h.Sum(nil)) {
+			return errors.Join(ErrServerChecksum, fmt.Errorf("size %d/%d, sum %s", sum.Size, size, sum.Sum))
+		}
+		return nil
+	}
+}
+
+// conflictName
+// name of a conflict copy, <name>.conflict-<host>-<timestamp>. host is the
+// name sent by client or its address.
+func conflictName(name string, host string, conn net.Conn, t time.Time) string {
+	if host == "" {
+		host = conn.RemoteAddr().String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	host = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, host)
+
+	dir, base := filepath.Split(name)
+	return fmt.Sprintf("%s%s.conflict-%s-%s", dir, base, host, t.UTC().Format("20060102T150405Z"))
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filehandler"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	p, err := ParseConflictPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, ConflictServerWins, p)
+
+	p, err = ParseConflictPolicy("Keep-Both")
+	require.NoError(t, err)
+	require.Equal(t, ConflictKeepBoth, p)
+
+	_, err = ParseConflictPolicy("client-wins")
+	require.ErrorIs(t, err, ErrServerConflictPolicy)
+}
+
+func TestConflictName(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	require.Equal(t, "dir/a.txt.conflict-my_host-20240506T070809Z", conflictName("dir/a.txt", "my host", c1, at))
+	require.Equal(t, "a.txt.conflict-pipe-20240506T070809Z", conflictName("a.txt", "", c1, at))
+}
+
+// newSyncServer
+// server accepting pushes with given policy, its default share has a.txt.
+func newSyncServer(t *testing.T, policy ConflictPolicy) (*Server, *filehandler.Handler, string) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("server"), 0644))
+
+	lg := log.New(io.Discard, "", 0)
+	h, err := filehandler.NewHandler(dir, lg)
+	require.NoError(t, err)
+	return NewServer("", dir, nil, nil, lg, h, WithSync(policy)), h, dir
+}
+
+// pushTo
+// push a change to server, content of a write is streamed like client does.
+func pushTo(t *testing.T, s *Server, p protocol.PushFilePayload, content string) protocol.AckPushPayload {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+
+	type result struct {
+		ack protocol.AckPushPayload
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer srv.Close()
+		ack, err := s.push(srv, protocol.NewDecoder(srv), p, "")
+		done <- result{ack, err}
+	}()
+
+	if p.Op.Has(model.Write) {
+		enc := protocol.NewEncoder(cli)
+		require.NoError(t, enc.WriteChunk(0, []byte(content)))
+		sum := sha256.Sum256([]byte(content))
+		payload, _ := json.Marshal(protocol.FileChecksumPayload{Size: int64(len(content)), Sum: hex.EncodeToString(sum[:])})
+		require.NoError(t, enc.Encode(&protocol.Data{Type: protocol.FileChecksum, Payload: payload}))
+	}
+
+	r := <-done
+	require.NoError(t, r.err)
+	return r.ack
+}
+
+func serverHash(t *testing.T, h *filehandler.Handler, name string) string {
+	m, err := h.Stat(name)
+	require.NoError(t, err)
+	return m.Hash
+}
+
+func requireContent(t *testing.T, path string, content string) {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+}
+
+func TestServer_PushBase(t *testing.T) {
+	s, h, dir := newSyncServer(t, ConflictServerWins)
+
+	// client edited the server version.
+	ack := pushTo(t, s, protocol.PushFilePayload{FileName: "a.txt", Op: model.Write, Base: serverHash(t, h, "a.txt")}, "client")
+	require.True(t, ack.Ok)
+	require.False(t, ack.Conflict)
+	require.Equal(t, "a.txt", ack.Name)
+	requireContent(t, filepath.Join(dir, "a.txt"), "client")
+
+	// client edited an older version, server one is kept.
+	ack = pushTo(t, s, protocol.PushFilePayload{FileName: "a.txt", Op: model.Write, Base: "outdated"}, "other")
+	require.True(t, ack.Ok)
+	require.True(t, ack.Conflict)
+	require.Empty(t, ack.Name)
+	requireContent(t, filepath.Join(dir, "a.txt"), "client")
+
+	// removal of an older version, server one is kept.
+	ack = pushTo(t, s, protocol.PushFilePayload{FileName: "a.txt", Op: model.Remove, Base: "outdated"}, "")
+	require.True(t, ack.Conflict)
+	requireContent(t, filepath.Join(dir, "a.txt"), "client")
+
+	// new file is created, a client which didn't know a file conflicts.
+	ack = pushTo(t, s, protocol.PushFilePayload{FileName: "b.txt", Op: model.Write}, "new")
+	require.False(t, ack.Conflict)
+	requireContent(t, filepath.Join(dir, "b.txt"), "new")
+	ack = pushTo(t, s, protocol.PushFilePayload{FileName: "b.txt", Op: model.Write}, "unknown")
+	require.True(t, ack.Conflict)
+	requireContent(t, filepath.Join(dir, "b.txt"), "new")
+}
+
+func TestServer_PushNewestWins(t *testing.T) {
+	s, _, dir := newSyncServer(t, ConflictNewestWins)
+
+	ack := pushTo(t, s, protocol.PushFilePayload{FileName: "a.txt", Op: model.Write, Base: "outdated", ChangeDate: time.Now().Add(-time.Hour)}, "older")
+	require.True(t, ack.Conflict)
+	require.Empty(t, ack.Name)
+	requireContent(t, filepath.Join(dir, "a.txt"), "server")
+
+	ack = pushTo(t, s, protocol.PushFilePayload{FileName: "a.txt", Op: model.Write, Base: "outdated", ChangeDate: time.Now().Add(time.Hour)}, "newer")
+	require.True(t, ack.Conflict)
+	require.Equal(t, "a.txt", ack.Name)
+	requireContent(t, filepath.Join(dir, "a.txt"), "newer")
+}
+
+func TestServer_PushKeepBoth(t *testing.T) {
+	s, _, dir := newSyncServer(t, ConflictKeepBoth)
+
+	ack := pushTo(t, s, protocol.PushFilePayload{FileName: "a.txt", Op: model.Write, Base: "outdated", Host: "laptop"}, "client")
+	require.True(t, ack.Conflict)
+	require.True(t, strings.HasPrefix(ack.Name, "a.txt.conflict-laptop-"), ack.Name)
+	requireContent(t, filepath.Join(dir, "a.txt"), "server")
+	requireContent(t, filepath.Join(dir, ack.Name), "client")
+}
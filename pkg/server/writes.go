@@ -0,0 +1,94 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+)
+
+const (
+	writeDelay    = time.Millisecond * 100
+	writeMaxDelay = time.Second
+)
+
+// writeBatch
+// coalesce write events of files being written, so a growing file is stat and
+// hashed once it settles instead of on every write. pending writes are
+// published once no write arrived for delay, or maxDelay after the first one.
+// any other event publishes pending writes first, order of changes is kept.
+type writeBatch struct {
+	mu       sync.Mutex
+	delay    time.Duration
+	maxDelay time.Duration
+	publish  func(e model.Event)
+	pending  []model.Event
+	names    map[string]struct{}
+	first    time.Time
+	timer    *time.Timer
+}
+
+func newWriteBatch(delay time.Duration, maxDelay time.Duration, publish func(e model.Event)) *writeBatch {
+	return &writeBatch{
+		delay:    delay,
+		maxDelay: maxDelay,
+		publish:  publish,
+		names:    make(map[string]struct{}),
+	}
+}
+
+// write
+// queue a write event, a file already pending is published once.
+func (b *writeBatch) write(e model.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.delay <= 0 {
+		b.publish(e)
+		return
+	}
+
+	if _, ok := b.names[e.Name]; !ok {
+		b.names[e.Name] = struct{}{}
+		b.pending = append(b.pending, e)
+	}
+	if b.first.IsZero() {
+		b.first = time.Now()
+	}
+
+	wait := max(min(b.delay, b.maxDelay-time.Since(b.first)), 0)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(wait, b.flush)
+	} else {
+		b.timer.Reset(wait)
+	}
+}
+
+// event
+// publish pending writes and then given event.
+func (b *writeBatch) event(e model.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flushLocked()
+	b.publish(e)
+}
+
+func (b *writeBatch) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flushLocked()
+}
+
+func (b *writeBatch) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	for _, e := range b.pending {
+		b.publish(e)
+	}
+	b.pending = nil
+	b.names = make(map[string]struct{})
+	b.first = time.Time{}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	var mutex sync.Mutex
+	var published []model.Event
+	b := newWriteBatch(time.Millisecond*20, time.Second, func(e model.Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		published = append(published, e)
+	})
+	events := func() []model.Event {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]model.Event(nil), published...)
+	}
+
+	// writes of a file being written are published once it settles.
+	for range 5 {
+		b.write(model.Event{Name: "a", Op: model.Write})
+	}
+	b.write(model.Event{Name: "b", Op: model.Write})
+	require.Empty(t, events())
+	require.Eventually(t, func() bool { return len(events()) == 2 }, time.Second, time.Millisecond*5)
+	require.Equal(t, []model.Event{{Name: "a", Op: model.Write}, {Name: "b", Op: model.Write}}, events())
+
+	// other events publish pending writes first.
+	b.write(model.Event{Name: "c", Op: model.Write})
+	b.event(model.Event{Name: "c", Op: model.Remove})
+	require.Equal(t, []model.Event{{Name: "c", Op: model.Write}, {Name: "c", Op: model.Remove}}, events()[2:])
+
+	time.Sleep(time.Millisecond * 50)
+	require.Len(t, events(), 4)
+}
+
+func TestWriteBatch_MaxDelay(t *testing.T) {
+	published := make(chan model.Event, 16)
+	b := newWriteBatch(time.Millisecond*50, time.Millisecond*100, func(e model.Event) { published <- e })
+
+	// a file written without pause is published at the latest after max delay.
+	deadline := time.Now().Add(time.Millisecond * 400)
+	for time.Now().Before(deadline) && len(published) == 0 {
+		b.write(model.Event{Name: "a", Op: model.Write})
+		time.Sleep(time.Millisecond * 10)
+	}
+	require.NotEmpty(t, published)
+	b.flush()
+}
@@ -0,0 +1,122 @@
+package user
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Permission
+// access level of a user in the acl file.
+type Permission string
+
+const (
+	// PermissionReadOnly user can subscribe and download files.
+	PermissionReadOnly Permission = "ro"
+	// PermissionReadWrite user can push changes too.
+	PermissionReadWrite Permission = "rw"
+	// PermissionAdmin user has read-write access to every path and can
+	// manage the server.
+	PermissionAdmin Permission = "admin"
+)
+
+// DefaultACLUser
+// acl file entry applied to users which don't have their own entry.
+const DefaultACLUser = "*"
+
+var (
+	ErrAclFileContentFormat = errors.New("something is wrong with the acl file content format")
+)
+
+// ACL
+// permissions of a user. Paths are sub paths or glob patterns under served
+// roots the user can access, none means the whole root.
+type ACL struct {
+	Paths []string
+	Write bool
+	Admin bool
+}
+
+// ACL
+// permissions of given user, ok is false when user has no access at all.
+// without acl file every user has read-write access to the whole root.
+func (m *UserManager) ACL(username string) (acl ACL, ok bool) {
+	if m.AclFile == "" {
+		return ACL{Write: true}, true
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return lookupACL(m.acls, username)
+}
+
+func lookupACL(acls map[string]ACL, username string) (ACL, bool) {
+	a, ok := acls[username]
+	if !ok {
+		a, ok = acls[DefaultACLUser]
+	}
+	if !ok {
+		return ACL{}, false
+	}
+	return ACL{Paths: append([]string(nil), a.Paths...), Write: a.Write, Admin: a.Admin}, true
+}
+
+// loadACL
+// read acl file, each line is username:permission:paths where permission is
+// ro, rw or admin and paths is a comma separated list, empty for the whole
+// root. username * is the entry of users without their own one, users not
+// listed have no access. empty lines and lines starting with # are skipped.
+func loadACL(name string) (map[string]ACL, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acls := make(map[string]ACL)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, columnSep)
+		if len(fields) != 3 || fields[0] == "" {
+			subErr := fmt.Errorf("(len: %d, fields: %v)", len(fields), fields)
+			return nil, errors.Join(ErrAclFileContentFormat, subErr)
+		}
+
+		var acl ACL
+		switch Permission(fields[1]) {
+		case PermissionReadOnly:
+		case PermissionReadWrite:
+			acl.Write = true
+		case PermissionAdmin:
+			acl.Write, acl.Admin = true, true
+		default:
+			subErr := fmt.Errorf("user %q, permission %q", fields[0], fields[1])
+			return nil, errors.Join(ErrAclFileContentFormat, subErr)
+		}
+
+		for _, p := range strings.Split(fields[2], ",") {
+			if p = strings.TrimSpace(p); p != "" && !acl.Admin {
+				acl.Paths = append(acl.Paths, p)
+			}
+		}
+
+		if _, ok := acls[fields[0]]; ok {
+			subErr := fmt.Errorf("duplicated user %q", fields[0])
+			return nil, errors.Join(ErrAclFileContentFormat, subErr)
+		}
+		acls[fields[0]] = acl
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acls, nil
+}
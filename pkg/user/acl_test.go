@@ -0,0 +1,63 @@
+package user
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserManager_ACL(t *testing.T) {
+	dir := t.TempDir()
+	pwFile := filepath.Join(dir, "pw")
+	aclFile := filepath.Join(dir, "acl")
+	require.NoError(t, os.WriteFile(aclFile, []byte(
+		"# comment\n\nalice:admin:ignored\nbob:rw:team-a/, shared\ncarol:ro:\n"), 0600))
+
+	m := &UserManager{PwFile: pwFile, AclFile: aclFile}
+	require.NoError(t, m.Init())
+
+	acl, ok := m.ACL("alice")
+	require.True(t, ok)
+	require.Equal(t, ACL{Write: true, Admin: true}, acl)
+
+	acl, ok = m.ACL("bob")
+	require.True(t, ok)
+	require.Equal(t, ACL{Paths: []string{"team-a/", "shared"}, Write: true}, acl)
+
+	acl, ok = m.ACL("carol")
+	require.True(t, ok)
+	require.Equal(t, ACL{}, acl)
+
+	_, ok = m.ACL("dave")
+	require.False(t, ok, "users not listed have no access")
+
+	require.NoError(t, os.WriteFile(aclFile, []byte("*:ro:public\n"), 0600))
+	require.NoError(t, m.Init())
+	acl, ok = m.ACL("dave")
+	require.True(t, ok)
+	require.Equal(t, ACL{Paths: []string{"public"}}, acl)
+
+	none := &UserManager{PwFile: pwFile}
+	require.NoError(t, none.Init())
+	acl, ok = none.ACL("dave")
+	require.True(t, ok)
+	require.Equal(t, ACL{Write: true}, acl, "without acl file everyone has read-write access")
+}
+
+func TestUserManager_ACLFormat(t *testing.T) {
+	for _, content := range []string{
+		"bob:rw\n",
+		":rw:\n",
+		"bob:write:\n",
+		"bob:ro:\nbob:rw:\n",
+	} {
+		dir := t.TempDir()
+		aclFile := filepath.Join(dir, "acl")
+		require.NoError(t, os.WriteFile(aclFile, []byte(content), 0600))
+
+		m := &UserManager{PwFile: filepath.Join(dir, "pw"), AclFile: aclFile}
+		require.ErrorIs(t, m.Init(), ErrAclFileContentFormat, "content %q", content)
+	}
+}
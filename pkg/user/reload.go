@@ -0,0 +1,147 @@
+package user
+
+import (
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/watcher"
+)
+
+// reloadDelay
+// files are reloaded once no write was seen for this duration, so a file
+// being written is not read half way.
+const reloadDelay = time.Millisecond * 500
+
+// Reload
+// read password and acl files again and swap them in at once. users which
+// were deleted or locked get their sessions ended and tokens revoked, users
+// whose permissions changed get their sessions ended so clients log in again
+// with the new ones. returns users whose sessions were ended, on error the
+// current tables are kept.
+func (m *UserManager) Reload() ([]string, error) {
+	m.reload.Lock()
+	defer m.reload.Unlock()
+
+	// files are read under the lock of updatePwFile, so a change made by
+	// this process is not replaced with the table read before it.
+	m.mutex.Lock()
+	users, acls, err := m.load()
+	if err != nil {
+		m.mutex.Unlock()
+		return nil, err
+	}
+	oldUsers, oldAcls := m.users, m.acls
+	m.users, m.acls = users, acls
+	m.mutex.Unlock()
+
+	var ended []string
+	for username, hash := range oldUsers {
+		if strings.HasPrefix(hash, lockMark) {
+			continue // locked users have no sessions.
+		}
+
+		if current, ok := users[username]; !ok || strings.HasPrefix(current, lockMark) {
+			m.logout(username)
+			ended = append(ended, username)
+			continue
+		}
+
+		if m.AclFile != "" {
+			before, wasOk := lookupACL(oldAcls, username)
+			after, ok := lookupACL(acls, username)
+			if wasOk != ok || before.Write != after.Write || before.Admin != after.Admin || !slices.Equal(before.Paths, after.Paths) {
+				m.KillUserSessions(username)
+				ended = append(ended, username)
+			}
+		}
+	}
+
+	sort.Strings(ended)
+	return ended, nil
+}
+
+// WatchFiles
+// reload users whenever password or acl file is written, their directories
+// are watched with the project watcher and writes are reloaded once they
+// settle for reloadDelay. reloaded gets the result of every reload, returned
+// function stops watching.
+func (m *UserManager) WatchFiles(reloaded func(ended []string, err error)) (func(), error) {
+	files := map[string]struct{}{filepath.Clean(m.PwFile): {}}
+	if m.AclFile != "" {
+		files[filepath.Clean(m.AclFile)] = struct{}{}
+	}
+
+	dirs := make(map[string]struct{})
+	for f := range files {
+		dirs[filepath.Dir(f)] = struct{}{}
+	}
+
+	var mutex sync.Mutex
+	var timer *time.Timer
+	stopped := false
+
+	// files removed or renamed away are being replaced, they are reloaded
+	// once the new one is in place.
+	hook := func(e model.Event, err error) {
+		if err != nil {
+			reloaded(nil, err)
+			return
+		}
+		if !e.Op.Has(model.Write) && !e.Op.Has(model.Create) && !e.Op.Has(model.Move) {
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if stopped {
+			return
+		}
+		if timer != nil {
+			timer.Reset(reloadDelay)
+			return
+		}
+		timer = time.AfterFunc(reloadDelay, func() {
+			reloaded(m.Reload())
+		})
+	}
+
+	var watches []*watcher.Watcher
+	stop := func() {
+		for _, w := range watches {
+			w.Close()
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		stopped = true
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	for dir := range dirs {
+		w, err := watcher.NewWatcher(dir,
+			watcher.WithIgnore(func(name string) bool {
+				_, ok := files[filepath.Clean(name)]
+				return !ok
+			}),
+			watcher.WithCallbackFunction(hook))
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		watches = append(watches, w)
+	}
+	return stop, nil
+}
+
+// logout
+// end sessions of given user and revoke its tokens.
+func (m *UserManager) logout(username string) {
+	m.KillUserSessions(username)
+	m.RevokeUserTokens(username)
+}
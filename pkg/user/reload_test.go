@@ -0,0 +1,180 @@
+package user
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReloadManager
+// user manager with users alice, bob, carol and dave, each with an open
+// session and a token.
+func newReloadManager(t *testing.T) (*UserManager, map[string]*closer, map[string]string) {
+	dir := t.TempDir()
+	um := &UserManager{PwFile: filepath.Join(dir, "pwfile"), AclFile: filepath.Join(dir, "acl")}
+	require.NoError(t, os.WriteFile(um.PwFile, nil, pwFileMode))
+	require.NoError(t, os.WriteFile(um.AclFile, []byte("*:ro:\n"), pwFileMode))
+	require.NoError(t, um.Init())
+
+	conns := make(map[string]*closer)
+	tokens := make(map[string]string)
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		require.NoError(t, um.CreateUser(&Creadential{Username: name, Password: "secret"}))
+
+		conns[name] = &closer{}
+		s, err := um.OpenSession(name, "127.0.0.1", "", conns[name])
+		require.NoError(t, err)
+		tokens[name], _, err = um.IssueToken(name, s.Id)
+		require.NoError(t, err)
+	}
+	return um, conns, tokens
+}
+
+func TestUserManager_Reload(t *testing.T) {
+	um, conns, tokens := newReloadManager(t)
+
+	// another process deletes bob, locks carol and gives dave write access.
+	other := &UserManager{PwFile: um.PwFile}
+	require.NoError(t, other.Init())
+	require.NoError(t, other.DeleteUser("bob"))
+	require.NoError(t, other.Lock("carol"))
+	require.NoError(t, other.CreateUser(&Creadential{Username: "erin", Password: "secret"}))
+	require.NoError(t, os.WriteFile(um.AclFile, []byte("dave:rw:\n*:ro:\n"), pwFileMode))
+
+	ended, err := um.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob", "carol", "dave"}, ended)
+
+	assert.False(t, conns["alice"].closed.Load())
+	for _, name := range ended {
+		assert.True(t, conns[name].closed.Load(), name)
+	}
+
+	_, _, err = um.CheckToken(tokens["alice"])
+	assert.NoError(t, err)
+	_, _, err = um.CheckToken(tokens["bob"])
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+	_, _, err = um.CheckToken(tokens["carol"])
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+
+	// permission change ends sessions only, client logs in again.
+	_, _, err = um.CheckToken(tokens["dave"])
+	assert.NoError(t, err)
+	acl, ok := um.ACL("dave")
+	assert.True(t, ok)
+	assert.True(t, acl.Write)
+
+	assert.True(t, um.Active("erin"))
+	assert.True(t, um.CheckUserPassword("erin", "secret"))
+}
+
+func TestUserManager_ReloadInvalid(t *testing.T) {
+	um, conns, _ := newReloadManager(t)
+
+	require.NoError(t, os.WriteFile(um.PwFile, []byte("broken\n"), pwFileMode))
+	_, err := um.Reload()
+	require.ErrorIs(t, err, ErrPwFileContentFormat)
+
+	require.NoError(t, os.Remove(um.PwFile))
+	_, err = um.Reload()
+	require.Error(t, err, "missing password file is not an empty one")
+
+	// current users are kept.
+	assert.Len(t, um.Users(), 4)
+	for name, c := range conns {
+		assert.False(t, c.closed.Load(), name)
+	}
+}
+
+func TestUserManager_ReloadEmpty(t *testing.T) {
+	um, conns, tokens := newReloadManager(t)
+
+	// every user is deleted.
+	require.NoError(t, os.WriteFile(um.PwFile, nil, pwFileMode))
+	ended, err := um.Reload()
+	require.NoError(t, err)
+	assert.Len(t, ended, len(conns))
+	assert.Empty(t, um.Users())
+	for name, c := range conns {
+		assert.True(t, c.closed.Load(), name)
+		_, _, err := um.CheckToken(tokens[name])
+		assert.Error(t, err, name)
+	}
+}
+
+func TestUserManager_WatchFiles(t *testing.T) {
+	um, conns, _ := newReloadManager(t)
+
+	var mutex sync.Mutex
+	var ended []string
+	stop, err := um.WatchFiles(func(e []string, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err == nil {
+			ended = append(ended, e...)
+		}
+	})
+	require.NoError(t, err)
+	defer stop()
+
+	other := &UserManager{PwFile: um.PwFile}
+	require.NoError(t, other.Init())
+	require.NoError(t, other.DeleteUser("bob"))
+
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(ended) == 1 && ended[0] == "bob"
+	}, time.Second*5, time.Millisecond*20, "deletion is not reloaded")
+	assert.True(t, conns["bob"].closed.Load())
+	assert.False(t, um.HasUser("bob"))
+}
+
+func TestUserManager_WatchFilesSettle(t *testing.T) {
+	um, conns, _ := newReloadManager(t)
+	content, err := os.ReadFile(um.PwFile)
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	var reloads [][]string
+	stop, err := um.WatchFiles(func(e []string, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.NoError(t, err)
+		reloads = append(reloads, e)
+	})
+	require.NoError(t, err)
+	defer stop()
+
+	// an editor truncates the file and writes it again, without bob.
+	f, err := os.OpenFile(um.PwFile, os.O_WRONLY|os.O_TRUNC, pwFileMode)
+	require.NoError(t, err)
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if !strings.HasPrefix(line, "bob:") {
+			_, err = f.WriteString(line)
+			require.NoError(t, err)
+			require.NoError(t, f.Sync())
+		}
+	}
+	require.NoError(t, f.Close())
+
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(reloads) > 0
+	}, time.Second*5, time.Millisecond*20, "write is not reloaded")
+	time.Sleep(reloadDelay * 2)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, [][]string{{"bob"}}, reloads, "writes are reloaded once")
+	for name, c := range conns {
+		assert.Equal(t, name == "bob", c.closed.Load(), name)
+	}
+}
@@ -0,0 +1,234 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	ErrScramVerifierFormat = errors.New("invalid SCRAM verifier")
+	ErrSaltKeyFormat       = errors.New("invalid salt key file")
+)
+
+// ScramMinIterations, ScramMaxIterations
+// iteration counts a verifier may have, clients refuse challenges out of
+// range: few iterations make a stolen verifier cheap to crack, too many make
+// the client hash for ever.
+const (
+	ScramMinIterations = 4096
+	ScramMaxIterations = 10_000_000
+)
+
+const (
+	scramPrefix     = "scram-sha-256"
+	scramIterations = 65536
+	scramSaltSize   = 16
+	saltKeySize     = 32
+	saltKeySuffix   = ".salt" // salt key file is next to password file
+)
+
+// scramVerifier
+// salted keys of a password as stored in password file, a login proves
+// knowledge of the password against them without sending it.
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func newScramVerifier(password string) (scramVerifier, error) {
+	salt := make([]byte, scramSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return scramVerifier{}, err
+	}
+	return scramVerifierFrom(password, salt, scramIterations), nil
+}
+
+func scramVerifierFrom(password string, salt []byte, iterations int) scramVerifier {
+	_, storedKey, serverKey := scramKeys(password, salt, iterations)
+	return scramVerifier{iterations: iterations, salt: salt, storedKey: storedKey, serverKey: serverKey}
+}
+
+// String
+// password file form, scram-sha-256$iterations$salt$stored key$server key
+// with base64 fields.
+func (v scramVerifier) String() string {
+	enc := base64.StdEncoding.EncodeToString
+	return strings.Join([]string{scramPrefix, strconv.Itoa(v.iterations), enc(v.salt), enc(v.storedKey), enc(v.serverKey)}, "$")
+}
+
+func isScram(hash string) bool {
+	return strings.HasPrefix(hash, scramPrefix+"$")
+}
+
+func parseScramVerifier(s string) (scramVerifier, error) {
+	fields := strings.Split(s, "$")
+	if len(fields) != 5 || fields[0] != scramPrefix {
+		return scramVerifier{}, errors.Join(ErrScramVerifierFormat, fmt.Errorf("%d fields", len(fields)))
+	}
+
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < ScramMinIterations || iterations > ScramMaxIterations {
+		return scramVerifier{}, errors.Join(ErrScramVerifierFormat, fmt.Errorf("iterations %q", fields[1]))
+	}
+
+	var keys [3][]byte
+	for i := range keys {
+		keys[i], err = base64.StdEncoding.DecodeString(fields[i+2])
+		if err != nil {
+			return scramVerifier{}, errors.Join(ErrScramVerifierFormat, err)
+		}
+	}
+	if len(keys[1]) != sha256.Size || len(keys[2]) != sha256.Size {
+		return scramVerifier{}, errors.Join(ErrScramVerifierFormat, errors.New("invalid key size"))
+	}
+
+	return scramVerifier{iterations: iterations, salt: keys[0], storedKey: keys[1], serverKey: keys[2]}, nil
+}
+
+// ScramLogin
+// server side of a SCRAM-SHA-256 login, started from client username and
+// nonce by StartScram and completed with client proof by FinishScram. Legacy
+// logins are of users with a bcrypt hash from before SCRAM, client sends the
+// password once and a verifier replaces the hash.
+type ScramLogin struct {
+	Username   string
+	Nonce      string // client nonce followed by server nonce
+	Salt       []byte
+	Iterations int
+	Legacy     bool
+
+	clientNonce string
+	verifier    scramVerifier
+	known       bool
+}
+
+// StartScram
+// challenge of a login, unknown and locked users get a made up one which is
+// the same on every attempt and after a restart, so challenges don't tell
+// which users exist. users from before SCRAM get a made up one too, unless
+// connection is secure (tls) or Cleartext is set: they are then asked for
+// their password in clear, which tells they exist, so Cleartext should only
+// be set while they migrate.
+func (m *UserManager) StartScram(username string, clientNonce string, secure bool) (*ScramLogin, error) {
+	nonce, err := ScramNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &ScramLogin{Username: username, Nonce: clientNonce + nonce, clientNonce: clientNonce}
+	if hash, ok := m.hash(username); ok && !strings.HasPrefix(hash, lockMark) {
+		if isScram(hash) {
+			if v, err := parseScramVerifier(hash); err == nil {
+				l.verifier, l.known = v, true
+			}
+		} else if secure || m.Cleartext {
+			l.Legacy = true
+			return l, nil
+		}
+	}
+
+	if !l.known {
+		mac := hmac.New(sha256.New, m.saltKey)
+		mac.Write([]byte(username))
+		l.verifier = scramVerifier{iterations: scramIterations, salt: mac.Sum(nil)[:scramSaltSize]}
+	}
+
+	l.Salt, l.Iterations = l.verifier.salt, l.verifier.iterations
+	return l, nil
+}
+
+// loadSaltKey
+// key of made up challenges, created on first use. it is kept in a file so
+// made up salts don't change on restart while real ones stay, and it is
+// secret so made up salts can't be computed by clients.
+func loadSaltKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != saltKeySize {
+			return nil, errors.Join(ErrSaltKeyFormat, fmt.Errorf("%s has %d bytes", path, len(key)))
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, saltKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key, pwFileMode)
+}
+
+// FinishScram
+// check client proof of a login, returns server signature which proves to
+// client that server holds the verifier of its password.
+func (m *UserManager) FinishScram(l *ScramLogin, nonce string, proof []byte) ([]byte, bool) {
+	if !l.known || l.Legacy || nonce != l.Nonce || len(proof) != sha256.Size {
+		return nil, false
+	}
+
+	msg := ScramAuthMessage(l.Username, l.clientNonce, l.Nonce, l.Salt, l.Iterations)
+	clientKey := xorBytes(proof, hmacSHA256(l.verifier.storedKey, msg))
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], l.verifier.storedKey) {
+		return nil, false
+	}
+	return hmacSHA256(l.verifier.serverKey, msg), true
+}
+
+// ScramNonce
+// random nonce of a login.
+func ScramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ScramAuthMessage
+// messages of a login both sides sign, in RFC 5802 form.
+func ScramAuthMessage(username string, clientNonce string, nonce string, salt []byte, iterations int) []byte {
+	return []byte(fmt.Sprintf("n=%s,r=%s,r=%s,s=%s,i=%d,c=biws,r=%s",
+		username, clientNonce, nonce, base64.StdEncoding.EncodeToString(salt), iterations, nonce))
+}
+
+// ScramProof
+// client proof of a login and the server signature client should receive.
+func ScramProof(password string, salt []byte, iterations int, authMessage []byte) (proof []byte, signature []byte) {
+	clientKey, storedKey, serverKey := scramKeys(password, salt, iterations)
+	return xorBytes(clientKey, hmacSHA256(storedKey, authMessage)), hmacSHA256(serverKey, authMessage)
+}
+
+func scramKeys(password string, salt []byte, iterations int) (clientKey, storedKey, serverKey []byte) {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey = hmacSHA256(salted, []byte("Client Key"))
+	stored := sha256.Sum256(clientKey)
+	return clientKey, stored[:], hmacSHA256(salted, []byte("Server Key"))
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
@@ -0,0 +1,186 @@
+package user
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newScramManager(t *testing.T, lines ...string) *UserManager {
+	pwFile := filepath.Join(t.TempDir(), "pwfile")
+	require.NoError(t, os.WriteFile(pwFile, []byte(strings.Join(lines, "\n")+"\n"), pwFileMode))
+
+	um := &UserManager{PwFile: pwFile}
+	require.NoError(t, um.Init())
+	return um
+}
+
+// scramLogin
+// client side of a login, returns whether server accepted the proof and
+// whether its signature matches.
+func scramLogin(t *testing.T, um *UserManager, username, password string) (bool, bool) {
+	clientNonce, err := ScramNonce()
+	require.NoError(t, err)
+
+	l, err := um.StartScram(username, clientNonce, false)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(l.Nonce, clientNonce))
+
+	msg := ScramAuthMessage(username, clientNonce, l.Nonce, l.Salt, l.Iterations)
+	proof, expected := ScramProof(password, l.Salt, l.Iterations, msg)
+	signature, ok := um.FinishScram(l, l.Nonce, proof)
+	return ok, ok && string(signature) == string(expected)
+}
+
+func TestUserManager_Scram(t *testing.T) {
+	v, err := newScramVerifier("secret")
+	require.NoError(t, err)
+	um := newScramManager(t, "user1:"+v.String())
+
+	ok, signed := scramLogin(t, um, "user1", "secret")
+	assert.True(t, ok)
+	assert.True(t, signed)
+
+	ok, _ = scramLogin(t, um, "user1", "wrong")
+	assert.False(t, ok)
+
+	ok, _ = scramLogin(t, um, "nobody", "secret")
+	assert.False(t, ok)
+
+	assert.True(t, um.CheckUserPassword("user1", "secret"))
+	assert.False(t, um.CheckUserPassword("user1", "wrong"))
+}
+
+func TestUserManager_ScramReplay(t *testing.T) {
+	v, err := newScramVerifier("secret")
+	require.NoError(t, err)
+	um := newScramManager(t, "user1:"+v.String())
+
+	first, err := um.StartScram("user1", "client", false)
+	require.NoError(t, err)
+	msg := ScramAuthMessage("user1", "client", first.Nonce, first.Salt, first.Iterations)
+	proof, _ := ScramProof("secret", first.Salt, first.Iterations, msg)
+
+	// proof of an observed login doesn't answer another challenge.
+	second, err := um.StartScram("user1", "client", false)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Nonce, second.Nonce)
+	_, ok := um.FinishScram(second, second.Nonce, proof)
+	assert.False(t, ok)
+	_, ok = um.FinishScram(second, first.Nonce, proof)
+	assert.False(t, ok)
+}
+
+func TestUserManager_ScramUnknownUser(t *testing.T) {
+	v, err := newScramVerifier("secret")
+	require.NoError(t, err)
+	um := newScramManager(t, "user1:"+v.String())
+
+	a, err := um.StartScram("nobody", "client", false)
+	require.NoError(t, err)
+	b, err := um.StartScram("nobody", "client", false)
+	require.NoError(t, err)
+
+	assert.False(t, a.Legacy)
+	assert.Equal(t, a.Salt, b.Salt)
+	assert.Equal(t, a.Iterations, b.Iterations)
+	assert.NotEqual(t, v.salt, a.Salt)
+}
+
+func TestUserManager_ScramMigration(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	um := newScramManager(t, "user1:"+string(hash), "user2:"+string(hash))
+	um.Cleartext = true
+
+	l, err := um.StartScram("user1", "client", false)
+	require.NoError(t, err)
+	assert.True(t, l.Legacy)
+
+	assert.False(t, um.CheckUserPassword("user1", "wrong"))
+	assert.True(t, um.CheckUserPassword("user1", "secret"))
+
+	content, err := os.ReadFile(um.PwFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "user1:"+scramPrefix+"$")
+	assert.Contains(t, string(content), "user2:"+string(hash))
+
+	ok, signed := scramLogin(t, um, "user1", "secret")
+	assert.True(t, ok)
+	assert.True(t, signed)
+
+	// migrated verifier survives a restart.
+	require.NoError(t, um.Init())
+	ok, _ = scramLogin(t, um, "user1", "secret")
+	assert.True(t, ok)
+}
+
+func TestUserManager_ScramHiddenUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	um := newScramManager(t, "legacy:"+string(hash), "locked:"+lockMark+string(hash))
+
+	// without cleartext, users from before SCRAM look like unknown ones.
+	for _, name := range []string{"legacy", "locked", "nobody"} {
+		l, err := um.StartScram(name, "client", false)
+		require.NoError(t, err)
+		assert.False(t, l.Legacy, name)
+		assert.Equal(t, scramIterations, l.Iterations, name)
+		assert.Len(t, l.Salt, scramSaltSize, name)
+
+		ok, _ := scramLogin(t, um, name, "secret")
+		assert.False(t, ok, name)
+	}
+
+	// over tls password is asked for, it isn't seen on the wire.
+	l, err := um.StartScram("legacy", "client", true)
+	require.NoError(t, err)
+	assert.True(t, l.Legacy)
+	for _, name := range []string{"locked", "nobody"} {
+		l, err := um.StartScram(name, "client", true)
+		require.NoError(t, err)
+		assert.False(t, l.Legacy, name)
+	}
+
+	// made up salts don't change on restart.
+	before, err := um.StartScram("nobody", "client", false)
+	require.NoError(t, err)
+	other := &UserManager{PwFile: um.PwFile}
+	require.NoError(t, other.Init())
+	after, err := other.StartScram("nobody", "client", false)
+	require.NoError(t, err)
+	assert.Equal(t, before.Salt, after.Salt)
+
+	require.NoError(t, os.WriteFile(um.PwFile+saltKeySuffix, []byte("short"), pwFileMode))
+	err = (&UserManager{PwFile: um.PwFile}).Init()
+	assert.ErrorIs(t, err, ErrSaltKeyFormat)
+}
+
+func TestParseScramVerifier(t *testing.T) {
+	v, err := newScramVerifier("secret")
+	require.NoError(t, err)
+
+	parsed, err := parseScramVerifier(v.String())
+	require.NoError(t, err)
+	assert.Equal(t, v, parsed)
+	assert.NotContains(t, v.String(), columnSep)
+
+	for _, s := range []string{
+		"",
+		"scram-sha-256$4096$c2FsdA==",
+		"scram-sha-256$x$c2FsdA==$a2V5$a2V5",
+		"scram-sha-256$4096$c2FsdA==$a2V5$a2V5",
+		"other$4096$c2FsdA==$a2V5$a2V5",
+		strings.Replace(v.String(), fmt.Sprintf("$%d$", scramIterations), "$1$", 1),
+		strings.Replace(v.String(), fmt.Sprintf("$%d$", scramIterations), "$100000000$", 1),
+	} {
+		_, err := parseScramVerifier(s)
+		assert.ErrorIs(t, err, ErrScramVerifierFormat, s)
+	}
+}
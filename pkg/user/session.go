@@ -0,0 +1,213 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManySessions = errors.New("too many sessions")
+	ErrUnknownSession  = errors.New("unknown session")
+	ErrSessionKilled   = errors.New("session was killed")
+)
+
+// killedRetention
+// how long killed sessions are remembered, a client continuing one within it
+// is refused.
+const killedRetention = 24 * time.Hour
+
+// Session
+// a logged in client. its subscription and transfer connections join the
+// same session, session ends when its last connection leaves or it is killed.
+type Session struct {
+	Id       string
+	Username string
+	Addr     string
+	Started  time.Time
+	Conns    int
+}
+
+type session struct {
+	Session
+	conns map[io.Closer]struct{}
+}
+
+type sessions struct {
+	byId   map[string]*session
+	killed map[string]time.Time // keys: session id / values: kill time
+	mutex  sync.Mutex
+}
+
+// OpenSession
+// register a new session of an authenticated user with given connection,
+// connection is closed when session is killed. previous session of a client
+// logging in again is replaced, its connections are closed and it doesn't
+// count. fails when user already has MaxSessions sessions.
+func (m *UserManager) OpenSession(username string, addr string, previous string, conn io.Closer) (Session, error) {
+	var stale *session
+	defer func() {
+		if stale != nil {
+			stale.close()
+		}
+	}()
+	m.sessions.mutex.Lock()
+	defer m.sessions.mutex.Unlock()
+
+	if s, ok := m.sessions.byId[previous]; ok && s.Username == username {
+		stale = s
+		delete(m.sessions.byId, previous)
+	}
+
+	if m.MaxSessions > 0 {
+		n := 0
+		for _, s := range m.sessions.byId {
+			if s.Username == username {
+				n++
+			}
+		}
+		if n >= m.MaxSessions {
+			return Session{}, errors.Join(ErrTooManySessions, fmt.Errorf("user %q has %d sessions", username, n))
+		}
+	}
+
+	id, err := newSessionId()
+	if err != nil {
+		return Session{}, err
+	}
+
+	s := &session{
+		Session: Session{Id: id, Username: username, Addr: addr, Started: time.Now(), Conns: 1},
+		conns:   map[io.Closer]struct{}{conn: {}},
+	}
+	m.sessions.byId[id] = s
+	return s.Session, nil
+}
+
+// JoinSession
+// attach another connection of the same user to an open session.
+func (m *UserManager) JoinSession(id string, username string, conn io.Closer) (Session, error) {
+	m.sessions.mutex.Lock()
+	defer m.sessions.mutex.Unlock()
+
+	s, ok := m.sessions.byId[id]
+	if !ok || s.Username != username {
+		return Session{}, errors.Join(ErrUnknownSession, fmt.Errorf("session %q", id))
+	}
+
+	s.conns[conn] = struct{}{}
+	s.Conns = len(s.conns)
+	return s.Session, nil
+}
+
+// LeaveSession
+// detach a closed connection, session ends with its last connection.
+func (m *UserManager) LeaveSession(id string, conn io.Closer) {
+	m.sessions.mutex.Lock()
+	defer m.sessions.mutex.Unlock()
+
+	s, ok := m.sessions.byId[id]
+	if !ok {
+		return
+	}
+
+	delete(s.conns, conn)
+	s.Conns = len(s.conns)
+	if s.Conns == 0 {
+		delete(m.sessions.byId, id)
+	}
+}
+
+// Sessions
+// open sessions, oldest first.
+func (m *UserManager) Sessions() []Session {
+	m.sessions.mutex.Lock()
+	defer m.sessions.mutex.Unlock()
+
+	list := make([]Session, 0, len(m.sessions.byId))
+	for _, s := range m.sessions.byId {
+		list = append(list, s.Session)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// KillSession
+// end given session and close all its connections. its tokens join nothing
+// anymore and a client continuing it is refused, see Killed.
+func (m *UserManager) KillSession(id string) error {
+	m.sessions.mutex.Lock()
+	s, ok := m.sessions.byId[id]
+	delete(m.sessions.byId, id)
+	if ok {
+		now := time.Now()
+		for k, at := range m.sessions.killed {
+			if now.Sub(at) > killedRetention {
+				delete(m.sessions.killed, k)
+			}
+		}
+		m.sessions.killed[id] = now
+	}
+	m.sessions.mutex.Unlock()
+
+	if !ok {
+		return errors.Join(ErrUnknownSession, fmt.Errorf("session %q", id))
+	}
+
+	s.close()
+	return nil
+}
+
+// Killed
+// check whether given session was killed, a client logging in again after
+// its session was killed names it as previous session.
+func (m *UserManager) Killed(id string) bool {
+	m.sessions.mutex.Lock()
+	defer m.sessions.mutex.Unlock()
+
+	at, ok := m.sessions.killed[id]
+	return ok && time.Since(at) <= killedRetention
+}
+
+// KillUserSessions
+// end every session of given user, returns number of killed sessions.
+func (m *UserManager) KillUserSessions(username string) int {
+	m.sessions.mutex.Lock()
+	var killed []*session
+	for id, s := range m.sessions.byId {
+		if s.Username == username {
+			killed = append(killed, s)
+			delete(m.sessions.byId, id)
+		}
+	}
+	m.sessions.mutex.Unlock()
+
+	for _, s := range killed {
+		s.close()
+	}
+	return len(killed)
+}
+
+// close
+// close session connections, called without holding sessions lock as
+// connection handlers leave the session when they see the close.
+func (s *session) close() {
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+func newSessionId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,143 @@
+package user
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closer struct {
+	closed atomic.Bool
+}
+
+func (c *closer) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func newSessionManager(max int) *UserManager {
+	return &UserManager{MaxSessions: max, sessions: &sessions{byId: make(map[string]*session), killed: make(map[string]time.Time)}}
+}
+
+func TestUserManager_OpenSession(t *testing.T) {
+	um := newSessionManager(2)
+
+	s1, err := um.OpenSession("user1", "192.168.1.1", "", &closer{})
+	require.NoError(t, err)
+	s2, err := um.OpenSession("user1", "192.168.1.2", "", &closer{})
+	require.NoError(t, err, "sessions from other machines are allowed")
+	require.NotEqual(t, s1.Id, s2.Id)
+
+	_, err = um.OpenSession("user1", "192.168.1.3", "", &closer{})
+	require.ErrorIs(t, err, ErrTooManySessions)
+
+	_, err = um.OpenSession("user2", "192.168.1.3", "", &closer{})
+	require.NoError(t, err, "limit is per user")
+
+	list := um.Sessions()
+	require.Len(t, list, 3)
+	assert.Equal(t, s1.Id, list[0].Id, "oldest first")
+}
+
+func TestUserManager_OpenSessionPrevious(t *testing.T) {
+	um := newSessionManager(1)
+
+	stale := &closer{}
+	s1, err := um.OpenSession("user1", "192.168.1.1", "", stale)
+	require.NoError(t, err)
+
+	// client reconnects before server saw its connection close.
+	s2, err := um.OpenSession("user1", "192.168.1.1", s1.Id, &closer{})
+	require.NoError(t, err, "previous session doesn't count")
+	assert.True(t, stale.closed.Load())
+	assert.False(t, um.Killed(s1.Id), "replaced, not killed")
+
+	_, err = um.OpenSession("user2", "192.168.1.2", s2.Id, &closer{})
+	require.NoError(t, err)
+	require.Len(t, um.Sessions(), 2, "session of another user is kept")
+
+	_, err = um.OpenSession("user1", "192.168.1.3", "", &closer{})
+	require.ErrorIs(t, err, ErrTooManySessions)
+}
+
+func TestUserManager_JoinSession(t *testing.T) {
+	um := newSessionManager(1)
+
+	main, transfer := &closer{}, &closer{}
+	s, err := um.OpenSession("user1", "192.168.1.1", "", main)
+	require.NoError(t, err)
+
+	joined, err := um.JoinSession(s.Id, "user1", transfer)
+	require.NoError(t, err, "transfer connections don't count as sessions")
+	assert.Equal(t, 2, joined.Conns)
+
+	_, err = um.JoinSession(s.Id, "user2", &closer{})
+	require.ErrorIs(t, err, ErrUnknownSession, "session of another user")
+	_, err = um.JoinSession("missing", "user1", &closer{})
+	require.ErrorIs(t, err, ErrUnknownSession)
+
+	um.LeaveSession(s.Id, main)
+	require.Len(t, um.Sessions(), 1, "session lives while it has connections")
+	um.LeaveSession(s.Id, transfer)
+	require.Empty(t, um.Sessions())
+
+	// unknown session and connection, should not panic.
+	um.LeaveSession(s.Id, transfer)
+}
+
+func TestUserManager_KillSession(t *testing.T) {
+	um := newSessionManager(0)
+
+	main, transfer, other := &closer{}, &closer{}, &closer{}
+	s, err := um.OpenSession("user1", "192.168.1.1", "", main)
+	require.NoError(t, err)
+	_, err = um.JoinSession(s.Id, "user1", transfer)
+	require.NoError(t, err)
+	_, err = um.OpenSession("user2", "192.168.1.2", "", other)
+	require.NoError(t, err)
+
+	require.False(t, um.Killed(s.Id))
+	require.NoError(t, um.KillSession(s.Id))
+	require.True(t, um.Killed(s.Id))
+	assert.True(t, main.closed.Load())
+	assert.True(t, transfer.closed.Load())
+	assert.False(t, other.closed.Load())
+	require.ErrorIs(t, um.KillSession(s.Id), ErrUnknownSession)
+
+	// sessions of deleted or changed users log in again.
+	assert.Equal(t, 1, um.KillUserSessions("user2"))
+	assert.True(t, other.closed.Load())
+	assert.Len(t, um.sessions.killed, 1)
+	assert.Empty(t, um.Sessions())
+}
+
+// Test concurrent access to sessions
+func TestUserManager_ConcurrentSessions(t *testing.T) {
+	um := newSessionManager(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c := &closer{}
+				s, err := um.OpenSession("user1", "192.168.1.1", "", c)
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, _ = um.JoinSession(s.Id, "user1", &closer{})
+				_ = um.Sessions()
+				um.LeaveSession(s.Id, c)
+				_ = um.KillSession(s.Id)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Empty(t, um.Sessions())
+}
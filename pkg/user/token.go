@@ -0,0 +1,141 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTokenTTL
+// lifetime of session tokens when TokenTTL is not set.
+const DefaultTokenTTL = time.Hour
+
+var (
+	ErrInvalidToken = errors.New("invalid session token")
+	ErrTokenExpired = errors.New("session token expired")
+	ErrTokenRevoked = errors.New("session token revoked")
+)
+
+// tokenClaims
+// content of a session token, it is signed with HMAC-SHA256 of token key.
+type tokenClaims struct {
+	Id       string `json:"id"`
+	Username string `json:"u"`
+	Session  string `json:"s"`
+	Issued   int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+type tokens struct {
+	key           []byte
+	revokedBefore map[string]time.Time // keys: username / values: tokens issued before are revoked
+	mutex         sync.Mutex
+}
+
+func newTokens(key []byte) (*tokens, error) {
+	if len(key) == 0 {
+		// tokens don't survive a restart, clients log in again with password.
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tokens{
+		key:           key,
+		revokedBefore: make(map[string]time.Time),
+	}, nil
+}
+
+// IssueToken
+// signed token of given session, connections presenting it join the session
+// without a password check until it expires.
+func (m *UserManager) IssueToken(username string, session string) (string, time.Time, error) {
+	ttl := m.TokenTTL
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+
+	id, err := newSessionId()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	claims, _ := json.Marshal(tokenClaims{
+		Id:       id,
+		Username: username,
+		Session:  session,
+		Issued:   now.UnixNano(),
+		Expires:  now.Add(ttl).Unix(),
+	})
+
+	body := base64.RawURLEncoding.EncodeToString(claims)
+	return body + "." + m.tokens.sign(body), time.Unix(now.Add(ttl).Unix(), 0), nil
+}
+
+// CheckToken
+// verify signature, expiry and revocation of a token, returns its user and
+// session. token of a user which no longer exists or is locked is invalid.
+func (m *UserManager) CheckToken(token string) (username string, session string, err error) {
+	claims, err := m.tokens.parse(token)
+	if err != nil {
+		return "", "", err
+	}
+
+	if time.Now().Unix() >= claims.Expires {
+		return "", "", errors.Join(ErrTokenExpired, fmt.Errorf("user %q", claims.Username))
+	}
+
+	m.tokens.mutex.Lock()
+	before, ok := m.tokens.revokedBefore[claims.Username]
+	m.tokens.mutex.Unlock()
+	if ok && claims.Issued < before.UnixNano() {
+		return "", "", errors.Join(ErrTokenRevoked, fmt.Errorf("user %q", claims.Username))
+	}
+
+	if !m.Active(claims.Username) {
+		return "", "", errors.Join(ErrInvalidToken, fmt.Errorf("unknown or locked user %q", claims.Username))
+	}
+	return claims.Username, claims.Session, nil
+}
+
+// RevokeUserTokens
+// reject every token issued to given user until now.
+func (m *UserManager) RevokeUserTokens(username string) {
+	m.tokens.mutex.Lock()
+	defer m.tokens.mutex.Unlock()
+
+	m.tokens.revokedBefore[username] = time.Now()
+}
+
+func (t *tokens) sign(body string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (t *tokens) parse(token string) (tokenClaims, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(t.sign(body))) {
+		return tokenClaims{}, ErrInvalidToken
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return tokenClaims{}, errors.Join(ErrInvalidToken, err)
+	}
+
+	claims := tokenClaims{}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return tokenClaims{}, errors.Join(ErrInvalidToken, err)
+	}
+	return claims, nil
+}
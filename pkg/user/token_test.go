@@ -0,0 +1,86 @@
+package user
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTokenManager(t *testing.T, ttl time.Duration) *UserManager {
+	tk, err := newTokens(nil)
+	require.NoError(t, err)
+	return &UserManager{
+		TokenTTL: ttl,
+		users:    map[string]string{"user1": "hash1", "user2": "hash2"},
+		tokens:   tk,
+	}
+}
+
+func TestUserManager_IssueToken(t *testing.T) {
+	um := newTokenManager(t, 0)
+
+	token, expires, err := um.IssueToken("user1", "session1")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(DefaultTokenTTL), expires, time.Second*2)
+
+	username, session, err := um.CheckToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", username)
+	assert.Equal(t, "session1", session)
+
+	// tampered claims or signature.
+	body, sig, _ := strings.Cut(token, ".")
+	_, _, err = um.CheckToken(body + "x." + sig)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, _, err = um.CheckToken(body + "." + sig[1:])
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, _, err = um.CheckToken("garbage")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// signed by another server.
+	other := newTokenManager(t, 0)
+	_, _, err = other.CheckToken(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	delete(um.users, "user1")
+	_, _, err = um.CheckToken(token)
+	assert.ErrorIs(t, err, ErrInvalidToken, "user doesn't exist anymore")
+}
+
+func TestUserManager_TokenExpired(t *testing.T) {
+	um := newTokenManager(t, time.Second)
+
+	token, _, err := um.IssueToken("user1", "session1")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, _, err := um.CheckToken(token)
+		return err != nil
+	}, time.Second*3, time.Millisecond*100)
+
+	_, _, err = um.CheckToken(token)
+	assert.ErrorIs(t, err, ErrTokenExpired)
+}
+
+func TestUserManager_RevokeUserTokens(t *testing.T) {
+	um := newTokenManager(t, 0)
+
+	t1, _, err := um.IssueToken("user1", "session1")
+	require.NoError(t, err)
+	t2, _, err := um.IssueToken("user2", "session2")
+	require.NoError(t, err)
+
+	um.RevokeUserTokens("user1")
+	_, _, err = um.CheckToken(t1)
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+	_, _, err = um.CheckToken(t2)
+	assert.NoError(t, err, "tokens of other users stay valid")
+
+	t3, _, err := um.IssueToken("user1", "session3")
+	require.NoError(t, err)
+	_, _, err = um.CheckToken(t3)
+	assert.NoError(t, err, "tokens issued after revocation are valid")
+}
@@ -2,26 +2,34 @@ package user
 
 import (
 	"bufio"
+	"crypto/hmac"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-type authenticatedUsers struct {
-	users map[string]string
-	mutex sync.Mutex
-}
-
 type UserManager struct {
-	PwFile             string
-	users              map[string]string   // keys: username / values: password hash
-	authenticatedUsers *authenticatedUsers // keys: username / values: ip address
+	PwFile      string
+	AclFile     string            // optional, see loadACL for format
+	MaxSessions int               // sessions each user may have open, 0 is unlimited
+	TokenTTL    time.Duration     // lifetime of session tokens, DefaultTokenTTL when not set
+	TokenKey    []byte            // optional, key signing session tokens, random one when not set
+	Cleartext   bool              // accept passwords sent in clear without tls, see StartScram
+	users       map[string]string // keys: username / values: SCRAM verifier or bcrypt hash
+	saltKey     []byte            // key made up challenges are derived from, see loadSaltKey
+	acls        map[string]ACL    // keys: username / values: permissions
+	sessions    *sessions
+	tokens      *tokens
+	mutex       sync.RWMutex // guards users, acls and password file
+	reload      sync.Mutex   // serializes reloads
 }
 
 type Creadential struct {
@@ -32,92 +40,122 @@ type Creadential struct {
 var (
 	ErrInvalidUsername     = errors.New("username is invalid. it can contains letters, numbers and underscores but should starts with a letter")
 	ErrUsernameExists      = errors.New("username exists")
+	ErrUnknownUser         = errors.New("unknown user")
+	ErrEmptyPassword       = errors.New("password is empty")
 	ErrPwFileContentFormat = errors.New("something is wrong with the password file content format")
 )
 
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z]\w*$`)
+
 const (
 	columnSep  = ":"
-	hashCost   = 14
+	lockMark   = "!" // prefix of password hash of locked users
+	hashCost   = 14  // of bcrypt hashes from before SCRAM verifiers, only checked
 	pwFileMode = 0600
 )
 
 func (m *UserManager) Init() error {
-	m.users = make(map[string]string)
-	m.authenticatedUsers = &authenticatedUsers{users: make(map[string]string)}
+	if m.sessions == nil {
+		m.sessions = &sessions{byId: make(map[string]*session), killed: make(map[string]time.Time)}
+	}
+	if m.tokens == nil {
+		t, err := newTokens(m.TokenKey)
+		if err != nil {
+			return err
+		}
+		m.tokens = t
+	}
+	if m.saltKey == nil {
+		key, err := loadSaltKey(m.PwFile + saltKeySuffix)
+		if err != nil {
+			return err
+		}
+		m.saltKey = key
+	}
 
 	f, err := os.OpenFile(m.PwFile, os.O_CREATE|os.O_RDONLY, pwFileMode)
 	if err != nil {
 		return err
 	}
+	f.Close()
+
+	users, acls, err := m.load()
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.users, m.acls = users, acls
+	m.mutex.Unlock()
+	return nil
+}
+
+// load
+// read password file and, when set, acl file.
+func (m *UserManager) load() (map[string]string, map[string]ACL, error) {
+	users, err := loadPwFile(m.PwFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var acls map[string]ACL
+	if m.AclFile != "" {
+		acls, err = loadACL(m.AclFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return users, acls, nil
+}
+
+func loadPwFile(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 
+	users := make(map[string]string)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
 		userFields := strings.Split(line, columnSep)
 		if len(userFields) != 2 || userFields[0] == "" || userFields[1] == "" {
 			subErr := fmt.Errorf("(len: %d, fields: %v)", len(userFields), userFields)
-			return errors.Join(ErrPwFileContentFormat, subErr)
+			return nil, errors.Join(ErrPwFileContentFormat, subErr)
 		}
-		m.users[userFields[0]] = userFields[1]
+		users[userFields[0]] = userFields[1]
 	}
 
-	err = scanner.Err()
-	if err != nil {
-		return err
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return users, nil
 }
 
+// CreateUser
+// add a user with given password to password file.
 func (m *UserManager) CreateUser(cred *Creadential) error {
-	var username string
-	var password string
-	usernameRegex := regexp.MustCompile(`^[a-zA-Z]\w*$`)
-	if cred != nil {
-		if usernameRegex.MatchString(cred.Username) {
-			if _, ok := m.users[cred.Username]; ok {
-				return ErrUsernameExists
-			} else {
-				username = cred.Username
-			}
-		} else {
-			return ErrInvalidUsername
-		}
-
-		password = cred.Password
-	} else {
-		for {
-			fmt.Print("Enter username: ")
-			fmt.Scanln(&username)
-			if usernameRegex.MatchString(username) {
-				if _, ok := m.users[username]; ok {
-					fmt.Println(ErrUsernameExists)
-				} else {
-					break
-				}
-			} else {
-				fmt.Println(ErrInvalidUsername)
-			}
-		}
-
-		fmt.Printf("Password for %s: ", username)
-		fmt.Scanln(&password)
-
-		var passwordConfirm string
-		fmt.Printf("Confirm password for %s: ", username)
-		fmt.Scanln(&passwordConfirm)
-		if password != passwordConfirm {
-			return errors.New("ERROR: Password does not match.")
-		}
+	if cred == nil || !usernameRegex.MatchString(cred.Username) {
+		return ErrInvalidUsername
+	}
+	if cred.Password == "" {
+		return ErrEmptyPassword
 	}
 
-	hashPass, err := m.hashPassword(password)
+	hashPass, err := m.hashPassword(cred.Password)
 	if err != nil {
 		return err
 	}
 
-	userRecord := username + columnSep + hashPass + "\n"
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.users[cred.Username]; ok {
+		return ErrUsernameExists
+	}
+
+	userRecord := cred.Username + columnSep + hashPass + "\n"
 	f, err := os.OpenFile(m.PwFile, os.O_APPEND|os.O_WRONLY, pwFileMode)
 	if err != nil {
 		return err
@@ -129,116 +167,237 @@ func (m *UserManager) CreateUser(cred *Creadential) error {
 		return err
 	}
 
+	if m.users != nil {
+		m.users[cred.Username] = hashPass
+	}
 	return nil
 }
 
+// DeleteUser
+// remove a user from password file, its sessions are ended and its tokens
+// revoked.
 func (m *UserManager) DeleteUser(username string) error {
-	if username == "" {
-		fmt.Print("Enter username to DELETE: ")
-		fmt.Scanln(&username)
+	if err := m.updatePwFile(username, func(string) string { return "" }); err != nil {
+		return err
 	}
+	m.logout(username)
+	return nil
+}
 
-	if _, ok := m.users[username]; ok {
-		delete(m.users, username)
+// SetPassword
+// replace password of a user, a locked user stays locked.
+func (m *UserManager) SetPassword(username string, password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
 
-		originalPw, err := os.OpenFile(m.PwFile, os.O_RDONLY, pwFileMode)
-		if err != nil {
-			return err
+	verifier, err := m.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return m.updatePwFile(username, func(hash string) string {
+		if strings.HasPrefix(hash, lockMark) {
+			return lockMark + verifier
 		}
-		defer originalPw.Close()
+		return verifier
+	})
+}
 
-		tmpPw, err := os.CreateTemp(filepath.Dir(m.PwFile), "pwfile_*.tmp")
-		if err != nil {
-			return err
+// Lock
+// refuse logins of a user until it is unlocked, its password is kept. its
+// sessions are ended and its tokens revoked.
+func (m *UserManager) Lock(username string) error {
+	err := m.updatePwFile(username, func(hash string) string {
+		if strings.HasPrefix(hash, lockMark) {
+			return hash
 		}
-		defer tmpPw.Close()
-		defer os.Remove(tmpPw.Name())
+		return lockMark + hash
+	})
+	if err != nil {
+		return err
+	}
+	m.logout(username)
+	return nil
+}
 
-		scanner := bufio.NewScanner(originalPw)
-		writer := bufio.NewWriter(tmpPw)
+// Unlock
+// accept logins of a locked user again.
+func (m *UserManager) Unlock(username string) error {
+	return m.updatePwFile(username, func(hash string) string {
+		return strings.TrimPrefix(hash, lockMark)
+	})
+}
 
-		for scanner.Scan() {
-			line := scanner.Text()
-			userFields := strings.Split(line, columnSep)
+// UserInfo
+// a user of password file, Legacy users still have a bcrypt hash from before
+// SCRAM verifiers.
+type UserInfo struct {
+	Username string
+	Locked   bool
+	Legacy   bool
+}
 
-			if len(userFields) != 2 || userFields[0] == "" || userFields[1] == "" || userFields[0] == username {
-				continue
-			}
+// Users
+// users of password file, sorted by name.
+func (m *UserManager) Users() []UserInfo {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	list := make([]UserInfo, 0, len(m.users))
+	for username, hash := range m.users {
+		list = append(list, UserInfo{
+			Username: username,
+			Locked:   strings.HasPrefix(hash, lockMark),
+			Legacy:   !isScram(strings.TrimPrefix(hash, lockMark)),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Username < list[j].Username
+	})
+	return list
+}
 
-			_, err = writer.WriteString(line + "\n")
-			if err != nil {
-				return err
-			}
-		}
+// updatePwFile
+// replace password hash of given user in password file and user table with
+// the one update returns for the current hash, an empty hash removes the user.
+func (m *UserManager) updatePwFile(username string, update func(hash string) string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-		if err := scanner.Err(); err != nil {
-			return err
-		}
+	current, ok := m.users[username]
+	if !ok {
+		return errors.Join(ErrUnknownUser, fmt.Errorf("user %q", username))
+	}
+	hash := update(current)
+	if hash == current {
+		return nil
+	}
 
-		if err := writer.Flush(); err != nil {
-			return nil
-		}
+	originalPw, err := os.OpenFile(m.PwFile, os.O_RDONLY, pwFileMode)
+	if err != nil {
+		return err
+	}
+	defer originalPw.Close()
 
-		if err := os.Rename(tmpPw.Name(), m.PwFile); err != nil {
-			return err
+	tmpPw, err := os.CreateTemp(filepath.Dir(m.PwFile), "pwfile_*.tmp")
+	if err != nil {
+		return err
+	}
+	defer tmpPw.Close()
+	defer os.Remove(tmpPw.Name())
+
+	scanner := bufio.NewScanner(originalPw)
+	writer := bufio.NewWriter(tmpPw)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		userFields := strings.Split(line, columnSep)
+
+		if len(userFields) != 2 || userFields[0] == "" || userFields[1] == "" {
+			continue
+		}
+		if userFields[0] == username {
+			if hash == "" {
+				continue
+			}
+			line = username + columnSep + hash
 		}
 
-		if err := os.Chmod(m.PwFile, pwFileMode); err != nil {
+		_, err = writer.WriteString(line + "\n")
+		if err != nil {
 			return err
 		}
+	}
 
-		return nil
+	if err := scanner.Err(); err != nil {
+		return err
 	}
 
-	return nil
-}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
 
-func (m *UserManager) CheckUserPassword(username, password string) bool {
-	if passwordHash, ok := m.users[username]; ok {
-		return m.checkPasswordHash(password, passwordHash)
+	if err := os.Rename(tmpPw.Name(), m.PwFile); err != nil {
+		return err
 	}
 
-	return false
-}
+	if err := os.Chmod(m.PwFile, pwFileMode); err != nil {
+		return err
+	}
 
-func (m *UserManager) CheckUserIP(username, ipAddr string) bool {
-	m.authenticatedUsers.mutex.Lock()
-	defer m.authenticatedUsers.mutex.Unlock()
-	if userIP, ok := m.authenticatedUsers.users[username]; ok {
-		return ipAddr == userIP
+	if hash == "" {
+		delete(m.users, username)
 	} else {
-		return false
+		m.users[username] = hash
 	}
+	return nil
 }
 
-// Set username/ip to the authenticated users map.
-// returns false if the user not exists or it already exists in authenticated users map.
-func (m *UserManager) SetAuthenticatedUser(username, ip string) (ok bool) {
-	if _, ok := m.users[username]; ok {
-		m.authenticatedUsers.mutex.Lock()
-		defer m.authenticatedUsers.mutex.Unlock()
-		if _, ok := m.authenticatedUsers.users[username]; !ok {
-			m.authenticatedUsers.users[username] = ip
-			return true
+// CheckUserPassword
+// check a password sent in clear. a bcrypt hash from before SCRAM is replaced
+// by a verifier of the password on success.
+func (m *UserManager) CheckUserPassword(username, password string) bool {
+	hash, ok := m.hash(username)
+	if !ok || strings.HasPrefix(hash, lockMark) {
+		return false
+	}
+
+	if isScram(hash) {
+		v, err := parseScramVerifier(hash)
+		if err != nil {
+			return false
 		}
+		return hmac.Equal(scramVerifierFrom(password, v.salt, v.iterations).storedKey, v.storedKey)
+	}
 
+	if !m.checkPasswordHash(password, hash) {
 		return false
 	}
 
-	return false
+	// migration is tried again on next login when it fails.
+	if verifier, err := m.hashPassword(password); err == nil {
+		_ = m.updatePwFile(username, func(current string) string {
+			if current != hash {
+				return current // changed meanwhile
+			}
+			return verifier
+		})
+	}
+	return true
+}
+
+// HasUser
+// check whether given user exists.
+func (m *UserManager) HasUser(username string) bool {
+	_, ok := m.hash(username)
+	return ok
 }
 
-// Removes username from authenticated users map.
-func (m *UserManager) UnsetAuthenticatedUser(username string) {
-	m.authenticatedUsers.mutex.Lock()
-	defer m.authenticatedUsers.mutex.Unlock()
-	delete(m.authenticatedUsers.users, username)
+// Active
+// check whether given user exists and is not locked, only active users log
+// in, with password, client certificate or token.
+func (m *UserManager) Active(username string) bool {
+	hash, ok := m.hash(username)
+	return ok && !strings.HasPrefix(hash, lockMark)
 }
 
-func (m *UserManager) hashPassword(password string) (string, error) {
-	byts, err := bcrypt.GenerateFromPassword([]byte(password), hashCost)
+func (m *UserManager) hash(username string) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	hash, ok := m.users[username]
+	return hash, ok
+}
 
-	return string(byts), err
+// hashPassword
+// SCRAM verifier of a password, see scramVerifier.
+func (m *UserManager) hashPassword(password string) (string, error) {
+	v, err := newScramVerifier(password)
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
 }
 
 func (m *UserManager) checkPasswordHash(password, hash string) bool {
@@ -84,8 +84,7 @@ func TestUserManager_Init(t *testing.T) {
 			} else {
 				assert.NoError(t, err)
 				assert.Equal(t, tt.expectedUsers, um.users)
-				assert.NotNil(t, um.authenticatedUsers)
-				assert.NotNil(t, um.authenticatedUsers.users)
+				assert.NotNil(t, um.sessions)
 			}
 		})
 	}
@@ -131,6 +130,20 @@ func TestUserManager_CreateUser(t *testing.T) {
 			credential:    &Creadential{Username: "user123", Password: "testpass"},
 			expectError:   false,
 		},
+		{
+			name:          "empty password",
+			pwFileContent: "",
+			credential:    &Creadential{Username: "testuser", Password: ""},
+			expectError:   true,
+			expectedError: ErrEmptyPassword,
+		},
+		{
+			name:          "no credential",
+			pwFileContent: "",
+			credential:    nil,
+			expectError:   true,
+			expectedError: ErrInvalidUsername,
+		},
 		{
 			name:          "username already exists",
 			pwFileContent: fmt.Sprintf("testuser%ssomehash", columnSep),
@@ -193,14 +206,14 @@ func TestUserManager_DeleteUser(t *testing.T) {
 			name:         "delete non-existing user",
 			initialUsers: map[string]string{"user1": "hash1"},
 			userToDelete: "nonexistent",
-			expectError:  false,
+			expectError:  true,
 			shouldDelete: false,
 		},
 		{
 			name:         "empty username",
 			initialUsers: map[string]string{"user1": "hash1"},
 			userToDelete: "",
-			expectError:  false,
+			expectError:  true,
 			shouldDelete: false,
 		},
 	}
@@ -229,7 +242,7 @@ func TestUserManager_DeleteUser(t *testing.T) {
 			err = um.DeleteUser(tt.userToDelete)
 
 			if tt.expectError {
-				assert.Error(t, err)
+				assert.ErrorIs(t, err, ErrUnknownUser)
 			} else {
 				assert.NoError(t, err)
 
@@ -244,6 +257,43 @@ func TestUserManager_DeleteUser(t *testing.T) {
 	}
 }
 
+func TestUserManager_LockUser(t *testing.T) {
+	v, err := newScramVerifier("secret")
+	require.NoError(t, err)
+	um := newScramManager(t, "user1:"+v.String(), "user2:$2a$14$hash2")
+
+	token, _, err := um.IssueToken("user1", "session1")
+	require.NoError(t, err)
+
+	require.NoError(t, um.Lock("user1"))
+	require.NoError(t, um.Lock("user1"), "locking twice")
+	assert.True(t, um.HasUser("user1"))
+	assert.False(t, um.Active("user1"))
+	assert.False(t, um.CheckUserPassword("user1", "secret"))
+	ok, _ := scramLogin(t, um, "user1", "secret")
+	assert.False(t, ok)
+	_, _, err = um.CheckToken(token)
+	assert.ErrorIs(t, err, ErrTokenRevoked)
+
+	// password change keeps the lock, lock survives a restart.
+	require.NoError(t, um.SetPassword("user1", "other"))
+	require.NoError(t, um.Init())
+	assert.Equal(t, []UserInfo{
+		{Username: "user1", Locked: true},
+		{Username: "user2", Legacy: true},
+	}, um.Users())
+
+	require.NoError(t, um.Unlock("user1"))
+	assert.True(t, um.Active("user1"))
+	assert.True(t, um.CheckUserPassword("user1", "other"))
+	assert.False(t, um.CheckUserPassword("user1", "secret"))
+
+	assert.ErrorIs(t, um.Lock("nobody"), ErrUnknownUser)
+	assert.ErrorIs(t, um.Unlock("nobody"), ErrUnknownUser)
+	assert.ErrorIs(t, um.SetPassword("nobody", "secret"), ErrUnknownUser)
+	assert.ErrorIs(t, um.SetPassword("user1", ""), ErrEmptyPassword)
+}
+
 func TestUserManager_CheckUserPassword(t *testing.T) {
 	// Create a test password hash
 	testPassword := "testpass123"
@@ -296,129 +346,6 @@ func TestUserManager_CheckUserPassword(t *testing.T) {
 	}
 }
 
-func TestUserManager_CheckUserIP(t *testing.T) {
-	tests := []struct {
-		name              string
-		authenticatedUser map[string]string
-		username          string
-		ipAddr            string
-		expected          bool
-	}{
-		{
-			name:              "valid IP check",
-			authenticatedUser: map[string]string{"user1": "192.168.1.1"},
-			username:          "user1",
-			ipAddr:            "192.168.1.1",
-			expected:          true,
-		},
-		{
-			name:              "invalid IP check",
-			authenticatedUser: map[string]string{"user1": "192.168.1.1"},
-			username:          "user1",
-			ipAddr:            "192.168.1.2",
-			expected:          false,
-		},
-		{
-			name:              "user not authenticated",
-			authenticatedUser: map[string]string{},
-			username:          "user1",
-			ipAddr:            "192.168.1.1",
-			expected:          false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			um := &UserManager{
-				authenticatedUsers: &authenticatedUsers{
-					users: tt.authenticatedUser,
-				},
-			}
-			result := um.CheckUserIP(tt.username, tt.ipAddr)
-			assert.Equal(t, tt.expected, result)
-		})
-	}
-}
-
-func TestUserManager_SetAuthenticatedUser(t *testing.T) {
-	tests := []struct {
-		name                    string
-		users                   map[string]string
-		authenticatedUsers      map[string]string
-		username                string
-		ip                      string
-		expectedResult          bool
-		expectedAuthenticatedIP string
-	}{
-		{
-			name:                    "set new authenticated user",
-			users:                   map[string]string{"user1": "hash1"},
-			authenticatedUsers:      map[string]string{},
-			username:                "user1",
-			ip:                      "192.168.1.1",
-			expectedResult:          true,
-			expectedAuthenticatedIP: "",
-		},
-		{
-			name:                    "deny to update existing authenticated user",
-			users:                   map[string]string{"user1": "hash1"},
-			authenticatedUsers:      map[string]string{"user1": "192.168.1.1"},
-			username:                "user1",
-			ip:                      "192.168.1.2",
-			expectedResult:          false,
-			expectedAuthenticatedIP: "192.168.1.1",
-		},
-		{
-			name:               "user doesn't exist",
-			users:              map[string]string{},
-			authenticatedUsers: map[string]string{},
-			username:           "nonexistent",
-			ip:                 "192.168.1.1",
-			expectedResult:     false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			um := &UserManager{
-				users: tt.users,
-				authenticatedUsers: &authenticatedUsers{
-					users: tt.authenticatedUsers,
-				},
-			}
-
-			result := um.SetAuthenticatedUser(tt.username, tt.ip)
-			assert.Equal(t, tt.expectedResult, result)
-
-			if tt.expectedAuthenticatedIP != "" {
-				assert.Equal(t, tt.expectedAuthenticatedIP, um.authenticatedUsers.users[tt.username])
-			}
-		})
-	}
-}
-
-func TestUserManager_UnsetAuthenticatedUser(t *testing.T) {
-	authUsers := map[string]string{
-		"user1": "192.168.1.1",
-		"user2": "192.168.1.2",
-	}
-
-	um := &UserManager{
-		authenticatedUsers: &authenticatedUsers{
-			users: authUsers,
-		},
-	}
-
-	// Test removing existing user
-	um.UnsetAuthenticatedUser("user1")
-	assert.NotContains(t, um.authenticatedUsers.users, "user1")
-	assert.Contains(t, um.authenticatedUsers.users, "user2")
-
-	// Test removing non-existent user (should not panic)
-	um.UnsetAuthenticatedUser("nonexistent")
-	assert.Contains(t, um.authenticatedUsers.users, "user2")
-}
-
 func TestUserManager_hashPassword(t *testing.T) {
 	um := &UserManager{}
 
@@ -429,9 +356,10 @@ func TestUserManager_hashPassword(t *testing.T) {
 	assert.NotEmpty(t, hash)
 	assert.NotEqual(t, password, hash)
 
-	// Verify the hash can be used to verify the password
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	assert.NoError(t, err)
+	// Verify the hash is a verifier of the password
+	v, err := parseScramVerifier(hash)
+	require.NoError(t, err)
+	assert.Equal(t, scramVerifierFrom(password, v.salt, v.iterations), v)
 }
 
 func TestUserManager_checkPasswordHash(t *testing.T) {
@@ -453,51 +381,3 @@ func TestUserManager_checkPasswordHash(t *testing.T) {
 	result = um.checkPasswordHash(password, "invalid_hash")
 	assert.False(t, result)
 }
-
-// Test concurrent access to authenticatedUsers
-func TestUserManager_ConcurrentAccess(t *testing.T) {
-	um := &UserManager{
-		users: map[string]string{"user1": "hash1"},
-		authenticatedUsers: &authenticatedUsers{
-			users: make(map[string]string),
-		},
-	}
-
-	// Add initial authenticated user
-	um.authenticatedUsers.users["user1"] = "192.168.1.1"
-
-	// Test concurrent access
-	done := make(chan bool)
-
-	// Goroutine 1: Check IP
-	go func() {
-		for i := 0; i < 100; i++ {
-			um.CheckUserIP("user1", "192.168.1.1")
-		}
-		done <- true
-	}()
-
-	// Goroutine 2: Set authenticated user
-	go func() {
-		for i := 0; i < 100; i++ {
-			um.SetAuthenticatedUser("user1", "192.168.1.1")
-		}
-		done <- true
-	}()
-
-	// Goroutine 3: Unset authenticated user
-	go func() {
-		for i := 0; i < 100; i++ {
-			um.UnsetAuthenticatedUser("user1")
-		}
-		done <- true
-	}()
-
-	// Wait for all goroutines to complete
-	for i := 0; i < 3; i++ {
-		<-done
-	}
-
-	// Test should not panic - if it gets here, mutex is working
-	assert.True(t, true)
-}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package watcher
+
+import "os"
+
+// inode numbers aren't available, renames are never paired into moves.
+func inode(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
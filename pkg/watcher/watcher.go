@@ -2,14 +2,19 @@ package watcher
 
 import (
 	"fmt"
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
 	"github.com/fsnotify/fsnotify"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
+const defaultRenameWindow = time.Millisecond * 100
+
 type Option func(w *Watcher)
 
 func WithCallbackFunction(hook func(e model.Event, err error)) Option {
@@ -21,12 +26,6 @@ func WithCallbackFunction(hook func(e model.Event, err error)) Option {
 			for {
 				select {
 				case e := <-ech:
-					if e.Op == model.Create {
-						fs, _ := os.Stat(e.Name)
-						if fs != nil && fs.IsDir() {
-							_ = w.fw.Add(e.Name)
-						}
-					}
 					hook(e, nil)
 				case <-w.closed:
 					for e := range ech {
@@ -45,13 +44,78 @@ func WithBufferSize(size int32) Option {
 	}
 }
 
+// WithRenameWindow
+// how long a rename waits for the create of the new name before it is
+// reported as a plain rename (file moved out of watched path).
+func WithRenameWindow(window time.Duration) Option {
+	return func(w *Watcher) {
+		w.renameWindow = window
+	}
+}
+
+// WithIgnore
+// names for which no event is reported, such as temporary files. a file
+// renamed from an ignored name is reported as written.
+func WithIgnore(ignore func(name string) bool) Option {
+	return func(w *Watcher) {
+		w.ignore = ignore
+	}
+}
+
+// WithFilter
+// names matching filter are not reported, ignored directories are not watched
+// at all.
+func WithFilter(f *filter.Filter) Option {
+	return func(w *Watcher) {
+		w.filter = f
+	}
+}
+
+// WithFollowSymlinks
+// symbolic links to directories inside watched path are watched as
+// directories, as file handler tracks them with follow-within-root policy.
+// a link to one of its own parents is not followed.
+func WithFollowSymlinks(follow bool) Option {
+	return func(w *Watcher) {
+		w.follow = follow
+	}
+}
+
 type Watcher struct {
-	fw         *fsnotify.Watcher
-	closed     chan struct{}
-	subs       []chan model.Event
-	bufferSize int32
-	wg         sync.WaitGroup
-	path       string
+	fw           *fsnotify.Watcher
+	closed       chan struct{}
+	subs         []chan model.Event
+	bufferSize   int32
+	wg           sync.WaitGroup
+	path         string
+	renameWindow time.Duration
+	ignore       func(name string) bool
+	filter       *filter.Filter
+	follow       bool
+
+	// inodes
+	// inode of every known path, a rename followed by a create of the same
+	// inode is reported as a single move event. only used by run routine.
+	inodes map[string]uint64
+	// dirs
+	// watched directories, their removal is reported as rmdir.
+	dirs map[string]struct{}
+	// gone
+	// directories already reported as removed or moved, watch of directory
+	// itself reports the same change again.
+	gone map[string]struct{}
+	// walking
+	// real paths of directories being walked by watchPath when links are
+	// followed, a link to one of them is a loop.
+	walking map[string]struct{}
+}
+
+// pendingRename
+// rename waiting for its create.
+type pendingRename struct {
+	name  string
+	inode uint64
+	timer *time.Timer
 }
 
 func NewWatcher(path string, options ...Option) (*Watcher, error) {
@@ -67,48 +131,125 @@ func NewWatcher(path string, options ...Option) (*Watcher, error) {
 		bufferSize: 25,
 		wg:         sync.WaitGroup{},
 		path:       path,
-	}
 
-	err = w.watchPath(path)
-	if err != nil {
-		return nil, err
+		renameWindow: defaultRenameWindow,
+		inodes:       make(map[string]uint64),
+		dirs:         make(map[string]struct{}),
+		gone:         make(map[string]struct{}),
+		walking:      make(map[string]struct{}),
 	}
 
 	for _, op := range options {
 		op(&w)
 	}
 
+	err = w.watchPath(path, nil)
+	if err != nil {
+		_ = fw.Close()
+		close(w.closed)
+		for i := range w.subs {
+			close(w.subs[i])
+		}
+		w.wg.Wait()
+		return nil, err
+	}
+
 	go w.run()
 
 	return &w, nil
 }
 
-func (w *Watcher) watchPath(path string) error {
-	files, err := ioutil.ReadDir(path)
+// watchPath
+// watch given directory and its sub directories, when emit is set every
+// entry found is reported too (directory created or moved in with content).
+func (w *Watcher) watchPath(path string, emit func(model.Event)) error {
+	// watch is added before reading, so nothing created meanwhile is missed.
+	err := w.fw.Add(path)
 	if err != nil {
 		return err
 	}
+	w.dirs[strings.TrimPrefix(path, "./")] = struct{}{}
 
-	for _, f := range files {
-		if f.IsDir() {
-			err = w.watchPath(fmt.Sprintf("%s/%s", path, f.Name()))
-			if err != nil {
-				return err
-			}
+	if w.follow {
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			w.walking[real] = struct{}{}
+			defer delete(w.walking, real)
 		}
 	}
 
-	err = w.fw.Add(path)
+	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		return err
 	}
+
+	for _, f := range files {
+		name := fmt.Sprintf("%s/%s", path, f.Name())
+		key := strings.TrimPrefix(name, "./")
+		dir := f.IsDir() || w.linkedDir(name)
+		if w.ignored(key, dir) {
+			continue
+		}
+		if ino, ok := inode(f); ok {
+			w.inodes[key] = ino
+		}
+
+		if !dir && w.follow && f.Mode()&os.ModeSymlink != 0 {
+			if fs, err := os.Stat(name); err == nil && fs.IsDir() {
+				continue // link to a directory which isn't followed, a loop.
+			}
+		}
+		if !dir {
+			if emit != nil {
+				emit(model.Event{Name: key, Op: model.Write})
+			}
+			continue
+		}
+
+		if emit != nil {
+			emit(model.Event{Name: key, Op: model.Mkdir})
+		}
+		err = w.watchPath(name, emit)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (w *Watcher) fanOut(e fsnotify.Event) {
-	event := model.Event{
-		Name: e.Name,
-		Op:   model.Op(e.Op),
+// ignored
+// check whether given name is ignored by ignore function or filter.
+func (w *Watcher) ignored(name string, dir bool) bool {
+	if w.ignore != nil && w.ignore(name) {
+		return true
+	}
+	if w.filter == nil {
+		return false
+	}
+
+	root := strings.TrimPrefix(w.path, "./")
+	if root != "." && root != "" {
+		name = strings.TrimPrefix(name, root+"/")
+	}
+	return w.filter.Match(name, dir)
+}
+
+func (w *Watcher) fanOut(event model.Event) {
+	if event.Op != model.Exit {
+		_, dir := w.dirs[event.Name]
+		dir = dir || event.Op.Has(model.Mkdir) || event.Op.Has(model.Rmdir)
+		switch {
+		case event.Op == model.Move && w.ignored(event.OldName, dir) && !w.ignored(event.Name, dir):
+			// temporary file renamed into place, its content is new.
+			event = model.Event{Name: event.Name, Op: model.Write}
+		case event.Op == model.Move && w.ignored(event.Name, dir) && !w.ignored(event.OldName, dir):
+			event = model.Event{Name: event.OldName, Op: model.Rename}
+			if dir {
+				event.Op = model.Rmdir
+			}
+		case w.ignored(event.Name, dir):
+			return
+		}
 	}
 
 	for i := range w.subs {
@@ -117,6 +258,27 @@ func (w *Watcher) fanOut(e fsnotify.Event) {
 }
 
 func (w *Watcher) run() {
+	var pending *pendingRename
+	var expired <-chan time.Time
+	// staged is set after an ignored file is renamed before its inode was
+	// known, the create which follows is most likely the file put in place.
+	var staged bool
+
+	flush := func() {
+		if pending == nil {
+			return
+		}
+		pending.timer.Stop()
+		delete(w.inodes, pending.name)
+		if _, ok := w.dirs[pending.name]; ok {
+			w.unwatch(pending.name)
+			w.fanOut(model.Event{Name: pending.name, Op: model.Rmdir})
+		} else {
+			w.fanOut(model.Event{Name: pending.name, Op: model.Rename})
+		}
+		pending, expired = nil, nil
+	}
+
 	for {
 		select {
 		case e := <-w.fw.Events:
@@ -125,13 +287,85 @@ func (w *Watcher) run() {
 			}
 
 			e.Name = strings.TrimPrefix(e.Name, "./")
-			w.fanOut(e)
+			event := model.Event{
+				Name: e.Name,
+				Op:   model.Op(e.Op),
+			}
+
+			if pending != nil && event.Op == model.Rename && event.Name == pending.name {
+				continue // watch of moved directory reports the rename too.
+			}
+
+			if pending != nil && event.Op == model.Create {
+				if fs, err := os.Lstat(event.Name); err == nil {
+					if ino, ok := inode(fs); ok && ino == pending.inode {
+						pending.timer.Stop()
+						w.move(pending.name, event.Name, fs)
+						w.fanOut(model.Event{Name: event.Name, Op: model.Move, OldName: pending.name})
+						pending, expired = nil, nil
+						continue
+					}
+				}
+			}
+			flush()
+
+			switch {
+			case event.Op == model.Rename || event.Op.Has(model.Remove):
+				if _, ok := w.gone[event.Name]; ok {
+					continue
+				}
+				if event.Op == model.Rename {
+					if ino, ok := w.inodes[event.Name]; ok {
+						pending = &pendingRename{name: event.Name, inode: ino, timer: time.NewTimer(w.renameWindow)}
+						expired = pending.timer.C
+						continue
+					}
+					if w.ignored(event.Name, false) {
+						staged = true
+						continue
+					}
+				}
+				if _, ok := w.dirs[event.Name]; !ok && w.ignored(event.Name, true) {
+					continue // ignored directory, it was never watched.
+				}
+				delete(w.inodes, event.Name)
+				if _, ok := w.dirs[event.Name]; ok {
+					w.unwatch(event.Name)
+					event.Op = model.Rmdir
+				}
+			case event.Op.Has(model.Create) || event.Op.Has(model.Write):
+				delete(w.gone, event.Name)
+				if fs, err := os.Lstat(event.Name); err == nil {
+					dir := fs.IsDir() || (event.Op.Has(model.Create) && w.linkedDir(event.Name))
+					if w.ignored(event.Name, dir) {
+						staged = false
+						continue
+					}
+					if ino, ok := inode(fs); ok {
+						w.inodes[event.Name] = ino
+					}
+					if event.Op.Has(model.Create) && dir {
+						w.fanOut(model.Event{Name: event.Name, Op: model.Mkdir})
+						_ = w.watchPath(event.Name, w.fanOut)
+						staged = false
+						continue
+					}
+				}
+				if staged && event.Op == model.Create {
+					event.Op = model.Write
+				}
+			}
+			staged = false
+
+			w.fanOut(event)
+		case <-expired:
+			flush()
 		case <-w.closed:
-			exitEvent := fsnotify.Event{
+			flush()
+			w.fanOut(model.Event{
 				Name: model.ExitName,
-				Op:   fsnotify.Op(model.Exit),
-			}
-			w.fanOut(exitEvent)
+				Op:   model.Exit,
+			})
 			for i := range w.subs {
 				close(w.subs[i])
 			}
@@ -140,6 +374,92 @@ func (w *Watcher) run() {
 	}
 }
 
+// move
+// update inode cache after rename, a moved directory is watched under its new
+// name together with its sub directories.
+func (w *Watcher) move(from string, to string, fs os.FileInfo) {
+	if ino, ok := w.inodes[from]; ok {
+		delete(w.inodes, from)
+		w.inodes[to] = ino
+	}
+
+	if !fs.IsDir() {
+		return
+	}
+
+	prefix := from + "/"
+	for name, ino := range w.inodes {
+		if strings.HasPrefix(name, prefix) {
+			delete(w.inodes, name)
+			w.inodes[to+"/"+strings.TrimPrefix(name, prefix)] = ino
+		}
+	}
+
+	w.unwatch(from)
+	delete(w.gone, to)
+	if w.ignored(to, true) {
+		return
+	}
+	_ = w.watchPath(to, nil)
+}
+
+// linkedDir
+// check whether given path is a symbolic link to be watched as directory, it
+// must point to a directory inside watched path which is neither being walked
+// nor one of the link parents.
+func (w *Watcher) linkedDir(name string) bool {
+	if !w.follow {
+		return false
+	}
+	if fs, err := os.Lstat(name); err != nil || fs.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return false
+	}
+	if fs, err := os.Stat(real); err != nil || !fs.IsDir() {
+		return false
+	}
+	root, err := filepath.EvalSymlinks(w.path)
+	if err != nil {
+		return false
+	}
+	if rel, err := filepath.Rel(root, real); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+
+	if _, ok := w.walking[real]; ok {
+		return false
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(name))
+	return err == nil && parent != real && !strings.HasPrefix(parent, real+"/")
+}
+
+// unwatch
+// stop watching removed or moved directory and its sub directories.
+func (w *Watcher) unwatch(dir string) {
+	prefix := dir + "/"
+	for name := range w.dirs {
+		if name == dir || strings.HasPrefix(name, prefix) {
+			delete(w.dirs, name)
+		}
+	}
+	for name := range w.inodes {
+		if strings.HasPrefix(name, prefix) {
+			delete(w.inodes, name)
+		}
+	}
+	for _, name := range w.fw.WatchList() {
+		name = strings.TrimPrefix(name, "./")
+		if name == dir || strings.HasPrefix(name, prefix) {
+			_ = w.fw.Remove(name)
+		}
+	}
+	w.gone[dir] = struct{}{}
+}
+
 func (w *Watcher) sub() chan model.Event {
 	ch := make(chan model.Event, w.bufferSize)
 	w.subs = append(w.subs, ch)
@@ -1,10 +1,12 @@
 package watcher
 
 import (
+	"github.com/ManouchehrRasoulli/rfswatcher/pkg/filter"
 	"github.com/ManouchehrRasoulli/rfswatcher/pkg/model"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 	"os"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -140,3 +142,239 @@ func TestWatcher_WithCreateChanges(t *testing.T) {
 	require.Equal(t, int64(4), run1)
 	require.Equal(t, int64(4), run2)
 }
+
+func TestWatcher_WithMove(t *testing.T) {
+	testPath := t.TempDir()
+	outsidePath := t.TempDir()
+
+	require.NoError(t, os.WriteFile(testPath+"/a.txt", []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(testPath+"/b.txt", []byte("b"), 0644))
+
+	events := make(chan model.Event, 10)
+	c := func(e model.Event, err error) {
+		require.NoError(t, err, "got error on hook !!")
+		t.Log(e)
+		events <- e
+	}
+
+	w, e := NewWatcher(testPath, WithCallbackFunction(c), WithRenameWindow(time.Millisecond*50))
+	require.NoError(t, e, "create watcher on test path.")
+	defer w.Close()
+
+	{ // MOVE inside watched path
+		require.NoError(t, os.Rename(testPath+"/a.txt", testPath+"/c.txt"))
+		e := <-events
+		require.Equal(t, model.Move, e.Op)
+		require.Equal(t, testPath+"/a.txt", e.OldName)
+		require.Equal(t, testPath+"/c.txt", e.Name)
+	}
+
+	{ // RENAME out of watched path
+		require.NoError(t, os.Rename(testPath+"/b.txt", outsidePath+"/b.txt"))
+		e := <-events
+		require.Equal(t, model.Rename, e.Op)
+		require.Equal(t, testPath+"/b.txt", e.Name)
+	}
+}
+
+func TestWatcher_WithDirectories(t *testing.T) {
+	testPath := t.TempDir()
+
+	events := make(chan model.Event, 25)
+	c := func(e model.Event, err error) {
+		require.NoError(t, err, "got error on hook !!")
+		t.Log(e)
+		events <- e
+	}
+
+	w, e := NewWatcher(testPath, WithCallbackFunction(c), WithRenameWindow(time.Millisecond*50))
+	require.NoError(t, e, "create watcher on test path.")
+	defer w.Close()
+
+	next := func() model.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+			return model.Event{}
+		}
+	}
+
+	{ // MKDIR of empty directory
+		require.NoError(t, os.Mkdir(testPath+"/empty", 0755))
+		e := next()
+		require.Equal(t, model.Mkdir, e.Op)
+		require.Equal(t, testPath+"/empty", e.Name)
+	}
+
+	{ // RMDIR is reported once
+		require.NoError(t, os.Remove(testPath+"/empty"))
+		e := next()
+		require.Equal(t, model.Rmdir, e.Op)
+		require.Equal(t, testPath+"/empty", e.Name)
+	}
+
+	{ // directory moved in with content, every entry is reported
+		outside := t.TempDir()
+		require.NoError(t, os.MkdirAll(outside+"/tree/sub", 0755))
+		require.NoError(t, os.WriteFile(outside+"/tree/sub/a.txt", []byte("a"), 0644))
+		require.NoError(t, os.Rename(outside+"/tree", testPath+"/tree"))
+
+		got := map[string]model.Op{}
+		for len(got) < 3 {
+			e := next()
+			got[e.Name] = e.Op
+		}
+		require.Equal(t, map[string]model.Op{
+			testPath + "/tree":           model.Mkdir,
+			testPath + "/tree/sub":       model.Mkdir,
+			testPath + "/tree/sub/a.txt": model.Write,
+		}, got)
+	}
+
+	{ // RMDIR of tree, files first then directories
+		require.NoError(t, os.RemoveAll(testPath+"/tree"))
+		require.Equal(t, model.Event{Name: testPath + "/tree/sub/a.txt", Op: model.Remove}, next())
+		require.Equal(t, model.Event{Name: testPath + "/tree/sub", Op: model.Rmdir}, next())
+		require.Equal(t, model.Event{Name: testPath + "/tree", Op: model.Rmdir}, next())
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	require.Len(t, events, 0, "duplicated events")
+}
+
+func TestWatcher_WithIgnore(t *testing.T) {
+	testPath := t.TempDir()
+
+	events := make(chan model.Event, 10)
+	c := func(e model.Event, err error) {
+		require.NoError(t, err, "got error on hook !!")
+		t.Log(e)
+		events <- e
+	}
+
+	ignore := func(name string) bool { return strings.HasSuffix(name, ".tmp") }
+	w, e := NewWatcher(testPath, WithIgnore(ignore), WithCallbackFunction(c), WithRenameWindow(time.Millisecond*50))
+	require.NoError(t, e, "create watcher on test path.")
+	defer w.Close()
+
+	// staging file is written and renamed into place, only the result is reported.
+	require.NoError(t, os.WriteFile(testPath+"/a.tmp", []byte("a"), 0644))
+	require.NoError(t, os.Rename(testPath+"/a.tmp", testPath+"/a.txt"))
+
+	select {
+	case e := <-events:
+		require.Equal(t, model.Event{Name: testPath + "/a.txt", Op: model.Write}, e)
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	require.Len(t, events, 0, "events of ignored names")
+}
+
+func TestWatcher_WithFilter(t *testing.T) {
+	testPath := t.TempDir()
+	require.NoError(t, os.Mkdir(testPath+"/node_modules", 0755))
+
+	events := make(chan model.Event, 10)
+	c := func(e model.Event, err error) {
+		require.NoError(t, err, "got error on hook !!")
+		t.Log(e)
+		events <- e
+	}
+
+	f, err := filter.New("node_modules/", "*.log")
+	require.NoError(t, err)
+	w, e := NewWatcher(testPath, WithFilter(f), WithCallbackFunction(c))
+	require.NoError(t, e, "create watcher on test path.")
+	defer w.Close()
+
+	for _, name := range w.fw.WatchList() {
+		require.NotContains(t, name, "node_modules", "ignored directory is watched")
+	}
+
+	require.NoError(t, os.WriteFile(testPath+"/node_modules/a.js", []byte("a"), 0644))
+	require.NoError(t, os.Mkdir(testPath+"/web", 0755))
+	require.NoError(t, os.Mkdir(testPath+"/web/node_modules", 0755))
+	require.NoError(t, os.WriteFile(testPath+"/web/debug.log", []byte("log"), 0644))
+	require.NoError(t, os.WriteFile(testPath+"/web/index.html", []byte("html"), 0644))
+
+	select {
+	case e := <-events:
+		require.Equal(t, model.Event{Name: testPath + "/web", Op: model.Mkdir}, e)
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	var got []model.Event
+	timeout := time.After(time.Second)
+	for len(got) == 0 || got[len(got)-1].Op != model.Write {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-timeout:
+			t.Fatalf("no write event received, got %v", got)
+		}
+	}
+	for _, e := range got {
+		require.Equal(t, testPath+"/web/index.html", e.Name, "event of ignored name")
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	require.Len(t, events, 0, "events of ignored names")
+	for _, name := range w.fw.WatchList() {
+		require.NotContains(t, name, "node_modules", "ignored directory is watched")
+	}
+}
+
+func TestWatcher_WithFollowSymlinks(t *testing.T) {
+	testPath := t.TempDir()
+	require.NoError(t, os.MkdirAll(testPath+"/target/sub", 0755))
+	require.NoError(t, os.WriteFile(testPath+"/target/sub/a.txt", []byte("a"), 0644))
+	require.NoError(t, os.Symlink("..", testPath+"/target/loop"))
+
+	events := make(chan model.Event, 25)
+	c := func(e model.Event, err error) {
+		require.NoError(t, err, "got error on hook !!")
+		t.Log(e)
+		events <- e
+	}
+
+	w, e := NewWatcher(testPath, WithCallbackFunction(c), WithFollowSymlinks(true))
+	require.NoError(t, e, "create watcher on test path, loop must not recurse forever.")
+	defer w.Close()
+
+	next := func() model.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+			return model.Event{}
+		}
+	}
+
+	{ // link to a directory is reported like a directory created with content
+		require.NoError(t, os.Symlink("target", testPath+"/link"))
+		got := map[string]model.Op{}
+		for len(got) < 3 {
+			e := next()
+			got[e.Name] = e.Op
+		}
+		require.Equal(t, map[string]model.Op{
+			testPath + "/link":           model.Mkdir,
+			testPath + "/link/sub":       model.Mkdir,
+			testPath + "/link/sub/a.txt": model.Write,
+		}, got)
+	}
+
+	{ // removed link is reported as rmdir
+		require.NoError(t, os.Remove(testPath+"/link"))
+		require.Equal(t, model.Event{Name: testPath + "/link", Op: model.Rmdir}, next())
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	require.Len(t, events, 0, "duplicated events")
+}